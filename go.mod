@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/hashicorp/golang-lru v0.5.5-0.20210104140557-80c98217689d
 	github.com/holiman/uint256 v1.2.4
+	github.com/openrelayxyz/cardinal-types v1.1.1
 	github.com/openrelayxyz/plugeth-utils v1.5.0
 )
 
@@ -17,7 +18,6 @@ require (
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
 	github.com/ethereum/c-kzg-4844/bindings/go v0.0.0-20230126171313-363c7d7593b4 // indirect
 	github.com/mmcloughlin/addchain v0.4.0 // indirect
-	github.com/openrelayxyz/cardinal-types v1.1.1 // indirect
 	github.com/supranational/blst v0.3.11 // indirect
 	golang.org/x/crypto v0.17.0 // indirect
 	golang.org/x/sync v0.5.0 // indirect
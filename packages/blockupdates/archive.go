@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+const (
+	archiveJSON = "json"
+	archiveRLP = "rlp"
+
+	archivePrefix = "blockupdates-"
+	defaultArchiveFileBytes = 256 * 1024 * 1024
+)
+
+var archiveExtensions = map[string]string{
+	archiveJSON: ".ndjson",
+	archiveRLP: ".rlp",
+}
+
+// archiveOptions configures an export. Format is "json" for newline delimited
+// block updates messages, or "rlp" for a stream of archiveRecords. A new file
+// is started whenever the current one would exceed MaxFileBytes.
+type archiveOptions struct {
+	Format string `json:"format"`
+	MaxFileBytes int64 `json:"maxFileBytes"`
+}
+
+// archiveRecord is the RLP archive format for one block. Receipts are kept in
+// the JSON encoding the backend provides them in, as the consensus RLP
+// encoding of receipts drops their derived fields.
+type archiveRecord struct {
+	Number uint64
+	Hash core.Hash
+	Block []byte
+	Receipts []byte
+	StateUpdate *stateUpdate
+}
+
+// archiveEntry is the subset of an NDJSON block updates message needed to
+// restore its state update.
+type archiveEntry struct {
+	Number *hexutil.Big `json:"number"`
+	Hash core.Hash `json:"hash"`
+	StateUpdates *stateUpdate `json:"stateUpdates"`
+}
+
+type archiveResult struct {
+	Files []string `json:"files"`
+	Blocks hexutil.Uint64 `json:"blocks"`
+	Bytes hexutil.Uint64 `json:"bytes"`
+	Skipped hexutil.Uint64 `json:"skipped"`
+}
+
+// archiveWriter writes records to a series of files, rotating to a new file
+// named after its first block once the size limit is reached.
+type archiveWriter struct {
+	dir string
+	ext string
+	maxBytes int64
+	file *os.File
+	w *bufio.Writer
+	size int64
+	result *archiveResult
+}
+
+func (a *archiveWriter) write(number uint64, data []byte) error {
+	if a.file != nil && a.size > 0 && a.size + int64(len(data)) > a.maxBytes {
+		if err := a.close(); err != nil { return err }
+	}
+	if a.file == nil {
+		path := filepath.Join(a.dir, fmt.Sprintf("%v%012d%v", archivePrefix, number, a.ext))
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil { return err }
+		a.file = file
+		a.w = bufio.NewWriter(file)
+		a.size = 0
+		a.result.Files = append(a.result.Files, path)
+	}
+	if _, err := a.w.Write(data); err != nil { return err }
+	a.size += int64(len(data))
+	a.result.Bytes += hexutil.Uint64(len(data))
+	return nil
+}
+
+func (a *archiveWriter) close() error {
+	if a.file == nil { return nil }
+	file := a.file
+	a.file = nil
+	if err := a.w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ExportBlockUpdates writes the block updates for a range of canonical blocks
+// to archive files in dir. Existing files are never overwritten.
+func (a *BlockUpdatesAdmin) ExportBlockUpdates(ctx context.Context, dir string, from, to restricted.BlockNumber, opts *archiveOptions) (*archiveResult, error) {
+	if opts == nil {
+		opts = &archiveOptions{}
+	}
+	if opts.Format == "" {
+		opts.Format = archiveJSON
+	}
+	ext, ok := archiveExtensions[opts.Format]
+	if !ok { return nil, fmt.Errorf("unknown archive format %q", opts.Format) }
+	if opts.MaxFileBytes <= 0 {
+		opts.MaxFileBytes = defaultArchiveFileBytes
+	}
+	head, err := decodeHeader(a.backend.CurrentHeader())
+	if err != nil { return nil, err }
+	if to < 0 || uint64(to) > head.Number.Uint64() {
+		to = restricted.BlockNumber(head.Number.Uint64())
+	}
+	if from < 0 || to < from {
+		return nil, fmt.Errorf("invalid range %v - %v", from.Int64(), to.Int64())
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil { return nil, err }
+	result := &archiveResult{Files: []string{}}
+	w := &archiveWriter{dir: dir, ext: ext, maxBytes: opts.MaxFileBytes, result: result}
+	defer w.close()
+	for n := from; n <= to; n++ {
+		if err := ctx.Err(); err != nil { return nil, err }
+		blockBytes, err := a.backend.BlockByNumber(ctx, n.Int64())
+		if err != nil { return nil, err }
+		var block types.Block
+		if err := rlp.DecodeBytes(blockBytes, &block); err != nil { return nil, err }
+		var data []byte
+		switch opts.Format {
+		case archiveJSON:
+			update, err := blockUpdates(ctx, &block)
+			if err != nil { return nil, fmt.Errorf("block %v: %v", n.Int64(), err) }
+			data, err = json.Marshal(update)
+			if err != nil { return nil, err }
+			data = append(data, '\n')
+		case archiveRLP:
+			receipts, err := a.backend.GetReceipts(ctx, block.Hash())
+			if err != nil { return nil, fmt.Errorf("block %v: %v", n.Int64(), err) }
+			su, err := loadStateUpdate(&block)
+			if err != nil { return nil, fmt.Errorf("block %v: %v", n.Int64(), err) }
+			data, err = rlp.EncodeToBytes(archiveRecord{block.NumberU64(), block.Hash(), blockBytes, receipts, su})
+			if err != nil { return nil, err }
+		}
+		if err := w.write(uint64(n), data); err != nil { return nil, err }
+		result.Blocks++
+	}
+	if err := w.close(); err != nil { return nil, err }
+	return result, nil
+}
+
+// archiveFiles lists the archive files in dir in block order.
+func archiveFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil { return nil, err }
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, archivePrefix) { continue }
+		for _, ext := range archiveExtensions {
+			if strings.HasSuffix(name, ext) {
+				files = append(files, filepath.Join(dir, name))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readArchive calls fn with the block number, hash and state update of each
+// record in an archive file.
+func readArchive(path string, fn func(uint64, core.Hash, *stateUpdate) error) error {
+	file, err := os.Open(path)
+	if err != nil { return err }
+	defer file.Close()
+	r := bufio.NewReader(file)
+	if strings.HasSuffix(path, archiveExtensions[archiveRLP]) {
+		stream := rlp.NewStream(r, 0)
+		for {
+			var record archiveRecord
+			if err := stream.Decode(&record); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := fn(record.Number, record.Hash, record.StateUpdate); err != nil { return err }
+		}
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var entry archiveEntry
+			if err := json.Unmarshal(line, &entry); err != nil { return err }
+			if entry.Number == nil || entry.StateUpdates == nil { return fmt.Errorf("incomplete block updates entry in %v", path) }
+			if err := fn(entry.Number.ToInt().Uint64(), entry.Hash, entry.StateUpdates); err != nil { return err }
+		}
+		if err == io.EOF { return nil }
+		if err != nil { return err }
+	}
+}
+
+// ImportBlockUpdates restores the state updates from the archive files in dir.
+// Records for blocks the node does not know about, or that already have a
+// state update stored, are skipped.
+func (a *BlockUpdatesAdmin) ImportBlockUpdates(ctx context.Context, dir string) (*archiveResult, error) {
+	files, err := archiveFiles(dir)
+	if err != nil { return nil, err }
+	if len(files) == 0 { return nil, fmt.Errorf("no block updates archives found in %v", dir) }
+	result := &archiveResult{Files: files}
+	db := a.backend.ChainDb()
+	for _, path := range files {
+		err := readArchive(path, func(number uint64, hash core.Hash, su *stateUpdate) error {
+			if err := ctx.Err(); err != nil { return err }
+			if header, err := a.backend.HeaderByHash(ctx, hash); err != nil || len(header) == 0 || hasStoredStateUpdate(number, hash) {
+				result.Skipped++
+				return nil
+			}
+			data, err := encodeStoredStateUpdate(su)
+			if err != nil { return err }
+			if err := db.Put(suKey(number, hash), data); err != nil { return err }
+			reverse, parent := priorValues(number, hash, true)
+			if err := indexStateUpdate(su, reverse, parent, number, hash, true); err != nil {
+				log.Warn("Failed to index imported state update history", "number", number, "hash", hash, "err", err)
+			}
+			result.Blocks++
+			result.Bytes += hexutil.Uint64(len(data))
+			return nil
+		})
+		if err != nil { return nil, fmt.Errorf("%v: %v", path, err) }
+	}
+	log.Info("Imported state updates", "files", len(files), "restored", uint64(result.Blocks), "skipped", uint64(result.Skipped))
+	return result, nil
+}
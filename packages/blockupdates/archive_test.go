@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	su := &stateUpdate{
+		Destructs: map[core.Hash]struct{}{core.HexToHash("0x01"): {}},
+		Accounts: map[core.Hash][]byte{core.HexToHash("0x02"): []byte{1, 2, 3}},
+		Storage: map[core.Hash]map[core.Hash][]byte{core.HexToHash("0x02"): {core.HexToHash("0x03"): []byte{4}}},
+		Code: map[core.Hash][]byte{core.HexToHash("0x04"): []byte{5, 6}},
+	}
+	for _, format := range []string{archiveJSON, archiveRLP} {
+		dir := t.TempDir()
+		result := &archiveResult{}
+		w := &archiveWriter{dir: dir, ext: archiveExtensions[format], maxBytes: 1, result: result}
+		for i := uint64(10); i < 13; i++ {
+			var data []byte
+			var err error
+			if format == archiveJSON {
+				data, err = json.Marshal(map[string]interface{}{"number": (*hexutil.Big)(new(big.Int).SetUint64(i)), "hash": core.BytesToHash([]byte{byte(i)}), "stateUpdates": su})
+				data = append(data, '\n')
+			} else {
+				data, err = rlp.EncodeToBytes(archiveRecord{i, core.BytesToHash([]byte{byte(i)}), nil, nil, su})
+			}
+			if err != nil {
+				t.Fatalf("Error encoding: %v", err.Error())
+			}
+			if err := w.write(i, data); err != nil {
+				t.Fatalf("Error writing: %v", err.Error())
+			}
+		}
+		if err := w.close(); err != nil {
+			t.Fatalf("Error closing: %v", err.Error())
+		}
+		files, err := archiveFiles(dir)
+		if err != nil || len(files) != 3 {
+			t.Fatalf("Expected a file per block with a tiny size limit, got %v %v", files, err)
+		}
+		var numbers []uint64
+		for _, path := range files {
+			err := readArchive(path, func(number uint64, hash core.Hash, got *stateUpdate) error {
+				numbers = append(numbers, number)
+				if hash != core.BytesToHash([]byte{byte(number)}) {
+					t.Errorf("%v: unexpected hash %#x", format, hash)
+				}
+				expected, _ := rlp.EncodeToBytes(su)
+				actual, _ := rlp.EncodeToBytes(got)
+				if string(expected) != string(actual) {
+					t.Errorf("%v: state update did not round trip", format)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Error reading %v: %v", path, err.Error())
+			}
+		}
+		if len(numbers) != 3 || numbers[0] != 10 || numbers[2] != 12 {
+			t.Errorf("%v: unexpected blocks %v", format, numbers)
+		}
+	}
+}
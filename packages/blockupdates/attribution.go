@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+var (
+	// txChangesPrefix holds the per transaction state changes of a block,
+	// keyed by number and hash like the "su" records.
+	txChangesPrefix = []byte("sx")
+	attributionKey = []byte("blockupdates-attribution")
+
+	attributionEnabled int32
+)
+
+func txChangesKey(number uint64, hash core.Hash) []byte {
+	key := make([]byte, suKeyLength)
+	copy(key, txChangesPrefix)
+	binary.BigEndian.PutUint64(key[2:10], number)
+	copy(key[10:], hash.Bytes())
+	return key
+}
+
+func parseTxChangesKey(key []byte) (uint64, core.Hash, bool) {
+	if len(key) != suKeyLength || !bytes.HasPrefix(key, txChangesPrefix) {
+		return 0, core.Hash{}, false
+	}
+	return binary.BigEndian.Uint64(key[2:10]), core.BytesToHash(key[10:]), true
+}
+
+// txAccount is the state of an account after a transaction.
+type txAccount struct {
+	Address core.Address
+	Deleted bool
+	Nonce uint64
+	Balance *big.Int
+	CodeHash core.Hash
+}
+
+func (a *txAccount) equal(b *txAccount) bool {
+	if a.Deleted || b.Deleted { return a.Deleted == b.Deleted }
+	return a.Nonce == b.Nonce && a.Balance.Cmp(b.Balance) == 0 && a.CodeHash == b.CodeHash
+}
+
+func (a txAccount) MarshalJSON() ([]byte, error) {
+	if a.Deleted {
+		return json.Marshal(map[string]interface{}{"address": a.Address, "deleted": true})
+	}
+	return json.Marshal(map[string]interface{}{
+		"address": a.Address,
+		"nonce": hexutil.Uint64(a.Nonce),
+		"balance": (*hexutil.Big)(a.Balance),
+		"codeHash": a.CodeHash,
+	})
+}
+
+type txSlot struct {
+	Address core.Address `json:"address"`
+	Slot core.Hash `json:"slot"`
+	Value core.Hash `json:"value"`
+}
+
+type txCode struct {
+	Hash core.Hash `json:"hash"`
+	Code hexutil.Bytes `json:"code"`
+}
+
+// txStateChanges are the accounts, storage slots and code a transaction
+// changed, with their values after the transaction.
+type txStateChanges struct {
+	Index hexutil.Uint64 `json:"transactionIndex"`
+	Hash core.Hash `json:"transactionHash"`
+	Accounts []txAccount `json:"accounts"`
+	Storage []txSlot `json:"storage"`
+	Code []txCode `json:"code"`
+}
+
+// attributionTracer is a live tracer that records which transaction made each
+// state change in a block. Every account a transaction calls, creates or
+// sends funds to, and every slot it writes, is compared with its value before
+// the transaction, which is either what an earlier transaction in the block
+// left it at or its value in the parent state. Changes made outside of
+// transactions, such as withdrawals, are not attributed.
+type attributionTracer struct {
+	statedb core.StateDB
+	active bool
+	number uint64
+	coinbase core.Address
+	parent *stateReader
+
+	accounts map[core.Address]*txAccount
+	storage map[core.Address]map[core.Hash]core.Hash
+	cleared map[core.Address]struct{}
+
+	touched map[core.Address]struct{}
+	slots map[core.Address]map[core.Hash]struct{}
+	current *txStateChanges
+	txs []*txStateChanges
+}
+
+// GetLiveTracer is invoked by the plugin loader for each block the node
+// processes. Any live tracer puts the EVM in debug mode and is called for
+// every opcode, so no tracer is returned unless attribution is enabled.
+func GetLiveTracer(hash core.Hash, statedb core.StateDB) core.BlockTracer {
+	if atomic.LoadInt32(&attributionEnabled) == 0 { return nil }
+	return &attributionTracer{statedb: statedb}
+}
+
+func (t *attributionTracer) fail(err error) {
+	if t.active {
+		log.Warn("Could not attribute state changes to transactions", "number", t.number, "err", err)
+	}
+	t.active = false
+}
+
+func (t *attributionTracer) PreProcessBlock(hash core.Hash, number uint64, encoded []byte) {
+	t.active = backend != nil && atomic.LoadInt32(&attributionEnabled) == 1
+	if !t.active { return }
+	t.number = number
+	var block types.Block
+	if err := rlp.DecodeBytes(encoded, &block); err != nil {
+		t.fail(err)
+		return
+	}
+	t.coinbase = block.Coinbase()
+	parentBytes, err := backend.HeaderByHash(context.Background(), block.ParentHash())
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	parent, err := decodeHeader(parentBytes)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	if t.parent, err = openState(parent.Root); err != nil {
+		t.fail(err)
+		return
+	}
+	t.accounts = make(map[core.Address]*txAccount)
+	t.storage = make(map[core.Address]map[core.Hash]core.Hash)
+	t.cleared = make(map[core.Address]struct{})
+	t.txs = nil
+}
+
+func (t *attributionTracer) PreProcessTransaction(tx core.Hash, block core.Hash, i int) {
+	if !t.active { return }
+	t.touched = map[core.Address]struct{}{t.coinbase: {}}
+	t.slots = make(map[core.Address]map[core.Hash]struct{})
+	t.current = &txStateChanges{Index: hexutil.Uint64(i), Hash: tx, Accounts: []txAccount{}, Storage: []txSlot{}, Code: []txCode{}}
+}
+
+func (t *attributionTracer) BlockProcessingError(tx core.Hash, block core.Hash, err error) {
+	t.active = false
+}
+
+func (t *attributionTracer) touch(addrs ...core.Address) {
+	if t.touched == nil { return }
+	for _, addr := range addrs {
+		t.touched[addr] = struct{}{}
+	}
+}
+
+// prevAccount returns the state of an account before the current transaction.
+func (t *attributionTracer) prevAccount(addr core.Address) (*txAccount, error) {
+	if acct, ok := t.accounts[addr]; ok { return acct, nil }
+	acct, err := t.parent.Account(crypto.Keccak256Hash(addr[:]))
+	if err != nil { return nil, err }
+	if acct == nil { return &txAccount{Address: addr, Deleted: true}, nil }
+	return &txAccount{Address: addr, Nonce: acct.Nonce, Balance: acct.Balance, CodeHash: core.BytesToHash(acct.CodeHash)}, nil
+}
+
+// prevSlot returns the value of a storage slot before the current transaction.
+func (t *attributionTracer) prevSlot(addr core.Address, slot core.Hash) (core.Hash, error) {
+	if value, ok := t.storage[addr][slot]; ok { return value, nil }
+	if _, ok := t.cleared[addr]; ok { return core.Hash{}, nil }
+	data, err := t.parent.Storage(crypto.Keccak256Hash(addr[:]), crypto.Keccak256Hash(slot[:]))
+	if err != nil || len(data) == 0 { return core.Hash{}, err }
+	_, content, _, err := rlp.Split(data)
+	if err != nil { return core.Hash{}, err }
+	return core.BytesToHash(content), nil
+}
+
+func (t *attributionTracer) PostProcessTransaction(tx core.Hash, block core.Hash, i int, receipt []byte) {
+	if !t.active || t.current == nil { return }
+	changes := t.current
+	for addr := range t.touched {
+		post := &txAccount{Address: addr, Deleted: true}
+		if t.statedb.Exist(addr) {
+			post = &txAccount{Address: addr, Nonce: t.statedb.GetNonce(addr), Balance: t.statedb.GetBalance(addr), CodeHash: t.statedb.GetCodeHash(addr)}
+		}
+		prev, err := t.prevAccount(addr)
+		if err != nil {
+			t.fail(err)
+			return
+		}
+		if !prev.equal(post) {
+			changes.Accounts = append(changes.Accounts, *post)
+			if !post.Deleted && post.CodeHash != prev.CodeHash && post.CodeHash != core.BytesToHash(emptyCodeHash) {
+				changes.Code = append(changes.Code, txCode{post.CodeHash, t.statedb.GetCode(addr)})
+			}
+		}
+		if post.Deleted && !prev.Deleted {
+			t.cleared[addr] = struct{}{}
+			delete(t.storage, addr)
+		}
+		t.accounts[addr] = post
+	}
+	for addr, slots := range t.slots {
+		for slot := range slots {
+			post := t.statedb.GetState(addr, slot)
+			prev, err := t.prevSlot(addr, slot)
+			if err != nil {
+				t.fail(err)
+				return
+			}
+			if post != prev {
+				changes.Storage = append(changes.Storage, txSlot{addr, slot, post})
+			}
+			if _, ok := t.storage[addr]; !ok {
+				t.storage[addr] = make(map[core.Hash]core.Hash)
+			}
+			t.storage[addr][slot] = post
+		}
+	}
+	sort.Slice(changes.Accounts, func(i, j int) bool { return bytes.Compare(changes.Accounts[i].Address[:], changes.Accounts[j].Address[:]) < 0 })
+	sort.Slice(changes.Storage, func(i, j int) bool {
+		if c := bytes.Compare(changes.Storage[i].Address[:], changes.Storage[j].Address[:]); c != 0 { return c < 0 }
+		return bytes.Compare(changes.Storage[i].Slot[:], changes.Storage[j].Slot[:]) < 0
+	})
+	t.txs = append(t.txs, changes)
+	t.current, t.touched, t.slots = nil, nil, nil
+}
+
+func (t *attributionTracer) PostProcessBlock(block core.Hash) {
+	if !t.active { return }
+	t.active = false
+	data, err := rlp.EncodeToBytes(t.txs)
+	if err != nil {
+		log.Warn("Failed to encode transaction state changes", "number", t.number, "err", err)
+		return
+	}
+	if err := backend.ChainDb().Put(txChangesKey(t.number, block), data); err != nil {
+		log.Warn("Failed to store transaction state changes", "number", t.number, "err", err)
+	}
+}
+
+func (t *attributionTracer) CaptureStart(from core.Address, to core.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.touch(from, to)
+}
+
+func (t *attributionTracer) CaptureState(pc uint64, op core.OpCode, gas, cost uint64, scope core.ScopeContext, rData []byte, depth int, err error) {
+	if t.touched == nil { return }
+	switch restricted.OpCode(op) {
+	case restricted.SSTORE:
+		stack := scope.Stack()
+		if stack.Len() < 1 { return }
+		addr := scope.Contract().Address()
+		if _, ok := t.slots[addr]; !ok {
+			t.slots[addr] = make(map[core.Hash]struct{})
+		}
+		t.slots[addr][core.Hash(stack.Back(0).Bytes32())] = struct{}{}
+	case restricted.SELFDESTRUCT:
+		stack := scope.Stack()
+		if stack.Len() < 1 { return }
+		t.touch(scope.Contract().Address(), core.Address(stack.Back(0).Bytes20()))
+	}
+}
+
+func (t *attributionTracer) CaptureFault(pc uint64, op core.OpCode, gas, cost uint64, scope core.ScopeContext, depth int, err error) {
+}
+
+func (t *attributionTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) {
+}
+
+func (t *attributionTracer) CaptureEnter(typ core.OpCode, from core.Address, to core.Address, input []byte, gas uint64, value *big.Int) {
+	t.touch(from, to)
+}
+
+func (t *attributionTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
+func (t *attributionTracer) Result() (interface{}, error) {
+	return nil, nil
+}
+
+// loadTxStateChanges returns the per transaction state changes recorded for a
+// block, or nil if none were recorded.
+func loadTxStateChanges(number uint64, hash core.Hash) ([]*txStateChanges, error) {
+	data, err := backend.ChainDb().Get(txChangesKey(number, hash))
+	if err != nil || len(data) == 0 { return nil, nil }
+	var changes []*txStateChanges
+	if err := rlp.DecodeBytes(data, &changes); err != nil { return nil, err }
+	return changes, nil
+}
+
+// withAttribution returns a copy of a block updates message with the per
+// transaction state changes of the block added, trimmed by the filter. The
+// original message is left untouched, as it may be shared with other
+// subscribers.
+func withAttribution(msg map[string]interface{}, filter *blockUpdatesFilter) (map[string]interface{}, error) {
+	if removed, _ := msg["removed"].(bool); removed { return msg, nil }
+	hash, _ := msg["hash"].(core.Hash)
+	number, _ := messageNumber(msg)
+	changes, err := loadTxStateChanges(number, hash)
+	if err != nil { return nil, err }
+	result := make(map[string]interface{}, len(msg) + 1)
+	for k, v := range msg {
+		result[k] = v
+	}
+	result["transactionStateUpdates"] = filter.filterTxStateChanges(changes)
+	return result, nil
+}
+
+func loadAttribution() {
+	data, err := backend.ChainDb().Get(attributionKey)
+	if err == nil && len(data) == 1 && data[0] == 1 {
+		atomic.StoreInt32(&attributionEnabled, 1)
+	}
+}
+
+// SetTransactionAttribution enables or disables recording which transaction
+// made each state change in new blocks. Recording adds some overhead to
+// block processing, so it is disabled by default.
+func (a *BlockUpdatesAdmin) SetTransactionAttribution(enabled bool) (bool, error) {
+	value := int32(0)
+	if enabled {
+		value = 1
+	}
+	if err := a.backend.ChainDb().Put(attributionKey, []byte{byte(value)}); err != nil { return false, err }
+	atomic.StoreInt32(&attributionEnabled, value)
+	return true, nil
+}
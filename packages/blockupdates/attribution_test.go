@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math/big"
+	"sync/atomic"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+)
+
+func TestTxStateChanges(t *testing.T) {
+	a := core.HexToAddress("0x01")
+	b := core.HexToAddress("0x02")
+	slot := core.HexToHash("0x05")
+	codeHash := core.HexToHash("0xc0de")
+	changes := []*txStateChanges{
+		{
+			Index: 0,
+			Hash: core.HexToHash("0x10"),
+			Accounts: []txAccount{{Address: a, Nonce: 1, Balance: big.NewInt(5), CodeHash: codeHash}, {Address: b, Deleted: true, Balance: new(big.Int)}},
+			Storage: []txSlot{{a, slot, core.HexToHash("0x07")}, {a, core.HexToHash("0x06"), core.Hash{}}},
+			Code: []txCode{{codeHash, []byte{0x60, 0x00}}},
+		},
+		{
+			Index: 1,
+			Hash: core.HexToHash("0x11"),
+			Accounts: []txAccount{{Address: b, Nonce: 2, Balance: big.NewInt(3)}},
+			Storage: []txSlot{},
+			Code: []txCode{},
+		},
+	}
+	data, err := rlp.EncodeToBytes(changes)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err.Error())
+	}
+	var decoded []*txStateChanges
+	if err := rlp.DecodeBytes(data, &decoded); err != nil {
+		t.Fatalf("Error decoding: %v", err.Error())
+	}
+	if len(decoded) != 2 || decoded[0].Hash != changes[0].Hash || !decoded[0].Accounts[0].equal(&changes[0].Accounts[0]) || !decoded[0].Accounts[1].Deleted {
+		t.Errorf("Unexpected decoded changes %v", decoded)
+	}
+	filter := &blockUpdatesFilter{Accounts: []core.Address{a}, StorageSlots: []core.Hash{slot}}
+	filter.compile()
+	filtered := filter.filterTxStateChanges(changes)
+	if len(filtered) != 1 {
+		t.Fatalf("Expected one matching transaction, got %v", len(filtered))
+	}
+	if len(filtered[0].Accounts) != 1 || len(filtered[0].Storage) != 1 || len(filtered[0].Code) != 1 {
+		t.Errorf("Unexpected filtered changes %v", filtered[0])
+	}
+	if len(changes[0].Storage) != 2 {
+		t.Errorf("Original changes should not be modified")
+	}
+}
+
+func TestGetLiveTracer(t *testing.T) {
+	defer atomic.StoreInt32(&attributionEnabled, atomic.LoadInt32(&attributionEnabled))
+	atomic.StoreInt32(&attributionEnabled, 0)
+	if tracer := GetLiveTracer(core.Hash{}, nil); tracer != nil {
+		t.Errorf("Expected no tracer while attribution is disabled")
+	}
+	atomic.StoreInt32(&attributionEnabled, 1)
+	if tracer := GetLiveTracer(core.Hash{}, nil); tracer == nil {
+		t.Errorf("Expected a tracer while attribution is enabled")
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"testing"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+var errNotFound = errors.New("not found")
+
+// memDB is an in memory restricted.Database. Only the key value methods are
+// implemented; the ancient store is not.
+type memDB struct {
+	restricted.Database
+	lock sync.Mutex
+	data map[string][]byte
+}
+
+func newMemDB() *memDB {
+	return &memDB{data: make(map[string][]byte)}
+}
+
+func (db *memDB) Has(key []byte) (bool, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	_, ok := db.data[string(key)]
+	return ok, nil
+}
+
+func (db *memDB) Get(key []byte) ([]byte, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	value, ok := db.data[string(key)]
+	if !ok { return nil, errNotFound }
+	return core.CopyBytes(value), nil
+}
+
+func (db *memDB) Put(key, value []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.data[string(key)] = core.CopyBytes(value)
+	return nil
+}
+
+func (db *memDB) Delete(key []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	delete(db.data, string(key))
+	return nil
+}
+
+func (db *memDB) NewIterator(prefix, start []byte) restricted.Iterator {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	from := string(append(append([]byte{}, prefix...), start...))
+	it := &memIterator{pos: -1}
+	for key := range db.data {
+		if bytes.HasPrefix([]byte(key), prefix) && key >= from {
+			it.keys = append(it.keys, key)
+		}
+	}
+	sort.Strings(it.keys)
+	for _, key := range it.keys {
+		it.values = append(it.values, db.data[key])
+	}
+	return it
+}
+
+type memIterator struct {
+	keys []string
+	values [][]byte
+	pos int
+}
+
+func (it *memIterator) Next() bool {
+	it.pos++
+	return it.pos < len(it.keys)
+}
+
+func (it *memIterator) Error() error { return nil }
+
+func (it *memIterator) Key() []byte {
+	if it.pos < 0 || it.pos >= len(it.keys) { return nil }
+	return []byte(it.keys[it.pos])
+}
+
+func (it *memIterator) Value() []byte {
+	if it.pos < 0 || it.pos >= len(it.keys) { return nil }
+	return it.values[it.pos]
+}
+
+func (it *memIterator) Release() {}
+
+// memTrie is a flat core.Trie whose node iterator yields only leaves, in key
+// order. That is enough for trie.NewDifferenceIterator and trieGet.
+type memTrie struct {
+	core.Trie
+	leaves map[core.Hash][]byte
+}
+
+func newMemTrie(leaves map[core.Hash][]byte) *memTrie {
+	t := &memTrie{leaves: make(map[core.Hash][]byte)}
+	for k, v := range leaves {
+		t.leaves[k] = v
+	}
+	return t
+}
+
+func (t *memTrie) keys() []core.Hash {
+	keys := make([]core.Hash, 0, len(t.leaves))
+	for k := range t.leaves {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+	return keys
+}
+
+func (t *memTrie) Hash() core.Hash {
+	if len(t.leaves) == 0 { return types.EmptyRootHash }
+	pairs := []kvpair{}
+	for _, k := range t.keys() {
+		pairs = append(pairs, kvpair{k, t.leaves[k]})
+	}
+	data, _ := rlp.EncodeToBytes(pairs)
+	return crypto.Keccak256Hash(data)
+}
+
+func (t *memTrie) NodeIterator(start []byte) core.NodeIterator {
+	it := &memTrieIterator{trie: t, pos: -1}
+	for _, k := range t.keys() {
+		if bytes.Compare(k[:], start) >= 0 {
+			it.keys = append(it.keys, k)
+		}
+	}
+	return it
+}
+
+type memTrieIterator struct {
+	core.NodeIterator
+	trie *memTrie
+	keys []core.Hash
+	pos int
+}
+
+func (it *memTrieIterator) Next(bool) bool {
+	it.pos++
+	return it.pos < len(it.keys)
+}
+
+func (it *memTrieIterator) Error() error { return nil }
+func (it *memTrieIterator) Hash() core.Hash { return core.Hash{} }
+func (it *memTrieIterator) Leaf() bool { return it.pos >= 0 && it.pos < len(it.keys) }
+func (it *memTrieIterator) LeafKey() []byte { return it.keys[it.pos].Bytes() }
+func (it *memTrieIterator) LeafBlob() []byte { return it.trie.leaves[it.keys[it.pos]] }
+
+func (it *memTrieIterator) Path() []byte {
+	if !it.Leaf() { return nil }
+	return it.keys[it.pos].Bytes()
+}
+
+// testBackend is a restricted.Backend over an in memory chain. Only the
+// methods the plugin uses are implemented.
+type testBackend struct {
+	restricted.Backend
+	db *memDB
+	tries map[core.Hash]*memTrie
+	code map[core.Hash][]byte
+	blocks map[core.Hash]*types.Block
+	canonical map[uint64]core.Hash
+	head *types.Block
+	missingTries int
+}
+
+// newTestBackend installs an empty test backend and fresh caches in the
+// plugin's globals for the duration of the test, and returns it with a
+// genesis block with empty state.
+func newTestBackend(t *testing.T) (*testBackend, *types.Block) {
+	b := &testBackend{
+		db: newMemDB(),
+		tries: make(map[core.Hash]*memTrie),
+		code: make(map[core.Hash][]byte),
+		blocks: make(map[core.Hash]*types.Block),
+		canonical: make(map[uint64]core.Hash),
+	}
+	oldBackend, oldLog, oldCache, oldPending, oldRecent, oldSuCh, oldIndexed := backend, log, cache, pending, recentEmits, suCh, indexed
+	backend, log, indexed = b, testLogger{t}, nil
+	cache, _ = lru.New(128)
+	pending, _ = lru.New(128)
+	recentEmits, _ = lru.New(128)
+	suCh = make(chan *stateUpdateWithBlock, 128)
+	t.Cleanup(func() {
+		backend, log, cache, pending, recentEmits, suCh, indexed = oldBackend, oldLog, oldCache, oldPending, oldRecent, oldSuCh, oldIndexed
+	})
+	return b, b.addBlock(nil, b.setState(nil, nil))
+}
+
+// setState builds the tries for a state holding the given accounts and
+// storage, and returns its root. Storage roots of the accounts are filled in
+// from the storage.
+func (b *testBackend) setState(accounts map[core.Hash]*fullAccount, storage map[core.Hash]map[core.Hash][]byte) core.Hash {
+	leaves := make(map[core.Hash][]byte)
+	for account, acct := range accounts {
+		acct := *acct
+		acct.Root = types.EmptyRootHash
+		if len(storage[account]) > 0 {
+			st := newMemTrie(storage[account])
+			b.tries[st.Hash()] = st
+			acct.Root = st.Hash()
+		}
+		if acct.CodeHash == nil {
+			acct.CodeHash = emptyCodeHash
+		}
+		leaves[account], _ = rlp.EncodeToBytes(&acct)
+	}
+	t := newMemTrie(leaves)
+	b.tries[t.Hash()] = t
+	return t.Hash()
+}
+
+// addBlock adds a block with the given state root on top of parent, or a
+// genesis block if parent is nil, and makes it the canonical head.
+func (b *testBackend) addBlock(parent *types.Block, root core.Hash) *types.Block {
+	header := &types.Header{Root: root, Difficulty: big.NewInt(1), Number: big.NewInt(0)}
+	if parent != nil {
+		header.ParentHash = parent.Hash()
+		header.Number = new(big.Int).Add(parent.Number(), big.NewInt(1))
+		header.Time = parent.Time() + 12
+	}
+	block := types.NewBlockWithHeader(header)
+	b.blocks[block.Hash()] = block
+	b.canonical[block.NumberU64()] = block.Hash()
+	b.head = block
+	return block
+}
+
+// setCanonical makes the given blocks canonical, the last of them the head.
+func (b *testBackend) setCanonical(blocks ...*types.Block) {
+	for _, block := range blocks {
+		b.canonical[block.NumberU64()] = block.Hash()
+		b.head = block
+	}
+}
+
+func (b *testBackend) ChainDb() restricted.Database { return b.db }
+
+func (b *testBackend) GetTrie(root core.Hash) (core.Trie, error) {
+	if t, ok := b.tries[root]; ok { return t, nil }
+	b.missingTries++
+	return nil, fmt.Errorf("missing trie node %#x", root)
+}
+
+func (b *testBackend) GetContractCode(hash core.Hash) ([]byte, error) {
+	if code, ok := b.code[hash]; ok { return code, nil }
+	return nil, fmt.Errorf("missing code %#x", hash)
+}
+
+func (b *testBackend) BlockByHash(ctx context.Context, hash core.Hash) ([]byte, error) {
+	block, ok := b.blocks[hash]
+	if !ok { return nil, fmt.Errorf("unknown block %#x", hash) }
+	return rlp.EncodeToBytes(block)
+}
+
+func (b *testBackend) BlockByNumber(ctx context.Context, number int64) ([]byte, error) {
+	if number < 0 {
+		number = b.head.Number().Int64()
+	}
+	hash, ok := b.canonical[uint64(number)]
+	if !ok { return nil, fmt.Errorf("unknown block %v", number) }
+	return b.BlockByHash(ctx, hash)
+}
+
+func (b *testBackend) HeaderByHash(ctx context.Context, hash core.Hash) ([]byte, error) {
+	block, ok := b.blocks[hash]
+	if !ok { return nil, fmt.Errorf("unknown block %#x", hash) }
+	return rlp.EncodeToBytes(block.Header())
+}
+
+func (b *testBackend) HeaderByNumber(ctx context.Context, number int64) ([]byte, error) {
+	if number < 0 {
+		number = b.head.Number().Int64()
+	}
+	hash, ok := b.canonical[uint64(number)]
+	if !ok { return nil, fmt.Errorf("unknown block %v", number) }
+	return b.HeaderByHash(ctx, hash)
+}
+
+func (b *testBackend) CurrentHeader() []byte {
+	data, _ := rlp.EncodeToBytes(b.head.Header())
+	return data
+}
+
+func (b *testBackend) GetReceipts(ctx context.Context, hash core.Hash) ([]byte, error) {
+	return json.Marshal(types.Receipts{})
+}
+
+func (b *testBackend) GetTd(ctx context.Context, hash core.Hash) *big.Int {
+	block, ok := b.blocks[hash]
+	if !ok { return nil }
+	return new(big.Int).Add(block.Number(), big.NewInt(1))
+}
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Trace(msg string, ctx ...interface{}) {}
+func (l testLogger) Debug(msg string, ctx ...interface{}) {}
+func (l testLogger) Info(msg string, ctx ...interface{}) {}
+func (l testLogger) Warn(msg string, ctx ...interface{}) { l.t.Log(append([]interface{}{msg}, ctx...)...) }
+func (l testLogger) Error(msg string, ctx ...interface{}) { l.t.Log(append([]interface{}{msg}, ctx...)...) }
+func (l testLogger) Crit(msg string, ctx ...interface{}) { l.t.Log(append([]interface{}{msg}, ctx...)...) }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	chexutil "github.com/openrelayxyz/cardinal-types/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+)
+
+const (
+	// policyDropOldest discards the oldest undelivered message to make room
+	// for new ones.
+	policyDropOldest = "dropOldest"
+	// policyDisconnect ends the subscription with an error message.
+	policyDisconnect = "disconnect"
+	// policySpill writes undelivered messages to disk until the subscriber
+	// catches up.
+	policySpill = "spill"
+
+	defaultMaxSpillBytes = 1 << 30
+)
+
+var (
+	errSlowConsumer = errors.New("subscriber is not keeping up with block updates")
+
+	subscribersLock sync.Mutex
+	subscribers = make(map[uint64]*subscriber)
+	lastSubscriberId uint64
+)
+
+// subscriptionOptions configures how a subscription behaves when its client
+// does not keep up with new blocks, which parts of each block it receives, and
+// whether state updates are decoded and attributed to transactions.
+type subscriptionOptions struct {
+	Policy string `json:"policy"`
+	MaxSpillBytes int64 `json:"maxSpillBytes"`
+	Filter *blockUpdatesFilter `json:"filter"`
+	Decoded bool `json:"decoded"`
+	Attribution bool `json:"attribution"`
+	Format string `json:"format"`
+}
+
+func (opts *subscriptionOptions) validate() error {
+	switch opts.Policy {
+	case "":
+		opts.Policy = policyDisconnect
+	case policyDropOldest, policyDisconnect, policySpill:
+	default:
+		return fmt.Errorf("unknown slow consumer policy %q", opts.Policy)
+	}
+	if err := validateFormat(opts.Format); err != nil { return err }
+	if opts.MaxSpillBytes <= 0 {
+		opts.MaxSpillBytes = defaultMaxSpillBytes
+	}
+	if opts.Filter != nil {
+		opts.Filter.compile()
+	}
+	return nil
+}
+
+// subscriber tracks delivery of messages to a single subscription, applying
+// its slow consumer policy so that a slow client never blocks the feed.
+type subscriber struct {
+	id uint64
+	opts subscriptionOptions
+	created time.Time
+	ch chan map[string]interface{}
+	spill *spillQueue
+	next map[string]interface{} // spilled message waiting to be delivered
+	delivered uint64
+	dropped uint64
+	lastNumber uint64
+}
+
+// subscriberStats reports how far behind a subscriber is.
+type subscriberStats struct {
+	Id hexutil.Uint64 `json:"id"`
+	Policy string `json:"policy"`
+	Created time.Time `json:"created"`
+	Delivered hexutil.Uint64 `json:"delivered"`
+	Dropped hexutil.Uint64 `json:"dropped"`
+	Queued hexutil.Uint64 `json:"queued"`
+	Spilled hexutil.Uint64 `json:"spilled"`
+	SpilledBytes hexutil.Uint64 `json:"spilledBytes"`
+	LastBlock hexutil.Uint64 `json:"lastBlock"`
+	Lag hexutil.Uint64 `json:"lag"`
+}
+
+func newSubscriber(opts subscriptionOptions, ch chan map[string]interface{}) (*subscriber, error) {
+	s := &subscriber{
+		id: atomic.AddUint64(&lastSubscriberId, 1),
+		opts: opts,
+		created: time.Now(),
+		ch: ch,
+	}
+	if opts.Policy == policySpill {
+		spill, err := newSpillQueue()
+		if err != nil { return nil, err }
+		s.spill = spill
+	}
+	subscribersLock.Lock()
+	subscribers[s.id] = s
+	subscribersLock.Unlock()
+	return s, nil
+}
+
+// close unregisters the subscriber and discards anything it had spilled.
+func (s *subscriber) close() {
+	subscribersLock.Lock()
+	delete(subscribers, s.id)
+	subscribersLock.Unlock()
+	if s.spill != nil {
+		s.spill.close()
+	}
+}
+
+func (s *subscriber) backlog() bool {
+	return s.next != nil || (s.spill != nil && s.spill.len() > 0)
+}
+
+func (s *subscriber) sent(msg map[string]interface{}) {
+	atomic.AddUint64(&s.delivered, 1)
+	if n, ok := messageNumber(msg); ok {
+		atomic.StoreUint64(&s.lastNumber, n)
+	}
+}
+
+// deliver queues a message for the client without blocking. If the client's
+// buffer is full, the subscriber's policy decides what happens; an error
+// means the subscription should be closed.
+func (s *subscriber) deliver(msg map[string]interface{}) error {
+	msg, err := s.present(msg)
+	if err != nil || msg == nil { return err }
+	if !s.backlog() {
+		select {
+		case s.ch <- msg:
+			s.sent(msg)
+			return nil
+		default:
+		}
+	}
+	switch s.opts.Policy {
+	case policyDropOldest:
+		for {
+			select {
+			case s.ch <- msg:
+				s.sent(msg)
+				return nil
+			default:
+			}
+			select {
+			case <-s.ch:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	case policySpill:
+		if s.spill.size() > s.opts.MaxSpillBytes { return errSlowConsumer }
+		return s.spill.push(msg)
+	default:
+		return errSlowConsumer
+	}
+}
+
+// present applies the subscriber's filter and view options to a message. A
+// nil message means there is nothing to send.
+func (s *subscriber) present(msg map[string]interface{}) (map[string]interface{}, error) {
+	return (&viewOptions{Decoded: s.opts.Decoded, Attribution: s.opts.Attribution, Format: s.opts.Format}).present(s.opts.Filter.apply(msg), s.opts.Filter)
+}
+
+// pending returns the channel and message for the next spilled message, or a
+// nil channel if nothing is waiting, for use in a select statement.
+func (s *subscriber) pending() (chan<- map[string]interface{}, map[string]interface{}) {
+	if s.next == nil && s.backlog() {
+		msg, err := s.spill.pop()
+		if err != nil {
+			log.Error("Failed to read spilled block update", "subscriber", s.id, "err", err)
+			atomic.AddUint64(&s.dropped, 1)
+			return nil, nil
+		}
+		s.next = msg
+	}
+	if s.next == nil { return nil, nil }
+	return s.ch, s.next
+}
+
+// pendingSent marks the message returned by pending as delivered.
+func (s *subscriber) pendingSent() {
+	s.sent(s.next)
+	s.next = nil
+}
+
+// fail makes room for an error message in the client's buffer and sends it,
+// so the client knows why its subscription is about to be closed.
+func (s *subscriber) fail(err error) {
+	for {
+		select {
+		case s.ch <- map[string]interface{}{"error": err.Error()}:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+			atomic.AddUint64(&s.dropped, 1)
+		default:
+		}
+	}
+}
+
+func (s *subscriber) stats(head uint64) subscriberStats {
+	last := atomic.LoadUint64(&s.lastNumber)
+	stats := subscriberStats{
+		Id: hexutil.Uint64(s.id),
+		Policy: s.opts.Policy,
+		Created: s.created,
+		Delivered: hexutil.Uint64(atomic.LoadUint64(&s.delivered)),
+		Dropped: hexutil.Uint64(atomic.LoadUint64(&s.dropped)),
+		Queued: hexutil.Uint64(len(s.ch)),
+		LastBlock: hexutil.Uint64(last),
+	}
+	if s.spill != nil {
+		stats.Spilled = hexutil.Uint64(s.spill.len())
+		stats.SpilledBytes = hexutil.Uint64(s.spill.size())
+	}
+	if last > 0 && head > last {
+		stats.Lag = hexutil.Uint64(head - last)
+	}
+	return stats
+}
+
+// messageNumber returns the block number of a subscription message, whether
+// it is freshly built, a Cardinal batch, or has been round tripped through a
+// spill file.
+func messageNumber(msg map[string]interface{}) (uint64, bool) {
+	switch n := msg["number"].(type) {
+	case *hexutil.Big:
+		return n.ToInt().Uint64(), true
+	case *chexutil.Big:
+		return n.ToInt().Uint64(), true
+	case string:
+		v, err := hexutil.DecodeUint64(n)
+		return v, err == nil
+	}
+	return 0, false
+}
+
+// spillQueue is a FIFO of subscription messages stored as JSON lines in a
+// temporary file.
+type spillQueue struct {
+	lock sync.Mutex
+	writer *os.File
+	reader *os.File
+	buf *bufio.Reader
+	count int
+	bytes int64
+}
+
+func newSpillQueue() (*spillQueue, error) {
+	if err := os.MkdirAll(spillDir, 0755); err != nil { return nil, err }
+	writer, err := os.CreateTemp(spillDir, "subscription-*.spill")
+	if err != nil { return nil, err }
+	reader, err := os.Open(writer.Name())
+	if err != nil {
+		writer.Close()
+		os.Remove(writer.Name())
+		return nil, err
+	}
+	return &spillQueue{writer: writer, reader: reader, buf: bufio.NewReader(reader)}, nil
+}
+
+func (q *spillQueue) push(msg map[string]interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil { return err }
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, err := q.writer.Write(append(data, '\n')); err != nil { return err }
+	q.count++
+	q.bytes += int64(len(data) + 1)
+	return nil
+}
+
+func (q *spillQueue) pop() (map[string]interface{}, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.count == 0 { return nil, io.EOF }
+	line, err := q.buf.ReadBytes('\n')
+	if err != nil { return nil, err }
+	q.count--
+	q.bytes -= int64(len(line))
+	if q.count == 0 {
+		// Everything has been read back, start the file over
+		if err := q.writer.Truncate(0); err != nil { return nil, err }
+		if _, err := q.writer.Seek(0, io.SeekStart); err != nil { return nil, err }
+		if _, err := q.reader.Seek(0, io.SeekStart); err != nil { return nil, err }
+		q.buf.Reset(q.reader)
+	}
+	msg := make(map[string]interface{})
+	if err := json.Unmarshal(line, &msg); err != nil { return nil, err }
+	return msg, nil
+}
+
+func (q *spillQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.count
+}
+
+func (q *spillQueue) size() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.bytes
+}
+
+func (q *spillQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.reader.Close()
+	q.writer.Close()
+	os.Remove(q.writer.Name())
+}
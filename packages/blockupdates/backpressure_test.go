@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+)
+
+func testMessage(n int64) map[string]interface{} {
+	return map[string]interface{}{"number": (*hexutil.Big)(big.NewInt(n))}
+}
+
+func TestDropOldest(t *testing.T) {
+	ch := make(chan map[string]interface{}, 2)
+	s, _ := newSubscriber(subscriptionOptions{Policy: policyDropOldest}, ch)
+	defer s.close()
+	for i := int64(1); i <= 4; i++ {
+		if err := s.deliver(testMessage(i)); err != nil {
+			t.Fatalf("Unexpected error: %v", err.Error())
+		}
+	}
+	if n, _ := messageNumber(<-ch); n != 3 {
+		t.Errorf("Expected oldest messages to be dropped, got %v", n)
+	}
+	if stats := s.stats(10); stats.Dropped != 2 || stats.LastBlock != 4 || stats.Lag != 6 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	ch := make(chan map[string]interface{}, 1)
+	s, _ := newSubscriber(subscriptionOptions{Policy: policyDisconnect}, ch)
+	defer s.close()
+	s.deliver(testMessage(1))
+	if err := s.deliver(testMessage(2)); err != errSlowConsumer {
+		t.Errorf("Expected slow consumer error, got %v", err)
+	}
+}
+
+func TestSpill(t *testing.T) {
+	spillDir = t.TempDir()
+	ch := make(chan map[string]interface{}, 1)
+	s, err := newSubscriber(subscriptionOptions{Policy: policySpill, MaxSpillBytes: 1 << 20}, ch)
+	if err != nil {
+		t.Fatalf("Error creating subscriber: %v", err.Error())
+	}
+	defer s.close()
+	for i := int64(1); i <= 5; i++ {
+		if err := s.deliver(testMessage(i)); err != nil {
+			t.Fatalf("Unexpected error: %v", err.Error())
+		}
+	}
+	if s.spill.len() != 4 {
+		t.Errorf("Expected 4 spilled messages, got %v", s.spill.len())
+	}
+	for i := uint64(1); i <= 5; i++ {
+		if i > 1 {
+			out, next := s.pending()
+			out <- next
+			s.pendingSent()
+		}
+		if n, _ := messageNumber(<-ch); n != i {
+			t.Errorf("Expected message %v, got %v", i, n)
+		}
+	}
+	if s.backlog() {
+		t.Errorf("Expected backlog to be drained")
+	}
+}
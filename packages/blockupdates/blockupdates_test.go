@@ -2,6 +2,8 @@ package main
 
 import (
 	"testing"
+	"encoding/json"
+	"math/big"
 	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
 	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
 	"github.com/openrelayxyz/plugeth-utils/core"
@@ -80,4 +82,82 @@ func TestSample(t *testing.T) {
 	if err := rlp.DecodeBytes(data, loaded) ; err != nil {
 		t.Errorf("Error decoding: %v", err.Error())
 	}
-}
\ No newline at end of file
+}
+
+func TestSuKey(t *testing.T) {
+	hash := core.HexToHash("0xabcd")
+	number, parsed, ok := parseSuKey(suKey(1234, hash))
+	if !ok || number != 1234 || parsed != hash {
+		t.Errorf("Unexpected key round trip: %v %v %v", number, parsed, ok)
+	}
+	if string(suKey(255, hash)) > string(suKey(256, core.Hash{})) {
+		t.Errorf("Keys should be ordered by block number")
+	}
+	if _, _, ok := parseSuKey(append([]byte("su"), hash.Bytes()...)); ok {
+		t.Errorf("Legacy keys should not parse")
+	}
+}
+
+func TestBlockNumberOrHashJSON(t *testing.T) {
+	var bnh blockNumberOrHash
+	if err := json.Unmarshal([]byte(`"0x10"`), &bnh); err != nil || bnh.Number == nil || bnh.Number.Int64() != 16 {
+		t.Errorf("Unexpected number decoding: %v", err)
+	}
+	bnh = blockNumberOrHash{}
+	hash := "0x000000000000000000000000000000000000000000000000000000000000abcd"
+	if err := json.Unmarshal([]byte(`"`+hash+`"`), &bnh); err != nil || bnh.Hash == nil || *bnh.Hash != core.HexToHash(hash) {
+		t.Errorf("Unexpected hash decoding: %v", err)
+	}
+	bnh = blockNumberOrHash{}
+	if err := json.Unmarshal([]byte(`"latest"`), &bnh); err != nil || bnh.Number == nil || bnh.Number.Int64() >= 0 {
+		t.Errorf("Unexpected tag decoding: %v", err)
+	}
+}
+
+func TestStateUpdateCanonicalEncoding(t *testing.T) {
+	build := func(order []int) *stateUpdate {
+		su := &stateUpdate{
+			Destructs: map[core.Hash]struct{}{},
+			Accounts: map[core.Hash][]byte{},
+			Storage: map[core.Hash]map[core.Hash][]byte{},
+			Code: map[core.Hash][]byte{},
+		}
+		for _, i := range order {
+			h := core.BytesToHash(big.NewInt(int64(i + 1)).Bytes())
+			su.Destructs[h] = struct{}{}
+			su.Accounts[h] = []byte{byte(i)}
+			su.Storage[h] = map[core.Hash][]byte{h: {byte(i)}, core.HexToHash("0xff"): {}}
+			su.Code[h] = []byte{byte(i), byte(i)}
+		}
+		return su
+	}
+	forward, backward := []int{}, []int{}
+	for i := 0; i < 32; i++ {
+		forward = append(forward, i)
+		backward = append([]int{i}, backward...)
+	}
+	a, b := build(forward), build(backward)
+	for i := 0; i < 8; i++ {
+		aRLP, _ := rlp.EncodeToBytes(a)
+		bRLP, _ := rlp.EncodeToBytes(b)
+		if string(aRLP) != string(bRLP) {
+			t.Fatalf("RLP encoding is not deterministic")
+		}
+		aJSON, _ := json.Marshal(a)
+		bJSON, _ := json.Marshal(b)
+		if string(aJSON) != string(bJSON) {
+			t.Fatalf("JSON encoding is not deterministic")
+		}
+	}
+	aHash, err := a.Hash()
+	if err != nil {
+		t.Fatalf("Error hashing: %v", err.Error())
+	}
+	if bHash, _ := b.Hash(); aHash != bHash {
+		t.Errorf("Equal state updates should have equal hashes")
+	}
+	b.Accounts[core.HexToHash("0x01")] = []byte{0x99}
+	if bHash, _ := b.Hash(); aHash == bHash {
+		t.Errorf("Different state updates should have different hashes")
+	}
+}
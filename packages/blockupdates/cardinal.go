@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	ctypes "github.com/openrelayxyz/cardinal-types"
+	chexutil "github.com/openrelayxyz/cardinal-types/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+const (
+	// formatBlockUpdates is the default message format.
+	formatBlockUpdates = ""
+	// formatCardinal expresses each block as a Cardinal batch.
+	formatCardinal = "cardinal"
+)
+
+func validateFormat(format string) error {
+	switch format {
+	case formatBlockUpdates, formatCardinal:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// cardinalBatch is a block update in the form of a Cardinal batch, using the
+// key layout of the Cardinal EVM producer:
+//
+//	c/{chainid}/b/{hash}/h               RLP encoded header
+//	c/{chainid}/b/{hash}/d               total difficulty
+//	c/{chainid}/b/{hash}/u               RLP encoded uncles
+//	c/{chainid}/b/{hash}/w               RLP encoded withdrawals
+//	c/{chainid}/b/{hash}/t/{index}       binary encoded transaction
+//	c/{chainid}/b/{hash}/r/{index}       binary encoded receipt
+//	c/{chainid}/a/{account hash}/d       slim RLP encoded account
+//	c/{chainid}/a/{account hash}/s/{slot hash}  RLP encoded storage value
+//	c/{chainid}/c/{code hash}            contract code
+//
+// Transactions and receipts are keyed by their index in the block, so a
+// filter that drops some of them does not shift the rest. Deleted accounts
+// and slots are listed in Deletes, and destructed accounts delete their
+// account record, unless the block recreates it, and their whole storage
+// prefix.
+//
+// When a reorg removes a block, its batch has Removed set. It deletes the
+// block's records and restores the state its changes replaced, taken from
+// the inverse state updates of the removed message, so consumers can roll it
+// back before applying the batches of the new chain.
+type cardinalBatch struct {
+	Number *chexutil.Big `json:"number"`
+	Weight *chexutil.Big `json:"weight"`
+	Hash ctypes.Hash `json:"hash"`
+	ParentHash ctypes.Hash `json:"parentHash"`
+	Values map[string]chexutil.Bytes `json:"values"`
+	Deletes []string `json:"deletes"`
+	Removed bool `json:"removed,omitempty"`
+}
+
+func newCardinalBatch(number, td *big.Int, hash, parentHash core.Hash) *cardinalBatch {
+	if td == nil {
+		td = new(big.Int)
+	}
+	return &cardinalBatch{
+		Number: (*chexutil.Big)(new(big.Int).Set(number)),
+		Weight: (*chexutil.Big)(td),
+		Hash: ctypes.BytesToHash(hash.Bytes()),
+		ParentHash: ctypes.BytesToHash(parentHash.Bytes()),
+		Values: make(map[string]chexutil.Bytes),
+		Deletes: []string{},
+	}
+}
+
+// message returns the batch as a subscription message.
+func (b *cardinalBatch) message() map[string]interface{} {
+	msg := map[string]interface{}{
+		"number": b.Number,
+		"weight": b.Weight,
+		"hash": b.Hash,
+		"parentHash": b.ParentHash,
+		"values": b.Values,
+		"deletes": b.Deletes,
+	}
+	if b.Removed {
+		msg["removed"] = true
+	}
+	return msg
+}
+
+// cardinalMessage presents a block updates message, already trimmed by any
+// filter, as a Cardinal batch. Only the transactions and receipts left in
+// the message are included.
+func cardinalMessage(ctx context.Context, msg map[string]interface{}) (map[string]interface{}, error) {
+	hash := messageHash(msg)
+	su, _ := msg["stateUpdates"].(*stateUpdate)
+	chainID := backend.ChainConfig().ChainID
+	if removed, _ := msg["removed"].(bool); removed {
+		number, _ := msg["number"].(*hexutil.Big)
+		parentHash, _ := msg["parentHash"].(core.Hash)
+		if number == nil { return nil, fmt.Errorf("removed block %#x has no number", hash) }
+		return buildCardinalRemoval(chainID, number.ToInt(), backend.GetTd(ctx, hash), hash, parentHash, su).message(), nil
+	}
+	blockBytes, err := backend.BlockByHash(ctx, hash)
+	if err != nil { return nil, err }
+	var block types.Block
+	if err := rlp.DecodeBytes(blockBytes, &block); err != nil { return nil, err }
+	txs, _ := msg["transactions"].([]interface{})
+	indexes := make([]uint64, 0, len(txs))
+	for _, txi := range txs {
+		if tx, ok := txi.(*RPCTransaction); ok && tx.TransactionIndex != nil {
+			indexes = append(indexes, uint64(*tx.TransactionIndex))
+		}
+	}
+	receipts, _ := msg["receipts"].(types.Receipts)
+	batch, err := buildCardinalBatch(chainID, &block, backend.GetTd(ctx, hash), indexes, receipts, su)
+	if err != nil { return nil, err }
+	return batch.message(), nil
+}
+
+// buildCardinalBatch builds the batch for a block, including the
+// transactions at the given indexes.
+func buildCardinalBatch(chainID *big.Int, block *types.Block, td *big.Int, indexes []uint64, receipts types.Receipts, su *stateUpdate) (*cardinalBatch, error) {
+	batch := newCardinalBatch(block.Number(), td, block.Hash(), block.ParentHash())
+	blockPrefix := cardinalBlockPrefix(chainID, block.Hash())
+	var err error
+	if batch.Values[blockPrefix + "h"], err = rlp.EncodeToBytes(block.Header()); err != nil { return nil, err }
+	batch.Values[blockPrefix + "d"] = batch.Weight.ToInt().Bytes()
+	if batch.Values[blockPrefix + "u"], err = rlp.EncodeToBytes(block.Uncles()); err != nil { return nil, err }
+	if block.Header().WithdrawalsHash != nil {
+		if batch.Values[blockPrefix + "w"], err = rlp.EncodeToBytes(block.Withdrawals()); err != nil { return nil, err }
+	}
+	txs := block.Transactions()
+	for _, i := range indexes {
+		if i >= uint64(len(txs)) { return nil, fmt.Errorf("transaction index %v out of range", i) }
+		if batch.Values[fmt.Sprintf("%vt/%x", blockPrefix, i)], err = txs[i].MarshalBinary(); err != nil { return nil, err }
+	}
+	for _, receipt := range receipts {
+		if batch.Values[fmt.Sprintf("%vr/%x", blockPrefix, receipt.TransactionIndex)], err = receipt.MarshalBinary(); err != nil { return nil, err }
+	}
+	batch.addStateUpdate(chainID, su)
+	return batch, nil
+}
+
+// buildCardinalRemoval builds the batch for a block removed by a reorg, from
+// the inverse of its state updates, if they are known.
+func buildCardinalRemoval(chainID, number, td *big.Int, hash, parentHash core.Hash, inverse *stateUpdate) *cardinalBatch {
+	batch := newCardinalBatch(number, td, hash, parentHash)
+	batch.Removed = true
+	batch.Deletes = append(batch.Deletes, cardinalBlockPrefix(chainID, hash))
+	batch.addStateUpdate(chainID, inverse)
+	return batch
+}
+
+func cardinalBlockPrefix(chainID *big.Int, hash core.Hash) string {
+	return fmt.Sprintf("c/%x/b/%x/", chainID, hash.Bytes())
+}
+
+func (b *cardinalBatch) addStateUpdate(chainID *big.Int, su *stateUpdate) {
+	if su == nil { return }
+	ssu := su.stored()
+	for _, account := range ssu.Destructs {
+		if _, ok := su.Accounts[account]; !ok {
+			b.Deletes = append(b.Deletes, fmt.Sprintf("c/%x/a/%x/d", chainID, account.Bytes()))
+		}
+		b.Deletes = append(b.Deletes, fmt.Sprintf("c/%x/a/%x/s/", chainID, account.Bytes()))
+	}
+	for _, kv := range ssu.Accounts {
+		key := fmt.Sprintf("c/%x/a/%x/d", chainID, kv.Key.Bytes())
+		if len(kv.Value) == 0 {
+			b.Deletes = append(b.Deletes, key)
+			continue
+		}
+		b.Values[key] = kv.Value
+	}
+	for _, s := range ssu.Storage {
+		for _, kv := range s.Data {
+			key := fmt.Sprintf("c/%x/a/%x/s/%x", chainID, s.Account.Bytes(), kv.Key.Bytes())
+			if len(kv.Value) == 0 {
+				b.Deletes = append(b.Deletes, key)
+				continue
+			}
+			b.Values[key] = kv.Value
+		}
+	}
+	for _, kv := range ssu.Code {
+		b.Values[fmt.Sprintf("c/%x/c/%x", chainID, kv.Key.Bytes())] = kv.Value
+	}
+}
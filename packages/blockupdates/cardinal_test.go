@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"testing"
+
+	ctypes "github.com/openrelayxyz/cardinal-types"
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hasher"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+func TestCardinalBatch(t *testing.T) {
+	to := core.HexToAddress("0x000000000000000000000000000000000000beef")
+	tx := types.NewTx(&types.LegacyTx{Nonce: 0, GasPrice: big.NewInt(30e9), Gas: 21000, To: &to, Value: big.NewInt(1)})
+	other := types.NewTx(&types.LegacyTx{Nonce: 1, GasPrice: big.NewInt(30e9), Gas: 21000, To: &to, Value: big.NewInt(2)})
+	header := &types.Header{
+		ParentHash: core.HexToHash("0x01"),
+		Root: core.HexToHash("0x02"),
+		Difficulty: big.NewInt(0),
+		Number: big.NewInt(100),
+		GasLimit: 30000000,
+		BaseFee: big.NewInt(20e9),
+	}
+	withdrawals := []*types.Withdrawal{{Index: 1, Validator: 2, Address: to, Amount: 3}}
+	block := types.NewBlockWithWithdrawals(header, []*types.Transaction{tx, other}, nil, nil, withdrawals, hasher.NewStackTrie(nil))
+	// A filter kept only the second transaction and its receipt.
+	receipts := types.Receipts{{Type: types.LegacyTxType, Status: types.ReceiptStatusSuccessful, CumulativeGasUsed: 42000, Logs: []*types.Log{}, TxHash: other.Hash(), TransactionIndex: 1}}
+	destructed, created, deleted, recreated := core.HexToHash("0xaa"), core.HexToHash("0xbb"), core.HexToHash("0xcc"), core.HexToHash("0xdd")
+	slot, cleared := core.HexToHash("0x10"), core.HexToHash("0x11")
+	codeHash := core.HexToHash("0xc0de")
+	su := &stateUpdate{
+		Destructs: map[core.Hash]struct{}{destructed: {}, recreated: {}},
+		Accounts: map[core.Hash][]byte{created: {0x01}, deleted: nil, recreated: {0x02}},
+		Storage: map[core.Hash]map[core.Hash][]byte{created: {slot: {0x05}, cleared: nil}},
+		Code: map[core.Hash][]byte{codeHash: {0x60, 0x00}},
+	}
+	batch, err := buildCardinalBatch(big.NewInt(1), block, big.NewInt(58750000000000000), []uint64{1}, receipts, su)
+	if err != nil {
+		t.Fatalf("Error building batch: %v", err.Error())
+	}
+	if batch.Hash != ctypes.BytesToHash(block.Hash().Bytes()) || batch.ParentHash != ctypes.BytesToHash(header.ParentHash.Bytes()) || batch.Removed {
+		t.Errorf("Unexpected batch hashes: %v %v", batch.Hash, batch.ParentHash)
+	}
+	if n, ok := messageNumber(batch.message()); !ok || n != 100 {
+		t.Errorf("Unexpected batch number %v", batch.Number)
+	}
+	values := batch.Values
+	blockPrefix := fmt.Sprintf("c/1/b/%x/", block.Hash().Bytes())
+	for _, key := range []string{
+		blockPrefix + "h",
+		blockPrefix + "d",
+		blockPrefix + "u",
+		blockPrefix + "w",
+		blockPrefix + "t/1",
+		blockPrefix + "r/1",
+		fmt.Sprintf("c/1/a/%x/d", created.Bytes()),
+		fmt.Sprintf("c/1/a/%x/d", recreated.Bytes()),
+		fmt.Sprintf("c/1/a/%x/s/%x", created.Bytes(), slot.Bytes()),
+		fmt.Sprintf("c/1/c/%x", codeHash.Bytes()),
+	} {
+		if _, ok := values[key]; !ok {
+			t.Errorf("Missing key %v", key)
+		}
+	}
+	if len(values) != 10 {
+		t.Errorf("Unexpected number of values: %v", len(values))
+	}
+	expected := map[string]bool{
+		fmt.Sprintf("c/1/a/%x/d", destructed.Bytes()): true,
+		fmt.Sprintf("c/1/a/%x/s/", destructed.Bytes()): true,
+		fmt.Sprintf("c/1/a/%x/s/", recreated.Bytes()): true,
+		fmt.Sprintf("c/1/a/%x/d", deleted.Bytes()): true,
+		fmt.Sprintf("c/1/a/%x/s/%x", created.Bytes(), cleared.Bytes()): true,
+	}
+	if len(batch.Deletes) != len(expected) {
+		t.Fatalf("Unexpected deletes: %v", batch.Deletes)
+	}
+	for _, key := range batch.Deletes {
+		if !expected[key] {
+			t.Errorf("Unexpected delete %v", key)
+		}
+	}
+	if _, err := buildCardinalBatch(big.NewInt(1), block, nil, []uint64{2}, nil, nil); err == nil {
+		t.Errorf("Expected an error for a transaction index out of range")
+	}
+
+	// Removing the block deletes its records and restores the prior state
+	inverse := &stateUpdate{
+		Accounts: map[core.Hash][]byte{created: nil, deleted: {0x03}},
+		Storage: map[core.Hash]map[core.Hash][]byte{created: {slot: nil}},
+	}
+	removal := buildCardinalRemoval(big.NewInt(1), block.Number(), nil, block.Hash(), header.ParentHash, inverse)
+	if !removal.Removed || removal.message()["removed"] != true || removal.Hash != batch.Hash {
+		t.Errorf("Unexpected removal batch %+v", removal)
+	}
+	if len(removal.Values) != 1 || !bytes.Equal(removal.Values[fmt.Sprintf("c/1/a/%x/d", deleted.Bytes())], []byte{0x03}) {
+		t.Errorf("Unexpected removal values %v", removal.Values)
+	}
+	expected = map[string]bool{
+		blockPrefix: true,
+		fmt.Sprintf("c/1/a/%x/d", created.Bytes()): true,
+		fmt.Sprintf("c/1/a/%x/s/%x", created.Bytes(), slot.Bytes()): true,
+	}
+	if len(removal.Deletes) != len(expected) {
+		t.Fatalf("Unexpected removal deletes: %v", removal.Deletes)
+	}
+	for _, key := range removal.Deletes {
+		if !expected[key] {
+			t.Errorf("Unexpected removal delete %v", key)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+const (
+	// safeBlockNumber and finalizedBlockNumber are the block numbers geth
+	// resolves to the latest safe and finalized blocks.
+	safeBlockNumber = -4
+	finalizedBlockNumber = -3
+
+	tagSafe = "safe"
+	tagFinalized = "finalized"
+)
+
+// confirmedOptions configures a BlockUpdatesConfirmed subscription. Blocks are
+// emitted once they are Depth blocks below the head, or once they are marked
+// safe or finalized when Tag is set.
+type confirmedOptions struct {
+	Depth uint64 `json:"depth"`
+	Tag string `json:"tag"`
+	Filter *blockUpdatesFilter `json:"filter"`
+	Decoded bool `json:"decoded"`
+	Attribution bool `json:"attribution"`
+	Format string `json:"format"`
+}
+
+func (opts *confirmedOptions) validate() error {
+	switch opts.Tag {
+	case "":
+		if opts.Depth == 0 { return fmt.Errorf("either a confirmation depth or a tag is required") }
+	case tagSafe, tagFinalized:
+		if opts.Depth != 0 { return fmt.Errorf("depth cannot be combined with the %q tag", opts.Tag) }
+	default:
+		return fmt.Errorf("unknown tag %q", opts.Tag)
+	}
+	if err := validateFormat(opts.Format); err != nil { return err }
+	if opts.Filter != nil {
+		opts.Filter.compile()
+	}
+	return nil
+}
+
+// confirmedHeader returns the most recent block meeting the confirmation
+// requirement, or nil if there is none yet. Chains that have not been
+// through the merge never have safe or finalized blocks.
+func confirmedHeader(ctx context.Context, opts *confirmedOptions) (*types.Header, error) {
+	var number int64
+	switch opts.Tag {
+	case tagSafe:
+		number = safeBlockNumber
+	case tagFinalized:
+		number = finalizedBlockNumber
+	default:
+		head, err := decodeHeader(backend.CurrentHeader())
+		if err != nil { return nil, err }
+		if head.Number.Uint64() < opts.Depth { return nil, nil }
+		number = int64(head.Number.Uint64() - opts.Depth)
+	}
+	headerBytes, err := backend.HeaderByNumber(ctx, number)
+	if err != nil || len(headerBytes) == 0 {
+		log.Debug("No confirmed block available", "tag", opts.Tag, "depth", opts.Depth, "err", err)
+		return nil, nil
+	}
+	return decodeHeader(headerBytes)
+}
+
+// BlockUpdatesConfirmed allows clients to subscribe to block updates for
+// blocks that are unlikely to be reorged, either because they are a number of
+// blocks below the head ({"depth": n}) or because the consensus client has
+// marked them safe or finalized ({"tag": "safe"} or {"tag": "finalized"}).
+// Blocks are emitted in order without gaps, so several may arrive at once
+// when finality advances.
+//
+// Finalized blocks are never removed. With a depth or the safe tag, a reorg
+// deeper than the confirmation can still remove emitted blocks, in which case
+// subscribers receive the same `"removed": true` messages as BlockUpdates.
+//
+// If a starting block number or hash is provided, block updates are emitted
+// from that block (inclusive), otherwise from the block after the current
+// confirmed block. The subscription works from its own position in the chain
+// rather than a queue, so a slow client falls behind and catches up without
+// losing messages. A block whose state update is unavailable and cannot be
+// regenerated is reported with a `"skipped": true` message rather than
+// holding the subscription up.
+func (b *BlockUpdates) BlockUpdatesConfirmed(ctx context.Context, start *blockNumberOrHash, opts *confirmedOptions) (<-chan map[string]interface{}, error) {
+	if opts == nil {
+		opts = &confirmedOptions{}
+	}
+	if err := opts.validate(); err != nil { return nil, err }
+	var offset *sinkOffset
+	if start != nil && (start.Hash != nil || start.Number.Int64() >= 0) {
+		startBlock, err := start.block(ctx, b.backend)
+		if err != nil { return nil, err }
+		if startBlock.NumberU64() == 0 { return nil, fmt.Errorf("cannot start from the genesis block") }
+		if _, err := loadStateUpdate(startBlock); err != nil {
+			return nil, fmt.Errorf("cannot resume from block %v, state updates have been pruned", startBlock.NumberU64())
+		}
+		offset = &sinkOffset{startBlock.NumberU64() - 1, startBlock.ParentHash()}
+	}
+	view := &viewOptions{Decoded: opts.Decoded, Attribution: opts.Attribution, Format: opts.Format}
+	ch := make(chan map[string]interface{}, 1000)
+	// The feed only wakes us up, so it must never block on a slow client
+	wake := make(chan struct{}, 1)
+	wake <- struct{}{}
+	events := make(chan map[string]interface{}, 16)
+	sub := blockEvents.Subscribe(events)
+	go func() {
+		for {
+			select {
+			case <-events:
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	deliver := func(ctx context.Context, msg map[string]interface{}, next *sinkOffset) error {
+		if !skipped(msg) {
+			var err error
+			if msg, err = view.present(opts.Filter.apply(msg), opts.Filter); err != nil { return err }
+		}
+		if msg == nil {
+			offset = next
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ch <- msg:
+		}
+		offset = next
+		return nil
+	}
+	go func() {
+		log.Info("BlockUpdatesConfirmed subscription setup", "depth", opts.Depth, "tag", opts.Tag)
+		defer log.Info("BlockUpdatesConfirmed subscription closed", "depth", opts.Depth, "tag", opts.Tag)
+		defer sub.Unsubscribe()
+		defer close(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+			}
+			confirmed, err := confirmedHeader(ctx, opts)
+			if err != nil {
+				log.Warn("Could not get confirmed block", "err", err)
+				continue
+			}
+			if confirmed == nil { continue }
+			if offset == nil {
+				offset = &sinkOffset{confirmed.Number.Uint64(), confirmed.Hash()}
+				continue
+			}
+			if _, err := followCanonical(ctx, offset, confirmed.Number.Uint64(), deliver); err != nil {
+				if ctx.Err() != nil { return }
+				log.Warn("Could not deliver confirmed block updates", "err", err)
+			}
+		}
+	}()
+	return ch, nil
+}
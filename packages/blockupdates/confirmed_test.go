@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConfirmedOptions(t *testing.T) {
+	for _, c := range []struct {
+		opts confirmedOptions
+		valid bool
+	}{
+		{confirmedOptions{}, false},
+		{confirmedOptions{Depth: 12}, true},
+		{confirmedOptions{Tag: tagSafe}, true},
+		{confirmedOptions{Tag: tagFinalized}, true},
+		{confirmedOptions{Tag: tagFinalized, Depth: 12}, false},
+		{confirmedOptions{Tag: "latest"}, false},
+	} {
+		if err := c.opts.validate(); (err == nil) != c.valid {
+			t.Errorf("Unexpected result validating %+v: %v", c.opts, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+var (
+	suPrefix = []byte("su")
+	// schemaKey tracks which layout the stored state updates are in. It must
+	// not start with suPrefix.
+	schemaKey = []byte("blockupdates-schema")
+)
+
+const (
+	// legacyKeyLength is the length of "su" + state root keys
+	legacyKeyLength = 2 + 32
+	// suKeyLength is the length of "su" + number + hash keys
+	suKeyLength = 2 + 8 + 32
+
+	schemaBlockKeyed = 1
+)
+
+// rootPair identifies a state transition reported by StateUpdate before we
+// know which block it belongs to.
+type rootPair struct {
+	root core.Hash
+	parent core.Hash
+}
+
+// suKey returns the database key for the state update of a block. Keys are
+// ordered by number so that records can be iterated in block order.
+func suKey(number uint64, hash core.Hash) []byte {
+	key := make([]byte, suKeyLength)
+	copy(key, suPrefix)
+	binary.BigEndian.PutUint64(key[2:10], number)
+	copy(key[10:], hash.Bytes())
+	return key
+}
+
+// parseSuKey extracts the block number and hash from a state update key.
+func parseSuKey(key []byte) (uint64, core.Hash, bool) {
+	if len(key) != suKeyLength || !bytes.HasPrefix(key, suPrefix) {
+		return 0, core.Hash{}, false
+	}
+	return binary.BigEndian.Uint64(key[2:10]), core.BytesToHash(key[10:]), true
+}
+
+func decodeHeader(data []byte) (*types.Header, error) {
+	header := new(types.Header)
+	if err := rlp.DecodeBytes(data, header); err != nil { return nil, err }
+	return header, nil
+}
+
+// resolveStateUpdate ties the pending state update for a block's state
+// transition to that block, queueing it to be stored under the block's number
+// and hash. Blocks that don't change the state root never get a StateUpdate
+// call, so they resolve to an empty state update.
+func resolveStateUpdate(block *types.Block) *stateUpdate {
+	if v, ok := cache.Get(block.Hash()); ok {
+		return v.(*stateUpdate)
+	}
+	if block.NumberU64() == 0 { return nil }
+	headerBytes, err := backend.HeaderByHash(context.Background(), block.ParentHash())
+	if err != nil { return nil }
+	parent, err := decodeHeader(headerBytes)
+	if err != nil { return nil }
+	var su *stateUpdate
+	if v, ok := pending.Get(rootPair{block.Root(), parent.Root}); ok {
+		su = v.(*stateUpdate)
+	} else if block.Root() == parent.Root {
+		su = &stateUpdate{
+			Destructs: make(map[core.Hash]struct{}),
+			Accounts: make(map[core.Hash][]byte),
+			Storage: make(map[core.Hash]map[core.Hash][]byte),
+			Code: make(map[core.Hash][]byte),
+		}
+	} else {
+		return nil
+	}
+	cache.Add(block.Hash(), su)
+	suCh <- &stateUpdateWithBlock{su: su, number: block.NumberU64(), hash: block.Hash()}
+	return su
+}
+
+// migrateStateUpdates converts state updates stored under "su"+root keys to
+// "su"+number+hash keys. Legacy records are matched against the canonical
+// chain still held in leveldb; records that match no canonical block are
+// dropped, as they could not be reliably attributed to a block.
+func migrateStateUpdates() error {
+	db := backend.ChainDb()
+	if version, err := db.Get(schemaKey); err == nil && len(version) > 0 && version[0] >= schemaBlockKeyed {
+		return nil
+	}
+	legacy := make(map[core.Hash]struct{})
+	it := db.NewIterator(suPrefix, nil)
+	for it.Next() {
+		if len(it.Key()) == legacyKeyLength {
+			legacy[core.BytesToHash(it.Key()[2:])] = struct{}{}
+		}
+	}
+	it.Release()
+	if err := it.Error(); err != nil { return err }
+	if len(legacy) > 0 {
+		log.Info("Migrating stored state updates", "records", len(legacy))
+		ancients, err := db.Ancients()
+		if err != nil { ancients = 0 }
+		current, err := decodeHeader(backend.CurrentHeader())
+		if err != nil { return err }
+		migrated := 0
+		header := current
+		for header.Number.Uint64() > ancients && len(legacy) > migrated {
+			parentBytes, err := backend.HeaderByHash(context.Background(), header.ParentHash)
+			if err != nil { return fmt.Errorf("could not load header %#x: %v", header.ParentHash, err) }
+			parent, err := decodeHeader(parentBytes)
+			if err != nil { return err }
+			if _, ok := legacy[header.Root]; ok && header.Root != parent.Root {
+				data, err := db.Get(append(suPrefix, header.Root.Bytes()...))
+				if err == nil {
+					if err := db.Put(suKey(header.Number.Uint64(), header.Hash()), data); err != nil { return err }
+					migrated++
+				}
+			}
+			header = parent
+		}
+		for root := range legacy {
+			if err := db.Delete(append(suPrefix, root.Bytes()...)); err != nil { return err }
+		}
+		log.Info("Migrated stored state updates", "migrated", migrated, "dropped", len(legacy) - migrated)
+	}
+	return db.Put(schemaKey, []byte{schemaBlockKeyed})
+}
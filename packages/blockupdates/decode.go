@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+)
+
+// preimagePrefix is the prefix geth stores hash preimages under. Preimages are
+// only recorded when the node runs with --cache.preimages.
+var preimagePrefix = []byte("secure-key-")
+
+// viewOptions selects how block updates are presented. Decoded and
+// Attribution do not apply to the cardinal format.
+type viewOptions struct {
+	Decoded bool `json:"decoded"`
+	Attribution bool `json:"attribution"`
+	Format string `json:"format"`
+}
+
+// present applies the view to a block updates message that has already been
+// trimmed by filter. A nil message means there is nothing to send in this
+// format.
+func (view *viewOptions) present(msg map[string]interface{}, filter *blockUpdatesFilter) (map[string]interface{}, error) {
+	if view == nil { return msg, nil }
+	if view.Format == formatCardinal {
+		return cardinalMessage(context.Background(), msg)
+	}
+	var err error
+	if view.Attribution {
+		if msg, err = withAttribution(msg, filter); err != nil { return nil, err }
+	}
+	if view.Decoded {
+		return decodeBlockUpdates(msg)
+	}
+	return msg, nil
+}
+
+type decodedAccount struct {
+	Address *core.Address `json:"address,omitempty"`
+	Deleted bool `json:"deleted,omitempty"`
+	Nonce *hexutil.Uint64 `json:"nonce,omitempty"`
+	Balance *hexutil.Big `json:"balance,omitempty"`
+	StorageRoot *core.Hash `json:"storageRoot,omitempty"`
+	CodeHash *core.Hash `json:"codeHash,omitempty"`
+}
+
+type decodedDestruct struct {
+	Hash core.Hash `json:"hash"`
+	Address *core.Address `json:"address,omitempty"`
+}
+
+type decodedSlot struct {
+	Slot *core.Hash `json:"slot,omitempty"`
+	Value core.Hash `json:"value"`
+}
+
+type decodedStorage struct {
+	Address *core.Address `json:"address,omitempty"`
+	Slots map[core.Hash]decodedSlot `json:"slots"`
+}
+
+// decodedStateUpdate is a human readable view of a stateUpdate. Entries stay
+// keyed by hashed account and slot, with the address and slot filled in
+// wherever the preimage is known.
+type decodedStateUpdate struct {
+	Destructs []decodedDestruct `json:"destructs"`
+	Accounts map[core.Hash]decodedAccount `json:"accounts"`
+	Storage map[core.Hash]decodedStorage `json:"storage"`
+	Code map[core.Hash]hexutil.Bytes `json:"code"`
+}
+
+// chainPreimage looks up the preimage of a hash in the chain database,
+// returning nil if it is not known.
+func chainPreimage(hash core.Hash) []byte {
+	data, err := backend.ChainDb().Get(append(append([]byte{}, preimagePrefix...), hash[:]...))
+	if err != nil { return nil }
+	return data
+}
+
+func preimageAddress(preimage func(core.Hash) []byte, hash core.Hash) *core.Address {
+	data := preimage(hash)
+	if len(data) != len(core.Address{}) { return nil }
+	addr := core.BytesToAddress(data)
+	return &addr
+}
+
+// decodeStateUpdate expands the accounts and storage values of su, resolving
+// addresses and slots through preimage.
+func decodeStateUpdate(su *stateUpdate, preimage func(core.Hash) []byte) (*decodedStateUpdate, error) {
+	result := &decodedStateUpdate{
+		Destructs: make([]decodedDestruct, 0, len(su.Destructs)),
+		Accounts: make(map[core.Hash]decodedAccount, len(su.Accounts)),
+		Storage: make(map[core.Hash]decodedStorage, len(su.Storage)),
+		Code: make(map[core.Hash]hexutil.Bytes, len(su.Code)),
+	}
+	addresses := make(map[core.Hash]*core.Address)
+	address := func(hash core.Hash) *core.Address {
+		if addr, ok := addresses[hash]; ok { return addr }
+		addr := preimageAddress(preimage, hash)
+		addresses[hash] = addr
+		return addr
+	}
+	for account := range su.Destructs {
+		result.Destructs = append(result.Destructs, decodedDestruct{Hash: account, Address: address(account)})
+	}
+	for account, data := range su.Accounts {
+		decoded := decodedAccount{Address: address(account)}
+		if len(data) == 0 {
+			decoded.Deleted = true
+			result.Accounts[account] = decoded
+			continue
+		}
+		acct, err := fullAccountFromSlim(data)
+		if err != nil { return nil, err }
+		nonce := hexutil.Uint64(acct.Nonce)
+		codeHash := core.BytesToHash(acct.CodeHash)
+		decoded.Nonce = &nonce
+		decoded.Balance = (*hexutil.Big)(acct.Balance)
+		decoded.StorageRoot = &acct.Root
+		decoded.CodeHash = &codeHash
+		result.Accounts[account] = decoded
+	}
+	for account, slots := range su.Storage {
+		decoded := decodedStorage{Address: address(account), Slots: make(map[core.Hash]decodedSlot, len(slots))}
+		for slot, data := range slots {
+			var value core.Hash
+			if len(data) > 0 {
+				_, content, _, err := rlp.Split(data)
+				if err != nil { return nil, err }
+				value = core.BytesToHash(content)
+			}
+			entry := decodedSlot{Value: value}
+			if key := preimage(slot); len(key) == len(core.Hash{}) {
+				keyHash := core.BytesToHash(key)
+				entry.Slot = &keyHash
+			}
+			decoded.Slots[slot] = entry
+		}
+		result.Storage[account] = decoded
+	}
+	for hash, code := range su.Code {
+		result.Code[hash] = hexutil.Bytes(code)
+	}
+	return result, nil
+}
+
+// decodeBlockUpdates returns a copy of a block updates message with its state
+// updates replaced by the decoded view. The original message is left
+// untouched, as it may be shared with other subscribers. The stateUpdatesHash
+// commits to the encoded state updates, not the decoded view, so it is left
+// out.
+func decodeBlockUpdates(msg map[string]interface{}) (map[string]interface{}, error) {
+	su, ok := msg["stateUpdates"].(*stateUpdate)
+	if !ok { return msg, nil }
+	decoded, err := decodeStateUpdate(su, chainPreimage)
+	if err != nil { return nil, err }
+	result := make(map[string]interface{}, len(msg))
+	for k, v := range msg {
+		result[k] = v
+	}
+	result["stateUpdates"] = decoded
+	delete(result, "stateUpdatesHash")
+	return result, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+func TestDecodeStateUpdate(t *testing.T) {
+	a := core.HexToAddress("0x01")
+	slot := core.HexToHash("0x05")
+	aHash := crypto.Keccak256Hash(a[:])
+	slotHash := crypto.Keccak256Hash(slot[:])
+	unknown := core.HexToHash("0x99")
+	acct, _ := rlp.EncodeToBytes(slimAccount{Nonce: 7, Balance: big.NewInt(1000)})
+	value, _ := rlp.EncodeToBytes([]byte{0x12, 0x34})
+	su := &stateUpdate{
+		Destructs: map[core.Hash]struct{}{unknown: {}},
+		Accounts: map[core.Hash][]byte{aHash: acct, unknown: {}},
+		Storage: map[core.Hash]map[core.Hash][]byte{
+			aHash: {slotHash: value, unknown: {}},
+		},
+		Code: map[core.Hash][]byte{},
+	}
+	preimages := map[core.Hash][]byte{aHash: a[:], slotHash: slot[:]}
+	decoded, err := decodeStateUpdate(su, func(h core.Hash) []byte { return preimages[h] })
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err.Error())
+	}
+	if len(decoded.Destructs) != 1 || decoded.Destructs[0].Address != nil {
+		t.Errorf("Unexpected destructs %v", decoded.Destructs)
+	}
+	account := decoded.Accounts[aHash]
+	if account.Address == nil || *account.Address != a {
+		t.Errorf("Expected address to be resolved")
+	}
+	if uint64(*account.Nonce) != 7 || account.Balance.ToInt().Int64() != 1000 || *account.StorageRoot != types.EmptyRootHash || *account.CodeHash != core.BytesToHash(emptyCodeHash) {
+		t.Errorf("Unexpected account %v", account)
+	}
+	if !decoded.Accounts[unknown].Deleted || decoded.Accounts[unknown].Address != nil {
+		t.Errorf("Expected unknown account to be deleted without an address")
+	}
+	slots := decoded.Storage[aHash].Slots
+	if slots[slotHash].Slot == nil || *slots[slotHash].Slot != slot || slots[slotHash].Value != core.HexToHash("0x1234") {
+		t.Errorf("Unexpected slot %v", slots[slotHash])
+	}
+	if slots[unknown].Slot != nil || slots[unknown].Value != (core.Hash{}) {
+		t.Errorf("Unexpected cleared slot %v", slots[unknown])
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+// blockUpdatesFilter trims block updates down to the transactions, receipts,
+// logs and state changes a client cares about. Empty criteria match
+// everything.
+//
+// Transactions (and their receipts) are kept if they were sent from an
+// address in From, sent to an address in To, involve one of Accounts as
+// sender, recipient or created contract, or emitted a log matching the log
+// criteria. Logs are kept if they were emitted by one of Accounts and carry
+// one of Topics. State changes are kept for Accounts and AccountHashes, and
+// storage changes are further limited to StorageSlots.
+type blockUpdatesFilter struct {
+	Accounts []core.Address `json:"accounts"`
+	AccountHashes []core.Hash `json:"accountHashes"`
+	StorageSlots []core.Hash `json:"storageSlots"`
+	Topics []core.Hash `json:"topics"`
+	From []core.Address `json:"from"`
+	To []core.Address `json:"to"`
+
+	accounts map[core.Address]struct{}
+	accountHashes map[core.Hash]struct{}
+	slotHashes map[core.Hash]struct{}
+	topics map[core.Hash]struct{}
+	from map[core.Address]struct{}
+	to map[core.Address]struct{}
+}
+
+func addressSet(addrs []core.Address) map[core.Address]struct{} {
+	set := make(map[core.Address]struct{}, len(addrs))
+	for _, addr := range addrs {
+		set[addr] = struct{}{}
+	}
+	return set
+}
+
+func hashSet(hashes []core.Hash) map[core.Hash]struct{} {
+	set := make(map[core.Hash]struct{}, len(hashes))
+	for _, hash := range hashes {
+		set[hash] = struct{}{}
+	}
+	return set
+}
+
+// compile prepares the lookup sets used when applying the filter. State
+// updates are keyed by hashed addresses and slots, so those are hashed here.
+func (f *blockUpdatesFilter) compile() {
+	f.accounts = addressSet(f.Accounts)
+	f.accountHashes = hashSet(f.AccountHashes)
+	for _, addr := range f.Accounts {
+		f.accountHashes[crypto.Keccak256Hash(addr[:])] = struct{}{}
+	}
+	f.slotHashes = make(map[core.Hash]struct{}, len(f.StorageSlots))
+	for _, slot := range f.StorageSlots {
+		f.slotHashes[crypto.Keccak256Hash(slot[:])] = struct{}{}
+	}
+	f.topics = hashSet(f.Topics)
+	f.from = addressSet(f.From)
+	f.to = addressSet(f.To)
+}
+
+func (f *blockUpdatesFilter) matchLog(l *types.Log) bool {
+	if len(f.accounts) > 0 {
+		if _, ok := f.accounts[l.Address]; !ok { return false }
+	}
+	if len(f.topics) > 0 {
+		for _, topic := range l.Topics {
+			if _, ok := f.topics[topic]; ok { return true }
+		}
+		return false
+	}
+	return true
+}
+
+func (f *blockUpdatesFilter) matchTx(tx *RPCTransaction, receipt *types.Receipt) bool {
+	if len(f.accounts) == 0 && len(f.topics) == 0 && len(f.from) == 0 && len(f.to) == 0 {
+		return true
+	}
+	if _, ok := f.from[tx.From]; ok { return true }
+	if tx.To != nil {
+		if _, ok := f.to[*tx.To]; ok { return true }
+	}
+	if len(f.accounts) > 0 {
+		if _, ok := f.accounts[tx.From]; ok { return true }
+		if tx.To != nil {
+			if _, ok := f.accounts[*tx.To]; ok { return true }
+		}
+		if receipt != nil {
+			if _, ok := f.accounts[receipt.ContractAddress]; ok && tx.To == nil { return true }
+		}
+	}
+	if receipt != nil && (len(f.accounts) > 0 || len(f.topics) > 0) {
+		for _, l := range receipt.Logs {
+			if f.matchLog(l) { return true }
+		}
+	}
+	return false
+}
+
+func (f *blockUpdatesFilter) matchAccount(account core.Hash) bool {
+	if len(f.accountHashes) == 0 { return true }
+	_, ok := f.accountHashes[account]
+	return ok
+}
+
+// filterStateUpdate returns the subset of su matching the filter.
+func (f *blockUpdatesFilter) filterStateUpdate(su *stateUpdate) *stateUpdate {
+	if len(f.accountHashes) == 0 && len(f.slotHashes) == 0 { return su }
+	result := &stateUpdate{
+		Destructs: make(map[core.Hash]struct{}),
+		Accounts: make(map[core.Hash][]byte),
+		Storage: make(map[core.Hash]map[core.Hash][]byte),
+		Code: make(map[core.Hash][]byte),
+	}
+	for account := range su.Destructs {
+		if f.matchAccount(account) {
+			result.Destructs[account] = struct{}{}
+		}
+	}
+	for account, data := range su.Accounts {
+		if !f.matchAccount(account) { continue }
+		result.Accounts[account] = data
+		if acct, err := fullAccountFromSlim(data); err == nil {
+			codeHash := core.BytesToHash(acct.CodeHash)
+			if code, ok := su.Code[codeHash]; ok {
+				result.Code[codeHash] = code
+			}
+		}
+	}
+	for account, slots := range su.Storage {
+		if !f.matchAccount(account) { continue }
+		if len(f.slotHashes) == 0 {
+			result.Storage[account] = slots
+			continue
+		}
+		for slot, value := range slots {
+			if _, ok := f.slotHashes[slot]; !ok { continue }
+			if _, ok := result.Storage[account]; !ok {
+				result.Storage[account] = make(map[core.Hash][]byte)
+			}
+			result.Storage[account][slot] = value
+		}
+	}
+	return result
+}
+
+// filterTxStateChanges returns the per transaction state changes touching
+// the filter's accounts.
+func (f *blockUpdatesFilter) filterTxStateChanges(changes []*txStateChanges) []*txStateChanges {
+	if f == nil || (len(f.accountHashes) == 0 && len(f.slotHashes) == 0) { return changes }
+	result := make([]*txStateChanges, 0, len(changes))
+	for _, c := range changes {
+		trimmed := &txStateChanges{Index: c.Index, Hash: c.Hash, Accounts: []txAccount{}, Storage: []txSlot{}, Code: []txCode{}}
+		for _, acct := range c.Accounts {
+			if !f.matchAccount(crypto.Keccak256Hash(acct.Address[:])) { continue }
+			trimmed.Accounts = append(trimmed.Accounts, acct)
+			for _, code := range c.Code {
+				if code.Hash == acct.CodeHash {
+					trimmed.Code = append(trimmed.Code, code)
+				}
+			}
+		}
+		for _, slot := range c.Storage {
+			if !f.matchAccount(crypto.Keccak256Hash(slot.Address[:])) { continue }
+			if len(f.slotHashes) > 0 {
+				if _, ok := f.slotHashes[crypto.Keccak256Hash(slot.Slot[:])]; !ok { continue }
+			}
+			trimmed.Storage = append(trimmed.Storage, slot)
+		}
+		if len(trimmed.Accounts) > 0 || len(trimmed.Storage) > 0 {
+			result = append(result, trimmed)
+		}
+	}
+	return result
+}
+
+// apply returns a copy of a block updates message trimmed down to the parts
+// matching the filter. The original message is left untouched, as it may be
+// shared with other subscribers. Trimmed state updates no longer match the
+// stateUpdatesHash of the block, so it is left out.
+func (f *blockUpdatesFilter) apply(msg map[string]interface{}) map[string]interface{} {
+	if f == nil { return msg }
+	result := make(map[string]interface{}, len(msg))
+	for k, v := range msg {
+		result[k] = v
+	}
+	if su, ok := msg["stateUpdates"].(*stateUpdate); ok {
+		if filtered := f.filterStateUpdate(su); filtered != su {
+			result["stateUpdates"] = filtered
+			delete(result, "stateUpdatesHash")
+		}
+	}
+	txs, ok := msg["transactions"].([]interface{})
+	if !ok { return result }
+	receipts, _ := msg["receipts"].(types.Receipts)
+	receiptsByTx := make(map[core.Hash]*types.Receipt, len(receipts))
+	for _, r := range receipts {
+		receiptsByTx[r.TxHash] = r
+	}
+	keptTxs := make([]interface{}, 0, len(txs))
+	keptReceipts := make(types.Receipts, 0, len(receipts))
+	for _, txi := range txs {
+		tx, ok := txi.(*RPCTransaction)
+		if !ok { continue }
+		receipt := receiptsByTx[tx.Hash]
+		if !f.matchTx(tx, receipt) { continue }
+		keptTxs = append(keptTxs, tx)
+		if receipt == nil { continue }
+		if len(f.accounts) > 0 || len(f.topics) > 0 {
+			trimmed := *receipt
+			trimmed.Logs = make([]*types.Log, 0, len(receipt.Logs))
+			for _, l := range receipt.Logs {
+				if f.matchLog(l) {
+					trimmed.Logs = append(trimmed.Logs, l)
+				}
+			}
+			receipt = &trimmed
+		}
+		keptReceipts = append(keptReceipts, receipt)
+	}
+	result["transactions"] = keptTxs
+	result["receipts"] = keptReceipts
+	return result
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+func TestFilterApply(t *testing.T) {
+	a := core.HexToAddress("0x01")
+	b := core.HexToAddress("0x02")
+	topic := core.HexToHash("0xaa")
+	codeHash := crypto.Keccak256([]byte("code"))
+	acct, _ := rlp.EncodeToBytes(slimAccount{Nonce: 1, Balance: big.NewInt(1), CodeHash: codeHash})
+	slot := core.HexToHash("0x05")
+	su := &stateUpdate{
+		Destructs: map[core.Hash]struct{}{},
+		Accounts: map[core.Hash][]byte{
+			crypto.Keccak256Hash(a[:]): acct,
+			crypto.Keccak256Hash(b[:]): acct,
+		},
+		Storage: map[core.Hash]map[core.Hash][]byte{
+			crypto.Keccak256Hash(a[:]): {
+				crypto.Keccak256Hash(slot[:]): []byte{1},
+				core.HexToHash("0x06"): []byte{2},
+			},
+		},
+		Code: map[core.Hash][]byte{core.BytesToHash(codeHash): []byte("code")},
+	}
+	txs := []interface{}{
+		&RPCTransaction{Hash: core.HexToHash("0x10"), From: b, To: &b},
+		&RPCTransaction{Hash: core.HexToHash("0x11"), From: b, To: &b},
+	}
+	receipts := types.Receipts{
+		{TxHash: core.HexToHash("0x10"), Logs: []*types.Log{{Address: a, Topics: []core.Hash{topic}}, {Address: b, Topics: []core.Hash{topic}}}},
+		{TxHash: core.HexToHash("0x11"), Logs: []*types.Log{{Address: b, Topics: []core.Hash{topic}}}},
+	}
+	msg := map[string]interface{}{"transactions": txs, "receipts": receipts}
+	if err := setStateUpdates(msg, su); err != nil {
+		t.Fatalf("Error setting state updates: %v", err.Error())
+	}
+	filter := &blockUpdatesFilter{Accounts: []core.Address{a}, StorageSlots: []core.Hash{slot}}
+	filter.compile()
+	result := filter.apply(msg)
+	filtered := result["stateUpdates"].(*stateUpdate)
+	if len(filtered.Accounts) != 1 || len(filtered.Storage[crypto.Keccak256Hash(a[:])]) != 1 || len(filtered.Code) != 1 {
+		t.Errorf("Unexpected filtered state update %v", filtered)
+	}
+	if _, ok := result["stateUpdatesHash"]; ok {
+		t.Errorf("Filtered state updates should not carry the block's state updates hash")
+	}
+	if _, ok := msg["stateUpdatesHash"]; !ok {
+		t.Errorf("Original message should keep its state updates hash")
+	}
+	txFilter := &blockUpdatesFilter{Topics: []core.Hash{topic}}
+	txFilter.compile()
+	if _, ok := txFilter.apply(msg)["stateUpdatesHash"]; !ok {
+		t.Errorf("Untrimmed state updates should keep their hash")
+	}
+	if len(result["transactions"].([]interface{})) != 1 {
+		t.Errorf("Expected one matching transaction")
+	}
+	keptReceipts := result["receipts"].(types.Receipts)
+	if len(keptReceipts) != 1 || len(keptReceipts[0].Logs) != 1 {
+		t.Errorf("Expected one receipt with one log")
+	}
+	if len(msg["receipts"].(types.Receipts)[0].Logs) != 2 || len(su.Accounts) != 2 {
+		t.Errorf("Original message should not be modified")
+	}
+}
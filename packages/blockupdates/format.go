@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+)
+
+// recordVersionCompressed is the version of records holding a compressed
+// compactStateUpdate, with code referenced by hash.
+const recordVersionCompressed = 1
+
+// codePrefix holds contract code referenced by stored records, keyed by code
+// hash, when the node's own code store does not have it, as on a snap synced
+// node importing an archive of older blocks. Each code is stored once, however
+// many records reference it, and is kept for as long as the database.
+var codePrefix = []byte("sc")
+
+func codeKey(hash core.Hash) []byte {
+	return append(append([]byte{}, codePrefix...), hash[:]...)
+}
+
+// versionedRecord is the database format for state updates and reverse
+// diffs. Unversioned records are a bare storedStateUpdate, which is a list
+// of lists, so the leading version number tells the two apart.
+type versionedRecord struct {
+	Version uint
+	Payload []byte
+}
+
+// compactStateUpdate is a storedStateUpdate with code replaced by code hashes.
+type compactStateUpdate struct {
+	Destructs []core.Hash
+	Accounts []kvpair
+	Storage []storage
+	Code []core.Hash
+}
+
+// isVersionedRecord indicates whether an encoded state update is a
+// versionedRecord rather than an unversioned storedStateUpdate.
+func isVersionedRecord(data []byte) bool {
+	content, _, err := rlp.SplitList(data)
+	if err != nil || len(content) == 0 { return false }
+	kind, _, _, err := rlp.Split(content)
+	return err == nil && kind != rlp.List
+}
+
+// encodeStoredStateUpdate encodes a state update for the database,
+// replacing its code with code hashes and compressing the rest. Code the
+// node's code store does not have is stored under codePrefix.
+func encodeStoredStateUpdate(su *stateUpdate) ([]byte, error) {
+	ssu := su.stored()
+	if len(ssu.Code) > 0 && backend == nil {
+		return nil, fmt.Errorf("cannot store code for state update before the node is initialized")
+	}
+	compact := compactStateUpdate{ssu.Destructs, ssu.Accounts, ssu.Storage, make([]core.Hash, 0, len(ssu.Code))}
+	for _, kv := range ssu.Code {
+		if err := storeCode(kv.Key, kv.Value); err != nil { return nil, err }
+		compact.Code = append(compact.Code, kv.Key)
+	}
+	payload, err := rlp.EncodeToBytes(compact)
+	if err != nil { return nil, err }
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil { return nil, err }
+	if _, err := w.Write(payload); err != nil { return nil, err }
+	if err := w.Close(); err != nil { return nil, err }
+	return rlp.EncodeToBytes(versionedRecord{recordVersionCompressed, buf.Bytes()})
+}
+
+// storeCode stores code under codePrefix unless the node's code store or
+// codePrefix already has it.
+func storeCode(hash core.Hash, code []byte) error {
+	if stored, err := backend.GetContractCode(hash); err == nil && len(stored) > 0 { return nil }
+	db := backend.ChainDb()
+	if ok, err := db.Has(codeKey(hash)); err == nil && ok { return nil }
+	return db.Put(codeKey(hash), code)
+}
+
+// loadCode reads contract code from the node's code store, falling back to
+// the copy under codePrefix.
+func loadCode(hash core.Hash) ([]byte, error) {
+	code, err := backend.GetContractCode(hash)
+	if err == nil && len(code) > 0 { return code, nil }
+	if stored, serr := backend.ChainDb().Get(codeKey(hash)); serr == nil { return stored, nil }
+	if err == nil {
+		err = fmt.Errorf("not found")
+	}
+	return nil, err
+}
+
+func (su *stateUpdate) decodeVersioned(data []byte) error {
+	var record versionedRecord
+	if err := rlp.DecodeBytes(data, &record); err != nil { return err }
+	if record.Version != recordVersionCompressed {
+		return fmt.Errorf("unsupported state update record version %v", record.Version)
+	}
+	payload, err := io.ReadAll(flate.NewReader(bytes.NewReader(record.Payload)))
+	if err != nil { return err }
+	var compact compactStateUpdate
+	if err := rlp.DecodeBytes(payload, &compact); err != nil { return err }
+	ssu := storedStateUpdate{compact.Destructs, compact.Accounts, compact.Storage, make([]kvpair, 0, len(compact.Code))}
+	if len(compact.Code) > 0 && backend == nil {
+		return fmt.Errorf("cannot load code for state update before the node is initialized")
+	}
+	for _, hash := range compact.Code {
+		code, err := loadCode(hash)
+		if err != nil { return fmt.Errorf("missing code %#x: %v", hash, err) }
+		ssu.Code = append(ssu.Code, kvpair{hash, code})
+	}
+	su.fromStored(ssu)
+	return nil
+}
+
+// compressionResult reports what CompressStateUpdates converted.
+type compressionResult struct {
+	Records hexutil.Uint64 `json:"records"`
+	Converted hexutil.Uint64 `json:"converted"`
+	BytesBefore hexutil.Uint64 `json:"bytesBefore"`
+	BytesAfter hexutil.Uint64 `json:"bytesAfter"`
+}
+
+// CompressStateUpdates converts stored state updates and reverse diffs in
+// unversioned records to the compressed format in place. Records that are
+// already converted are skipped, so an interrupted run can simply be
+// repeated. Frozen records are left as they are; they remain readable.
+func (a *BlockUpdatesAdmin) CompressStateUpdates(ctx context.Context) (*compressionResult, error) {
+	db := a.backend.ChainDb()
+	result := &compressionResult{}
+	for _, prefix := range [][]byte{suPrefix, reverseDiffPrefix} {
+		it := db.NewIterator(prefix, nil)
+		for it.Next() {
+			if err := ctx.Err(); err != nil {
+				it.Release()
+				return result, err
+			}
+			if len(it.Key()) != suKeyLength { continue }
+			result.Records++
+			if isVersionedRecord(it.Value()) { continue }
+			su := new(stateUpdate)
+			if err := rlp.DecodeBytes(it.Value(), su); err != nil {
+				log.Warn("Skipping undecodable state update record", "key", hexutil.Bytes(it.Key()), "err", err)
+				continue
+			}
+			data, err := encodeStoredStateUpdate(su)
+			if err != nil {
+				it.Release()
+				return result, err
+			}
+			if err := db.Put(append([]byte{}, it.Key()...), data); err != nil {
+				it.Release()
+				return result, err
+			}
+			result.Converted++
+			result.BytesBefore += hexutil.Uint64(len(it.Value()))
+			result.BytesAfter += hexutil.Uint64(len(data))
+		}
+		err := it.Error()
+		it.Release()
+		if err != nil { return result, err }
+	}
+	log.Info("Compressed stored state updates", "records", uint64(result.Records), "converted", uint64(result.Converted), "before", uint64(result.BytesBefore), "after", uint64(result.BytesAfter))
+	return result, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+)
+
+func TestStoredStateUpdateFormat(t *testing.T) {
+	value := bytes.Repeat([]byte{0x42}, 32)
+	su := &stateUpdate{
+		Destructs: map[core.Hash]struct{}{core.HexToHash("0x01"): {}},
+		Accounts: map[core.Hash][]byte{},
+		Storage: map[core.Hash]map[core.Hash][]byte{core.HexToHash("0x02"): {}},
+		Code: map[core.Hash][]byte{},
+	}
+	for i := 0; i < 64; i++ {
+		key := core.BytesToHash([]byte{byte(i + 1)})
+		su.Accounts[key] = value
+		su.Storage[core.HexToHash("0x02")][key] = value
+	}
+	legacy, _ := rlp.EncodeToBytes(su)
+	stored, err := encodeStoredStateUpdate(su)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err.Error())
+	}
+	if isVersionedRecord(legacy) || !isVersionedRecord(stored) {
+		t.Fatalf("Records not told apart")
+	}
+	if len(stored) >= len(legacy) {
+		t.Errorf("Compressed record is not smaller: %v >= %v", len(stored), len(legacy))
+	}
+	expected, _ := su.Hash()
+	for name, data := range map[string][]byte{"legacy": legacy, "stored": stored} {
+		decoded := new(stateUpdate)
+		if err := rlp.DecodeBytes(data, decoded); err != nil {
+			t.Fatalf("Error decoding %v record: %v", name, err.Error())
+		}
+		if hash, _ := decoded.Hash(); hash != expected {
+			t.Errorf("Decoded %v record does not match", name)
+		}
+	}
+}
+
+func TestStoredStateUpdateCode(t *testing.T) {
+	b, _ := newTestBackend(t)
+	code, storedCode := []byte{0x60, 0x00}, []byte{0x60, 0x01}
+	codeHash, storedHash := crypto.Keccak256Hash(code), crypto.Keccak256Hash(storedCode)
+	b.code[codeHash] = code
+	su := &stateUpdate{
+		Destructs: map[core.Hash]struct{}{},
+		Accounts: map[core.Hash][]byte{core.HexToHash("0x01"): {0x01}},
+		Storage: map[core.Hash]map[core.Hash][]byte{},
+		Code: map[core.Hash][]byte{codeHash: code},
+	}
+	stored, err := encodeStoredStateUpdate(su)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err.Error())
+	}
+	if len(b.db.data) != 0 {
+		t.Errorf("Encoding should not write code to the database")
+	}
+	decoded := new(stateUpdate)
+	if err := rlp.DecodeBytes(stored, decoded); err != nil {
+		t.Fatalf("Error decoding: %v", err.Error())
+	}
+	if !bytes.Equal(decoded.Code[codeHash], code) {
+		t.Errorf("Unexpected code: %v", decoded.Code)
+	}
+
+	// Code the node does not have is stored under codePrefix, once
+	su.Code = map[core.Hash][]byte{storedHash: storedCode}
+	stored, err = encodeStoredStateUpdate(su)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err.Error())
+	}
+	if data, err := b.db.Get(codeKey(storedHash)); err != nil || !bytes.Equal(data, storedCode) || len(b.db.data) != 1 {
+		t.Fatalf("Expected code to be stored under codePrefix: %x", data)
+	}
+	decoded = new(stateUpdate)
+	if err := rlp.DecodeBytes(stored, decoded); err != nil {
+		t.Fatalf("Error decoding stored code: %v", err.Error())
+	}
+	if !bytes.Equal(decoded.Code[storedHash], storedCode) {
+		t.Errorf("Unexpected stored code: %v", decoded.Code)
+	}
+
+	b.db.Delete(codeKey(storedHash))
+	if err := rlp.DecodeBytes(stored, new(stateUpdate)); err == nil {
+		t.Errorf("Expected missing code to fail decoding")
+	}
+	backend = nil
+	if err := rlp.DecodeBytes(stored, new(stateUpdate)); err == nil {
+		t.Errorf("Expected decoding code without a backend to fail")
+	}
+	if _, err := encodeStoredStateUpdate(su); err == nil {
+		t.Errorf("Expected encoding code without a backend to fail")
+	}
+}
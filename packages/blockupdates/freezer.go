@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// indexEntrySize is the size of an index entry: a 2 byte file number
+	// followed by a 4 byte offset, matching geth's freezer tables.
+	indexEntrySize = 6
+
+	// freezerMaxFileSize is the point at which a new data file is started.
+	freezerMaxFileSize = 2 * 1000 * 1000 * 1000
+)
+
+var (
+	errOutOfBounds = errors.New("out of bounds")
+	errOutOfOrder = errors.New("append out of order")
+)
+
+// indexEntry marks the end of an item within a data file. The first entry of
+// the index is special: its offset holds the number of the first item in the
+// table, allowing the table to start somewhere other than block 0.
+type indexEntry struct {
+	filenum uint16
+	offset uint32
+}
+
+func (i *indexEntry) unmarshal(b []byte) {
+	i.filenum = binary.BigEndian.Uint16(b[:2])
+	i.offset = binary.BigEndian.Uint32(b[2:6])
+}
+
+func (i *indexEntry) marshal() []byte {
+	b := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint16(b[:2], i.filenum)
+	binary.BigEndian.PutUint32(b[2:6], i.offset)
+	return b
+}
+
+// freezer is an append-only, number indexed flat file store. It mirrors the
+// layout of geth's freezer tables (a .ridx index file pointing into a series
+// of .rdat data files), without compression.
+type freezer struct {
+	lock sync.RWMutex
+	path string
+	name string
+	index *os.File
+	files map[uint16]*os.File
+	head *os.File
+	headId uint16
+	headBytes uint32
+	tail uint64  // Number of the first item in the table
+	items uint64 // Number of items in the table
+	maxFileSize uint32
+}
+
+// openFreezer opens (or creates) the freezer table with the given name in the
+// specified directory, repairing any partially written entries.
+func openFreezer(path, name string) (*freezer, error) {
+	if err := os.MkdirAll(path, 0755); err != nil { return nil, err }
+	index, err := os.OpenFile(filepath.Join(path, name+".ridx"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil { return nil, err }
+	f := &freezer{
+		path: path,
+		name: name,
+		index: index,
+		files: make(map[uint16]*os.File),
+		maxFileSize: freezerMaxFileSize,
+	}
+	if err := f.repair(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *freezer) dataPath(num uint16) string {
+	return filepath.Join(f.path, fmt.Sprintf("%s.%04d.rdat", f.name, num))
+}
+
+func (f *freezer) openFile(num uint16) (*os.File, error) {
+	if file, ok := f.files[num]; ok { return file, nil }
+	file, err := os.OpenFile(f.dataPath(num), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil { return nil, err }
+	f.files[num] = file
+	return file, nil
+}
+
+func (f *freezer) readEntry(pos uint64) (indexEntry, error) {
+	var entry indexEntry
+	buf := make([]byte, indexEntrySize)
+	if _, err := f.index.ReadAt(buf, int64(pos*indexEntrySize)); err != nil { return entry, err }
+	entry.unmarshal(buf)
+	return entry, nil
+}
+
+// repair makes sure the index and head data file agree with each other,
+// truncating anything that was left half written by an unclean shutdown.
+func (f *freezer) repair() error {
+	stat, err := f.index.Stat()
+	if err != nil { return err }
+	size := stat.Size()
+	if size == 0 {
+		// Fresh table, the tail will be set by the first append
+		if _, err := f.index.Write((&indexEntry{}).marshal()); err != nil { return err }
+		size = indexEntrySize
+	}
+	if overflow := size % indexEntrySize; overflow != 0 {
+		size -= overflow
+		if err := f.index.Truncate(size); err != nil { return err }
+	}
+	first, err := f.readEntry(0)
+	if err != nil { return err }
+	f.tail = uint64(first.offset)
+	for {
+		last, err := f.readEntry(uint64(size/indexEntrySize) - 1)
+		if err != nil { return err }
+		if size == indexEntrySize {
+			last = indexEntry{filenum: first.filenum}
+		}
+		head, err := f.openFile(last.filenum)
+		if err != nil { return err }
+		stat, err := head.Stat()
+		if err != nil { return err }
+		if stat.Size() < int64(last.offset) {
+			// The index points past the end of the data file, drop the entry
+			size -= indexEntrySize
+			if err := f.index.Truncate(size); err != nil { return err }
+			continue
+		}
+		if stat.Size() > int64(last.offset) {
+			if err := head.Truncate(int64(last.offset)); err != nil { return err }
+		}
+		f.head = head
+		f.headId = last.filenum
+		f.headBytes = last.offset
+		break
+	}
+	for num := first.filenum; num < f.headId; num++ {
+		if _, err := f.openFile(num); err != nil { return err }
+	}
+	f.items = uint64(size/indexEntrySize) - 1
+	if _, err := f.index.Seek(size, io.SeekStart); err != nil { return err }
+	if _, err := f.head.Seek(int64(f.headBytes), io.SeekStart); err != nil { return err }
+	return nil
+}
+
+// Tail returns the number of the first item in the table.
+func (f *freezer) Tail() uint64 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.tail
+}
+
+// Head returns the number the next appended item must have.
+func (f *freezer) Head() uint64 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.tail + f.items
+}
+
+// Items returns the number of items in the table.
+func (f *freezer) Items() uint64 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.items
+}
+
+// Has indicates whether the given item number is within the table.
+func (f *freezer) Has(number uint64) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.items > 0 && number >= f.tail && number < f.tail + f.items
+}
+
+// Append adds an item to the end of the table. Items must be appended in
+// order; if the table is empty, the first appended number becomes the tail.
+func (f *freezer) Append(number uint64, data []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.items == 0 && number != f.tail {
+		if number > 0xffffffff { return errOutOfBounds }
+		first := indexEntry{filenum: f.headId, offset: uint32(number)}
+		if _, err := f.index.WriteAt(first.marshal(), 0); err != nil { return err }
+		f.tail = number
+	}
+	if number != f.tail + f.items {
+		return fmt.Errorf("%w: expected %v, got %v", errOutOfOrder, f.tail + f.items, number)
+	}
+	if uint64(f.headBytes) + uint64(len(data)) > uint64(f.maxFileSize) {
+		if err := f.head.Sync(); err != nil { return err }
+		head, err := f.openFile(f.headId + 1)
+		if err != nil { return err }
+		f.head = head
+		f.headId++
+		f.headBytes = 0
+	}
+	if _, err := f.head.Write(data); err != nil { return err }
+	f.headBytes += uint32(len(data))
+	entry := indexEntry{filenum: f.headId, offset: f.headBytes}
+	if _, err := f.index.Write(entry.marshal()); err != nil { return err }
+	f.items++
+	return nil
+}
+
+// Retrieve looks up the item with the given number.
+func (f *freezer) Retrieve(number uint64) ([]byte, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.items == 0 || number < f.tail || number >= f.tail + f.items {
+		return nil, errOutOfBounds
+	}
+	pos := number - f.tail + 1
+	start, err := f.readEntry(pos - 1)
+	if err != nil { return nil, err }
+	end, err := f.readEntry(pos)
+	if err != nil { return nil, err }
+	if pos == 1 || start.filenum != end.filenum {
+		start.offset = 0
+	}
+	file, ok := f.files[end.filenum]
+	if !ok { return nil, fmt.Errorf("missing data file %v", end.filenum) }
+	data := make([]byte, end.offset - start.offset)
+	if _, err := file.ReadAt(data, int64(start.offset)); err != nil { return nil, err }
+	return data, nil
+}
+
+// TruncateHead discards all items numbered at or above the given number, so
+// that number becomes the next item to be appended.
+func (f *freezer) TruncateHead(number uint64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if number >= f.tail + f.items { return nil }
+	if number < f.tail { number = f.tail }
+	items := number - f.tail
+	last := indexEntry{filenum: f.headId}
+	if items > 0 {
+		var err error
+		if last, err = f.readEntry(items); err != nil { return err }
+	} else {
+		first, err := f.readEntry(0)
+		if err != nil { return err }
+		last = indexEntry{filenum: first.filenum}
+	}
+	size := int64((items + 1) * indexEntrySize)
+	if err := f.index.Truncate(size); err != nil { return err }
+	if _, err := f.index.Seek(size, io.SeekStart); err != nil { return err }
+	for num, file := range f.files {
+		if num > last.filenum {
+			file.Close()
+			os.Remove(f.dataPath(num))
+			delete(f.files, num)
+		}
+	}
+	head, err := f.openFile(last.filenum)
+	if err != nil { return err }
+	if err := head.Truncate(int64(last.offset)); err != nil { return err }
+	if _, err := head.Seek(int64(last.offset), io.SeekStart); err != nil { return err }
+	f.head = head
+	f.headId = last.filenum
+	f.headBytes = last.offset
+	f.items = items
+	return nil
+}
+
+// TruncateTail discards items numbered below the given number. Only whole
+// data files are removed, so some items below the number may be retained:
+// the new tail is the first item of the oldest remaining data file.
+func (f *freezer) TruncateTail(number uint64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.items == 0 || number <= f.tail { return nil }
+	limit := number - f.tail + 1
+	if limit > f.items {
+		limit = f.items
+	}
+	buf := make([]byte, (limit + 1) * indexEntrySize)
+	if _, err := f.index.ReadAt(buf, 0); err != nil { return err }
+	entries := make([]indexEntry, limit + 1)
+	for i := range entries {
+		entries[i].unmarshal(buf[i*indexEntrySize:])
+	}
+	// Find the last item within the limit that starts a new data file
+	pos := uint64(1)
+	for p := uint64(2); p <= limit; p++ {
+		if entries[p-1].filenum != entries[p].filenum {
+			pos = p
+		}
+	}
+	if pos == 1 { return nil }
+	tailFile := entries[pos].filenum
+	name := f.index.Name()
+	tmp, err := os.OpenFile(name + ".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil { return err }
+	first := indexEntry{filenum: tailFile, offset: uint32(f.tail + pos - 1)}
+	if _, err := tmp.Write(first.marshal()); err != nil {
+		tmp.Close()
+		return err
+	}
+	remaining := io.NewSectionReader(f.index, int64(pos * indexEntrySize), int64((f.items - pos + 1) * indexEntrySize))
+	if _, err := io.Copy(tmp, remaining); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(name + ".tmp", name); err != nil {
+		tmp.Close()
+		return err
+	}
+	f.index.Close()
+	f.index = tmp
+	if _, err := f.index.Seek(0, io.SeekEnd); err != nil { return err }
+	for num, file := range f.files {
+		if num < tailFile {
+			file.Close()
+			os.Remove(f.dataPath(num))
+			delete(f.files, num)
+		}
+	}
+	f.tail += pos - 1
+	f.items -= pos - 1
+	return nil
+}
+
+// SecondFileTail returns the number of the first item stored in the second
+// oldest data file, which is the tail that TruncateTail would need to remove
+// only the oldest data file.
+func (f *freezer) SecondFileTail() (uint64, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	first, err := f.readEntry(0)
+	if err != nil { return 0, false }
+	const chunk = 4096
+	buf := make([]byte, chunk * indexEntrySize)
+	for start := uint64(1); start <= f.items; start += chunk {
+		n, err := f.index.ReadAt(buf, int64(start * indexEntrySize))
+		if n == 0 && err != nil { return 0, false }
+		for i := 0; i < n / indexEntrySize; i++ {
+			var entry indexEntry
+			entry.unmarshal(buf[i*indexEntrySize:])
+			if entry.filenum != first.filenum {
+				return f.tail + start - 1 + uint64(i), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Size returns the total size of the table's index and data files.
+func (f *freezer) Size() (uint64, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	stat, err := f.index.Stat()
+	if err != nil { return 0, err }
+	size := uint64(stat.Size())
+	for _, file := range f.files {
+		stat, err := file.Stat()
+		if err != nil { return 0, err }
+		size += uint64(stat.Size())
+	}
+	return size, nil
+}
+
+// Sync flushes the index and head data file to disk.
+func (f *freezer) Sync() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.index.Sync(); err != nil { return err }
+	return f.head.Sync()
+}
+
+// Close closes all files associated with the table.
+func (f *freezer) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.index.Close()
+	for _, file := range f.files {
+		if cerr := file.Close(); cerr != nil && err == nil { err = cerr }
+	}
+	f.files = make(map[uint16]*os.File)
+	return err
+}
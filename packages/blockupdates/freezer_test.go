@@ -0,0 +1,175 @@
+package main
+
+import (
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+)
+
+func TestFreezerAppendRetrieve(t *testing.T) {
+	dir := t.TempDir()
+	f, err := openFreezer(dir, "test")
+	if err != nil {
+		t.Fatalf("Error opening freezer: %v", err.Error())
+	}
+	f.maxFileSize = 8
+	for i := uint64(100); i < 110; i++ {
+		if err := f.Append(i, []byte{byte(i), byte(i), byte(i)}); err != nil {
+			t.Fatalf("Error appending %v: %v", i, err.Error())
+		}
+	}
+	if err := f.Append(120, []byte{1}); err == nil {
+		t.Errorf("Expected out of order append to fail")
+	}
+	if f.Tail() != 100 || f.Head() != 110 {
+		t.Errorf("Unexpected bounds %v - %v", f.Tail(), f.Head())
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Error closing freezer: %v", err.Error())
+	}
+	f, err = openFreezer(dir, "test")
+	if err != nil {
+		t.Fatalf("Error reopening freezer: %v", err.Error())
+	}
+	defer f.Close()
+	for i := uint64(100); i < 110; i++ {
+		data, err := f.Retrieve(i)
+		if err != nil {
+			t.Fatalf("Error retrieving %v: %v", i, err.Error())
+		}
+		if len(data) != 3 || data[0] != byte(i) {
+			t.Errorf("Unexpected data for %v: %x", i, data)
+		}
+	}
+	if _, err := f.Retrieve(99); err != errOutOfBounds {
+		t.Errorf("Expected out of bounds error, got %v", err)
+	}
+	if err := f.TruncateHead(105); err != nil {
+		t.Fatalf("Error truncating: %v", err.Error())
+	}
+	if f.Has(105) || !f.Has(104) {
+		t.Errorf("Unexpected items after truncation")
+	}
+	if err := f.Append(105, []byte{7}); err != nil {
+		t.Fatalf("Error appending after truncation: %v", err.Error())
+	}
+	if data, _ := f.Retrieve(105); len(data) != 1 || data[0] != 7 {
+		t.Errorf("Unexpected data after truncation: %x", data)
+	}
+}
+
+func TestFreezerRepair(t *testing.T) {
+	dir := t.TempDir()
+	f, err := openFreezer(dir, "test")
+	if err != nil {
+		t.Fatalf("Error opening freezer: %v", err.Error())
+	}
+	f.Append(0, []byte("abc"))
+	f.Append(1, []byte("def"))
+	f.Close()
+	// Simulate a crash that left a partial index entry and truncated data
+	index, _ := os.OpenFile(f.index.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	index.Write([]byte{0, 0, 0})
+	index.Close()
+	os.Truncate(f.dataPath(0), 4)
+	f, err = openFreezer(dir, "test")
+	if err != nil {
+		t.Fatalf("Error reopening freezer: %v", err.Error())
+	}
+	defer f.Close()
+	if f.Head() != 1 {
+		t.Errorf("Expected head 1 after repair, got %v", f.Head())
+	}
+	if data, err := f.Retrieve(0); err != nil || string(data) != "abc" {
+		t.Errorf("Unexpected data after repair: %s %v", data, err)
+	}
+}
+
+func TestFreezerTruncateTail(t *testing.T) {
+	f, err := openFreezer(t.TempDir(), "test")
+	if err != nil {
+		t.Fatalf("Error opening freezer: %v", err.Error())
+	}
+	defer f.Close()
+	f.maxFileSize = 6
+	for i := uint64(10); i < 20; i++ {
+		f.Append(i, []byte{byte(i), byte(i), byte(i)})
+	}
+	// Two items fit per file, so files start at items 10, 12, 14, 16 and 18
+	if next, ok := f.SecondFileTail(); !ok || next != 12 {
+		t.Errorf("Unexpected second file tail %v", next)
+	}
+	if err := f.TruncateTail(15); err != nil {
+		t.Fatalf("Error truncating tail: %v", err.Error())
+	}
+	if f.Tail() != 14 || f.Head() != 20 {
+		t.Errorf("Unexpected bounds %v - %v", f.Tail(), f.Head())
+	}
+	for i := uint64(14); i < 20; i++ {
+		if data, err := f.Retrieve(i); err != nil || data[0] != byte(i) {
+			t.Errorf("Unexpected data for %v: %x %v", i, data, err)
+		}
+	}
+	if err := f.Append(20, []byte{20}); err != nil {
+		t.Errorf("Error appending after tail truncation: %v", err)
+	}
+	if _, err := os.Stat(f.dataPath(0)); !os.IsNotExist(err) {
+		t.Errorf("Expected first data file to be removed")
+	}
+}
+
+func TestAppendAncientBeforeMigration(t *testing.T) {
+	b, _ := newTestBackend(t)
+	oldCh, oldReady, oldFreezer := ancientCh, ancientReady, suFreezer
+	ancientCh, ancientReady = make(chan *ancientBlock, 4), make(chan struct{})
+	f, err := openFreezer(t.TempDir(), "stateupdates")
+	if err != nil {
+		t.Fatalf("Error opening freezer: %v", err.Error())
+	}
+	suFreezer = f
+	t.Cleanup(func() {
+		f.Close()
+		ancientCh, ancientReady, suFreezer = oldCh, oldReady, oldFreezer
+	})
+	done := make(chan struct{})
+	go func() {
+		freezeAncients()
+		close(done)
+	}()
+	hash := func(n uint64) core.Hash { return core.BytesToHash(new(big.Int).SetUint64(n + 1).Bytes()) }
+	for n := uint64(0); n < 100; n++ {
+		b.db.Put(suKey(n, hash(n)), []byte{byte(n)})
+	}
+	appended := make(chan struct{})
+	go func() {
+		for n := uint64(0); n < 100; n++ {
+			AppendAncient(n, hash(n).Bytes(), nil, nil, nil, nil)
+		}
+		close(appended)
+	}()
+	select {
+	case <-appended:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AppendAncient blocked before migration finished")
+	}
+	if ok, _ := b.db.Has(suKey(0, hash(0))); !ok || f.Items() != 0 {
+		t.Fatalf("Blocks were frozen before migration finished")
+	}
+	close(ancientReady)
+	close(ancientCh)
+	<-done
+	if f.Tail() != 0 || f.Head() != 100 {
+		t.Errorf("Unexpected freezer bounds %v - %v", f.Tail(), f.Head())
+	}
+	for n := uint64(0); n < 100; n++ {
+		if data, err := frozenStateUpdate(n, hash(n)); err != nil || len(data) != 1 || data[0] != byte(n) {
+			t.Errorf("Unexpected frozen state update %v: %x %v", n, data, err)
+		}
+		if ok, _ := b.db.Has(suKey(n, hash(n))); ok {
+			t.Errorf("State update %v left in leveldb", n)
+		}
+	}
+}
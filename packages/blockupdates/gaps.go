@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+const (
+	// maxCatchUp is the most blocks emitted to fill a gap before a new head.
+	// Anything older is reported as missed; clients can recover it with
+	// BlockUpdatesRange or by resuming a subscription.
+	maxCatchUp = 1024
+	maxRecentGaps = 16
+)
+
+var (
+	emittedKey = []byte("blockupdates-emitted")
+
+	emittedLock sync.Mutex
+	lastEmitted *sinkOffset
+	storedEmitted *sinkOffset
+	emission emissionStatus
+)
+
+// emissionGap is a run of blocks that were not emitted before a new head.
+type emissionGap struct {
+	Detected time.Time `json:"detected"`
+	From hexutil.Uint64 `json:"from"`
+	To hexutil.Uint64 `json:"to"`
+	Repaired hexutil.Uint64 `json:"repaired"`
+	Missed hexutil.Uint64 `json:"missed"`
+	Error string `json:"error,omitempty"`
+}
+
+// emissionStatus reports the last block emitted and the gaps found in
+// emission since the node started.
+type emissionStatus struct {
+	Number hexutil.Uint64 `json:"number"`
+	Hash core.Hash `json:"hash"`
+	GapsDetected hexutil.Uint64 `json:"gapsDetected"`
+	BlocksRepaired hexutil.Uint64 `json:"blocksRepaired"`
+	BlocksMissed hexutil.Uint64 `json:"blocksMissed"`
+	RecentGaps []emissionGap `json:"recentGaps"`
+}
+
+// loadLastEmitted restores the last block emitted before a restart, so the
+// blocks imported while the node was down can be emitted with the next head.
+func loadLastEmitted() {
+	data, err := backend.ChainDb().Get(emittedKey)
+	if err != nil || len(data) == 0 { return }
+	offset := &sinkOffset{}
+	if err := rlp.DecodeBytes(data, offset); err != nil {
+		log.Warn("Ignoring invalid last emitted block", "err", err)
+		return
+	}
+	emittedLock.Lock()
+	defer emittedLock.Unlock()
+	lastEmitted, storedEmitted = offset, offset
+	emission.Number = hexutil.Uint64(offset.Number)
+	emission.Hash = offset.Hash
+}
+
+func setLastEmitted(number uint64, hash core.Hash) {
+	emittedLock.Lock()
+	defer emittedLock.Unlock()
+	lastEmitted = &sinkOffset{number, hash}
+	emission.Number = hexutil.Uint64(number)
+	emission.Hash = hash
+}
+
+// storeLastEmitted records the last emitted block if it has changed since it
+// was last recorded. This is left to the state update writer, rather than
+// done as each block is emitted, so emission never waits on the database.
+func storeLastEmitted() {
+	emittedLock.Lock()
+	offset := lastEmitted
+	stored := offset == storedEmitted
+	emittedLock.Unlock()
+	if offset == nil || stored { return }
+	data, err := rlp.EncodeToBytes(offset)
+	if err != nil { return }
+	if err := backend.ChainDb().Put(emittedKey, data); err != nil {
+		log.Warn("Failed to record last emitted block", "number", offset.Number, "err", err)
+		return
+	}
+	emittedLock.Lock()
+	storedEmitted = offset
+	emittedLock.Unlock()
+}
+
+func recordGap(gap *emissionGap) {
+	emittedLock.Lock()
+	defer emittedLock.Unlock()
+	emission.GapsDetected++
+	emission.BlocksRepaired += gap.Repaired
+	emission.BlocksMissed += gap.Missed
+	emission.RecentGaps = append(emission.RecentGaps, *gap)
+	if len(emission.RecentGaps) > maxRecentGaps {
+		emission.RecentGaps = emission.RecentGaps[len(emission.RecentGaps) - maxRecentGaps:]
+	}
+}
+
+// missingAncestors returns the ancestors of a new head that have not been
+// emitted, oldest first, along with a description of the gap. Blocks at or
+// below the last emitted height are taken to have been emitted, or removed
+// by a reorg. Nothing is missing if nothing has ever been emitted.
+func missingAncestors(ctx context.Context, block *types.Block) ([]*types.Block, *emissionGap) {
+	emittedLock.Lock()
+	last := lastEmitted
+	emittedLock.Unlock()
+	if last == nil || block.NumberU64() <= last.Number + 1 { return nil, nil }
+	gap := &emissionGap{Detected: time.Now(), To: hexutil.Uint64(block.NumberU64() - 1)}
+	var missing []*types.Block
+	hash, number := block.ParentHash(), block.NumberU64() - 1
+	for number > last.Number && !recentEmits.Contains(hash) {
+		if len(missing) == maxCatchUp {
+			gap.Missed = hexutil.Uint64(number - last.Number)
+			break
+		}
+		blockRLP, err := backend.BlockByHash(ctx, hash)
+		if err != nil {
+			gap.Error = err.Error()
+			gap.Missed = hexutil.Uint64(number - last.Number)
+			break
+		}
+		parent := new(types.Block)
+		if err := rlp.DecodeBytes(blockRLP, parent); err != nil {
+			gap.Error = err.Error()
+			gap.Missed = hexutil.Uint64(number - last.Number)
+			break
+		}
+		missing = append(missing, parent)
+		hash, number = parent.ParentHash(), number - 1
+	}
+	if len(missing) == 0 && gap.Missed == 0 { return nil, nil }
+	gap.From = hexutil.Uint64(last.Number + 1)
+	if gap.Missed == 0 {
+		gap.From = hexutil.Uint64(number + 1)
+	}
+	gap.Repaired = hexutil.Uint64(len(missing))
+	for i, j := 0, len(missing) - 1; i < j; i, j = i + 1, j - 1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+	return missing, gap
+}
+
+// BlockUpdatesEmissionStatus reports the last block emitted to subscribers
+// and hooks, and any gaps in emission that were detected and repaired.
+func (b *BlockUpdates) BlockUpdatesEmissionStatus() emissionStatus {
+	emittedLock.Lock()
+	defer emittedLock.Unlock()
+	status := emission
+	status.RecentGaps = append([]emissionGap{}, emission.RecentGaps...)
+	return status
+}
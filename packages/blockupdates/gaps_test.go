@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+func TestMissingAncestors(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	oldLast, oldStored, oldEmission := lastEmitted, storedEmitted, emission
+	lastEmitted, storedEmitted, emission = nil, nil, emissionStatus{}
+	defer func() { lastEmitted, storedEmitted, emission = oldLast, oldStored, oldEmission }()
+	chain := []*types.Block{genesis}
+	for i := 1; i <= maxCatchUp + 10; i++ {
+		chain = append(chain, b.addBlock(chain[i-1], genesis.Root()))
+	}
+
+	// Nothing is missing before anything has been emitted
+	if missing, gap := missingAncestors(context.Background(), chain[5]); missing != nil || gap != nil {
+		t.Errorf("Unexpected gap before the first emission: %v", gap)
+	}
+
+	setLastEmitted(1, chain[1].Hash())
+	if ok, _ := b.db.Has(emittedKey); ok {
+		t.Errorf("Last emitted block stored as it was emitted")
+	}
+	storeLastEmitted()
+	if ok, _ := b.db.Has(emittedKey); !ok {
+		t.Errorf("Last emitted block not stored by the writer")
+	}
+	missing, gap := missingAncestors(context.Background(), chain[5])
+	if len(missing) != 3 || missing[0].Hash() != chain[2].Hash() || missing[2].Hash() != chain[4].Hash() {
+		t.Fatalf("Unexpected missing blocks %v", len(missing))
+	}
+	if gap.From != 2 || gap.To != 4 || gap.Repaired != 3 || gap.Missed != 0 {
+		t.Errorf("Unexpected gap %+v", gap)
+	}
+	recordGap(gap)
+	// Recently emitted blocks end the walk
+	recentEmits.Add(chain[3].Hash(), struct{}{})
+	if missing, _ := missingAncestors(context.Background(), chain[5]); len(missing) != 1 || missing[0].Hash() != chain[4].Hash() {
+		t.Errorf("Unexpected missing blocks after a recent emission %v", len(missing))
+	}
+
+	// Only the most recent maxCatchUp blocks are emitted, the rest are missed
+	head := chain[len(chain)-1]
+	missing, gap = missingAncestors(context.Background(), head)
+	if len(missing) != maxCatchUp || missing[0].Hash() != chain[10].Hash() || missing[len(missing)-1].Hash() != chain[len(chain)-2].Hash() {
+		t.Fatalf("Unexpected missing blocks %v", len(missing))
+	}
+	if gap.From != 2 || uint64(gap.To) != head.NumberU64() - 1 || gap.Repaired != maxCatchUp || gap.Missed != 8 || gap.Error != "" {
+		t.Errorf("Unexpected gap %+v", gap)
+	}
+	recordGap(gap)
+
+	// A parent that can't be found stops the walk
+	delete(b.blocks, chain[6].Hash())
+	missing, gap = missingAncestors(context.Background(), chain[9])
+	if len(missing) != 2 || missing[0].Hash() != chain[7].Hash() {
+		t.Fatalf("Unexpected missing blocks %v", len(missing))
+	}
+	if gap.From != 2 || gap.To != 8 || gap.Repaired != 2 || gap.Missed != 5 || gap.Error == "" {
+		t.Errorf("Unexpected gap %+v", gap)
+	}
+	recordGap(gap)
+
+	status := (&BlockUpdates{}).BlockUpdatesEmissionStatus()
+	if status.Number != 1 || status.Hash != chain[1].Hash() || status.GapsDetected != 3 || status.BlocksRepaired != 3 + maxCatchUp + 2 || status.BlocksMissed != 8 + 5 {
+		t.Errorf("Unexpected emission status %+v", status)
+	}
+	if len(status.RecentGaps) != 3 || status.RecentGaps[2].Error == "" {
+		t.Errorf("Unexpected recent gaps %v", status.RecentGaps)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit = 1000
+
+	// historyBackfillProgressInterval is how often, in blocks, the backfill
+	// records its progress.
+	historyBackfillProgressInterval = 1000
+)
+
+var (
+	// accountHistoryPrefix and storageHistoryPrefix index the blocks that
+	// changed an account or storage slot, keyed by account hash (and slot
+	// hash), then number and block hash, so an account's changes are
+	// contiguous and in block order.
+	accountHistoryPrefix = []byte("sha")
+	storageHistoryPrefix = []byte("shs")
+	historyBackfillKey = []byte("blockupdates-history-backfill")
+)
+
+func accountHistoryKey(account core.Hash, number uint64, hash core.Hash) []byte {
+	key := make([]byte, 0, len(accountHistoryPrefix) + 32 + 8 + 32)
+	key = append(append(key, accountHistoryPrefix...), account[:]...)
+	key = binary.BigEndian.AppendUint64(key, number)
+	return append(key, hash[:]...)
+}
+
+func storageHistoryKey(account, slot core.Hash, number uint64, hash core.Hash) []byte {
+	key := make([]byte, 0, len(storageHistoryPrefix) + 32 + 32 + 8 + 32)
+	key = append(append(append(key, storageHistoryPrefix...), account[:]...), slot[:]...)
+	key = binary.BigEndian.AppendUint64(key, number)
+	return append(key, hash[:]...)
+}
+
+// historyEntry is the value stored under a history key. The prior value
+// comes from the block's reverse diff, or the parent state when there is
+// none, and is unknown if neither was available when the entry was indexed.
+// Destructed marks account entries for blocks that destroyed the account.
+type historyEntry struct {
+	BeforeKnown bool
+	Before []byte
+	After []byte
+	Destructed bool `rlp:"optional"`
+}
+
+// parentState opens the state a block was applied to, or returns nil if it
+// is not available.
+func parentState(hash core.Hash) *stateReader {
+	headerBytes, err := backend.HeaderByHash(context.Background(), hash)
+	if err != nil { return nil }
+	header, err := decodeHeader(headerBytes)
+	if err != nil || header.Number.Uint64() == 0 { return nil }
+	parentBytes, err := backend.HeaderByHash(context.Background(), header.ParentHash)
+	if err != nil { return nil }
+	parent, err := decodeHeader(parentBytes)
+	if err != nil { return nil }
+	state, err := openState(parent.Root)
+	if err != nil { return nil }
+	return state
+}
+
+// priorValues returns the reverse diff of a block, or failing that the state
+// it was applied to if openParent is set, for indexStateUpdate to take prior
+// values from.
+func priorValues(number uint64, hash core.Hash, openParent bool) (*stateUpdate, *stateReader) {
+	if reverse, err := loadReverseDiff(number, hash); err == nil { return reverse, nil }
+	if !openParent { return nil, nil }
+	return nil, parentState(hash)
+}
+
+// indexStateUpdate adds the accounts and storage slots changed by a block to
+// the history index, taking prior values from reverse, or from the parent
+// state if reverse is nil. If both are nil, prior values are recorded as
+// unknown. If skipExisting is set, entries already in the index are left
+// alone, so a backfill never replaces known prior values.
+func indexStateUpdate(su *stateUpdate, reverse *stateUpdate, parent *stateReader, number uint64, hash core.Hash, skipExisting bool) error {
+	db := backend.ChainDb()
+	put := func(key []byte, before func() ([]byte, error), after []byte, destructed bool) error {
+		if skipExisting {
+			if ok, err := db.Has(key); err == nil && ok { return nil }
+		}
+		entry := historyEntry{After: after, Destructed: destructed}
+		if reverse != nil || parent != nil {
+			if value, err := before(); err == nil {
+				entry.BeforeKnown, entry.Before = true, value
+			}
+		}
+		data, err := rlp.EncodeToBytes(entry)
+		if err != nil { return err }
+		return db.Put(key, data)
+	}
+	accounts := make(map[core.Hash]struct{}, len(su.Accounts) + len(su.Destructs))
+	for account := range su.Destructs {
+		accounts[account] = struct{}{}
+	}
+	for account := range su.Accounts {
+		accounts[account] = struct{}{}
+	}
+	for account := range accounts {
+		account := account
+		before := func() ([]byte, error) {
+			if reverse != nil { return reverse.Accounts[account], nil }
+			return parent.SlimAccount(account)
+		}
+		_, destructed := su.Destructs[account]
+		if err := put(accountHistoryKey(account, number, hash), before, su.Accounts[account], destructed); err != nil { return err }
+	}
+	for account, slots := range su.Storage {
+		for slot, value := range slots {
+			account, slot := account, slot
+			before := func() ([]byte, error) {
+				if reverse != nil { return reverse.Storage[account][slot], nil }
+				return parent.Storage(account, slot)
+			}
+			if err := put(storageHistoryKey(account, slot, number, hash), before, value, false); err != nil { return err }
+		}
+	}
+	return nil
+}
+
+// deleteHistory removes the history entries indexed for a block's state
+// update.
+func deleteHistory(db restricted.Database, su *stateUpdate, number uint64, hash core.Hash) {
+	for account := range su.Destructs {
+		db.Delete(accountHistoryKey(account, number, hash))
+	}
+	for account := range su.Accounts {
+		db.Delete(accountHistoryKey(account, number, hash))
+	}
+	for account, slots := range su.Storage {
+		for slot := range slots {
+			db.Delete(storageHistoryKey(account, slot, number, hash))
+		}
+	}
+}
+
+// backfillHistory indexes the state updates stored before the history index
+// existed, from the oldest block up to the head at startup. Blocks after that
+// are indexed as they are written, and any skipped then are left for the
+// backfill on the next startup. Progress is persisted, so a restart picks up
+// where the backfill left off.
+func backfillHistory() {
+	db := backend.ChainDb()
+	var next uint64
+	if data, err := db.Get(historyBackfillKey); err == nil && len(data) == 8 {
+		next = binary.BigEndian.Uint64(data)
+	}
+	head, err := decodeHeader(backend.CurrentHeader())
+	if err != nil {
+		log.Error("Could not start history backfill", "err", err)
+		return
+	}
+	target := head.Number.Uint64()
+	if next > target { return }
+	log.Info("Backfilling state update history", "from", next, "to", target)
+	saveProgress := func(n uint64) {
+		if err := db.Put(historyBackfillKey, binary.BigEndian.AppendUint64(nil, n)); err != nil {
+			log.Warn("Failed to record history backfill progress", "err", err)
+		}
+	}
+	indexed := 0
+	// Old states are normally pruned, and failing to open one is expensive,
+	// so once one is missing we stop trying until we get near the head.
+	pruned := false
+	index := func(data []byte, number uint64, hash core.Hash) {
+		su := new(stateUpdate)
+		if err := rlp.DecodeBytes(data, su); err != nil { return }
+		recent := number + canonicalDepth >= target
+		reverse, parent := priorValues(number, hash, !pruned || recent)
+		if reverse == nil && parent == nil && !recent {
+			pruned = true
+		}
+		if err := indexStateUpdate(su, reverse, parent, number, hash, true); err != nil {
+			log.Warn("Failed to index state update history", "number", number, "hash", hash, "err", err)
+			return
+		}
+		if indexed++; indexed % historyBackfillProgressInterval == 0 {
+			saveProgress(number)
+		}
+	}
+	// Frozen state updates are older than any in leveldb, so they go first
+	if suFreezer != nil {
+		start := suFreezer.Tail()
+		if next > start {
+			start = next
+		}
+		for n := start; n < suFreezer.Head() && n <= target; n++ {
+			item, err := suFreezer.Retrieve(n)
+			if err != nil || len(item) < 32 { continue }
+			index(item[32:], n, core.BytesToHash(item[:32]))
+		}
+	}
+	it := db.NewIterator(suPrefix, binary.BigEndian.AppendUint64(nil, next))
+	for it.Next() {
+		number, hash, ok := parseSuKey(it.Key())
+		if !ok { continue }
+		if number > target { break }
+		index(it.Value(), number, hash)
+	}
+	it.Release()
+	saveProgress(target + 1)
+	log.Info("Finished backfilling state update history", "blocks", indexed)
+}
+
+// rewindHistoryBackfill moves the backfill back to block number, so the next
+// backfill indexes a block whose history was skipped. Until a backfill has
+// recorded progress, it starts from the oldest block anyway.
+func rewindHistoryBackfill(number uint64) {
+	db := backend.ChainDb()
+	data, err := db.Get(historyBackfillKey)
+	if err != nil || len(data) != 8 || binary.BigEndian.Uint64(data) <= number { return }
+	if err := db.Put(historyBackfillKey, binary.BigEndian.AppendUint64(nil, number)); err != nil {
+		log.Warn("Failed to record skipped state history", "number", number, "err", err)
+	}
+}
+
+// historyOptions selects a page of change history. Next in the result is the
+// fromBlock to pass for the following page.
+type historyOptions struct {
+	FromBlock restricted.BlockNumber `json:"fromBlock"`
+	ToBlock *restricted.BlockNumber `json:"toBlock"`
+	Limit int `json:"limit"`
+}
+
+// historyChange is a canonical block that changed an account or storage
+// slot. Before is null if the prior value is unknown.
+type historyChange struct {
+	BlockNumber hexutil.Uint64 `json:"blockNumber"`
+	BlockHash core.Hash `json:"blockHash"`
+	Before interface{} `json:"before"`
+	After interface{} `json:"after"`
+}
+
+type historyPage struct {
+	Changes []historyChange `json:"changes"`
+	Next *hexutil.Uint64 `json:"next,omitempty"`
+}
+
+func decodeHistoryAccount(data []byte) (interface{}, error) {
+	if len(data) == 0 { return decodedAccount{Deleted: true}, nil }
+	acct, err := fullAccountFromSlim(data)
+	if err != nil { return nil, err }
+	nonce := hexutil.Uint64(acct.Nonce)
+	codeHash := core.BytesToHash(acct.CodeHash)
+	return decodedAccount{Nonce: &nonce, Balance: (*hexutil.Big)(acct.Balance), StorageRoot: &acct.Root, CodeHash: &codeHash}, nil
+}
+
+func decodeHistorySlot(data []byte) (interface{}, error) {
+	if len(data) == 0 { return core.Hash{}, nil }
+	_, content, _, err := rlp.Split(data)
+	if err != nil { return nil, err }
+	return core.BytesToHash(content), nil
+}
+
+// changeHistory reads a page of canonical changes from the index under prefix.
+// If inferBefore is set, prior values that were unknown when indexed are
+// filled in from the previous change on the page. That does not hold for
+// storage, where destroying an account clears slots without indexing them.
+func changeHistory(ctx context.Context, b restricted.Backend, prefix []byte, opts *historyOptions, inferBefore bool, decode func([]byte) (interface{}, error)) (*historyPage, error) {
+	if opts == nil {
+		opts = &historyOptions{}
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultHistoryLimit
+	}
+	if opts.Limit > maxHistoryLimit {
+		opts.Limit = maxHistoryLimit
+	}
+	head, err := decodeHeader(b.CurrentHeader())
+	if err != nil { return nil, err }
+	to := head.Number.Uint64()
+	if opts.ToBlock != nil && opts.ToBlock.Int64() >= 0 && uint64(*opts.ToBlock) < to {
+		to = uint64(*opts.ToBlock)
+	}
+	if opts.FromBlock < 0 || uint64(opts.FromBlock) > to {
+		return nil, fmt.Errorf("invalid range %v - %v", opts.FromBlock.Int64(), to)
+	}
+	page := &historyPage{Changes: []historyChange{}}
+	it := b.ChainDb().NewIterator(prefix, binary.BigEndian.AppendUint64(nil, uint64(opts.FromBlock)))
+	defer it.Release()
+	var previous []byte
+	havePrevious := false
+	for it.Next() {
+		if err := ctx.Err(); err != nil { return nil, err }
+		key := it.Key()
+		if len(key) != len(prefix) + 40 || !bytes.HasPrefix(key, prefix) { continue }
+		number := binary.BigEndian.Uint64(key[len(prefix):])
+		hash := core.BytesToHash(key[len(prefix) + 8:])
+		if number > to { break }
+		if canonical, err := canonicalHash(number); err != nil || canonical != hash { continue }
+		if len(page.Changes) == opts.Limit {
+			next := hexutil.Uint64(number)
+			page.Next = &next
+			break
+		}
+		var entry historyEntry
+		if err := rlp.DecodeBytes(it.Value(), &entry); err != nil { return nil, err }
+		change := historyChange{BlockNumber: hexutil.Uint64(number), BlockHash: hash}
+		if !entry.BeforeKnown && inferBefore && havePrevious {
+			entry.BeforeKnown, entry.Before = true, previous
+		}
+		if entry.BeforeKnown {
+			if change.Before, err = decode(entry.Before); err != nil { return nil, err }
+		}
+		if change.After, err = decode(entry.After); err != nil { return nil, err }
+		page.Changes = append(page.Changes, change)
+		previous, havePrevious = entry.After, true
+	}
+	return page, nil
+}
+
+// AccountChangeHistory returns the canonical blocks that changed an account,
+// in block order, with the account before and after each change. Results are
+// paginated; pass Next as fromBlock to get the following page.
+func (b *BlockUpdates) AccountChangeHistory(ctx context.Context, address core.Address, opts *historyOptions) (*historyPage, error) {
+	account := crypto.Keccak256Hash(address[:])
+	prefix := append(append([]byte{}, accountHistoryPrefix...), account[:]...)
+	return changeHistory(ctx, b.backend, prefix, opts, true, decodeHistoryAccount)
+}
+
+// StorageChangeHistory returns the canonical blocks that wrote a storage slot,
+// in block order, with the value before and after each write. Slots cleared
+// by destroying their account are not listed; see AccountChangeHistory.
+func (b *BlockUpdates) StorageChangeHistory(ctx context.Context, address core.Address, slot core.Hash, opts *historyOptions) (*historyPage, error) {
+	account := crypto.Keccak256Hash(address[:])
+	slotHash := crypto.Keccak256Hash(slot[:])
+	prefix := append(append(append([]byte{}, storageHistoryPrefix...), account[:]...), slotHash[:]...)
+	return changeHistory(ctx, b.backend, prefix, opts, false, decodeHistorySlot)
+}
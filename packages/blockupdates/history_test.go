@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+)
+
+func TestHistoryKeys(t *testing.T) {
+	account := core.HexToHash("0x01")
+	slot := core.HexToHash("0x02")
+	if !bytes.HasPrefix(accountHistoryKey(account, 5, core.Hash{}), append(append([]byte{}, accountHistoryPrefix...), account[:]...)) {
+		t.Errorf("Account history keys should start with the account")
+	}
+	if bytes.Compare(accountHistoryKey(account, 255, core.HexToHash("0xff")), accountHistoryKey(account, 256, core.Hash{})) >= 0 {
+		t.Errorf("Account history keys should be ordered by block number")
+	}
+	if bytes.Compare(storageHistoryKey(account, slot, 255, core.HexToHash("0xff")), storageHistoryKey(account, slot, 256, core.Hash{})) >= 0 {
+		t.Errorf("Storage history keys should be ordered by block number")
+	}
+	if bytes.HasPrefix(storageHistoryKey(account, slot, 1, core.Hash{}), accountHistoryPrefix) {
+		t.Errorf("Storage history keys should not fall under the account history prefix")
+	}
+}
+
+func TestDecodeHistory(t *testing.T) {
+	acct, _ := rlp.EncodeToBytes(slimAccount{Nonce: 3, Balance: big.NewInt(10)})
+	decoded, err := decodeHistoryAccount(acct)
+	if err != nil {
+		t.Fatalf("Error decoding account: %v", err.Error())
+	}
+	if a := decoded.(decodedAccount); a.Deleted || uint64(*a.Nonce) != 3 || a.Balance.ToInt().Int64() != 10 {
+		t.Errorf("Unexpected account %v", a)
+	}
+	if decoded, _ := decodeHistoryAccount(nil); !decoded.(decodedAccount).Deleted {
+		t.Errorf("Empty account should decode as deleted")
+	}
+	value, _ := rlp.EncodeToBytes([]byte{0x12, 0x34})
+	if decoded, err := decodeHistorySlot(value); err != nil || decoded.(core.Hash) != core.HexToHash("0x1234") {
+		t.Errorf("Unexpected slot value %v: %v", decoded, err)
+	}
+}
+
+func TestHistoryEntryCompatibility(t *testing.T) {
+	old, _ := rlp.EncodeToBytes([]interface{}{true, []byte{1}, []byte{2}})
+	var entry historyEntry
+	if err := rlp.DecodeBytes(old, &entry); err != nil {
+		t.Fatalf("Error decoding entry without destructed flag: %v", err.Error())
+	}
+	if !entry.BeforeKnown || entry.Destructed || !bytes.Equal(entry.After, []byte{2}) {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+	number, hash, ok := parseReverseDiffKey(reverseDiffKey(1234, core.HexToHash("0xabcd")))
+	if !ok || number != 1234 || hash != core.HexToHash("0xabcd") {
+		t.Errorf("Unexpected reverse diff key round trip: %v %v %v", number, hash, ok)
+	}
+}
+
+func TestBackfillHistorySkipsPrunedState(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	account := core.HexToHash("0x01")
+	block := genesis
+	for i := int64(1); i <= 300; i++ {
+		block = b.addBlock(block, b.setState(map[core.Hash]*fullAccount{account: {Nonce: uint64(i), Balance: big.NewInt(i)}}, nil))
+		su, err := regenerateStateUpdate(block)
+		if err != nil {
+			t.Fatalf("Error regenerating state update: %v", err.Error())
+		}
+		data, _ := encodeStoredStateUpdate(su)
+		b.db.Put(suKey(block.NumberU64(), block.Hash()), data)
+	}
+	// Only the most recent states are available
+	for n := uint64(0); n <= 170; n++ {
+		delete(b.tries, b.blocks[b.canonical[n]].Root())
+	}
+	b.missingTries = 0
+	backfillHistory()
+	if b.missingTries > 1 {
+		t.Errorf("Expected pruned states to be skipped, tried %v", b.missingTries)
+	}
+	for n, known := range map[uint64]bool{10: false, 171: false, 172: true, 300: true} {
+		hash := b.canonical[n]
+		data, err := b.db.Get(accountHistoryKey(account, n, hash))
+		if err != nil {
+			t.Fatalf("Missing history for block %v", n)
+		}
+		var entry historyEntry
+		rlp.DecodeBytes(data, &entry)
+		if entry.BeforeKnown != known {
+			t.Errorf("Unexpected history entry for block %v: %v", n, entry)
+		}
+	}
+}
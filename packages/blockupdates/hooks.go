@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"sync"
+
+	"github.com/openrelayxyz/plugeth-plugins/packages/blockupdates/updates"
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+// legacyHook is the signature of the original BlockUpdates hook.
+type legacyHook = func(*types.Block, *big.Int, types.Receipts, map[core.Hash]struct{}, map[core.Hash][]byte, map[core.Hash]map[core.Hash][]byte, map[core.Hash][]byte)
+
+var (
+	hooksOnce sync.Once
+	legacyHooks []legacyHook
+	v2Hooks []updates.Hook
+)
+
+// loadHooks looks up the BlockUpdates and BlockUpdatesV2 hooks of other
+// plugins. Plugins are all loaded before the node starts, so this only needs
+// to happen once.
+func loadHooks() {
+	hooksOnce.Do(func() {
+		for _, fni := range pl.Lookup("BlockUpdates", func(item interface{}) bool {
+			_, ok := item.(legacyHook)
+			return ok
+		}) {
+			legacyHooks = append(legacyHooks, fni.(legacyHook))
+		}
+		for _, fni := range pl.Lookup("BlockUpdatesV2", func(item interface{}) bool {
+			_, ok := item.(updates.Hook)
+			return ok
+		}) {
+			v2Hooks = append(v2Hooks, fni.(updates.Hook))
+		}
+		log.Info("Loaded block updates hooks", "BlockUpdates", len(legacyHooks), "BlockUpdatesV2", len(v2Hooks))
+	})
+}
+
+// dispatchBlockUpdate invokes the hooks of other plugins for a block. The
+// original BlockUpdates hook has no way to represent removed blocks, so it
+// only receives blocks joining the canonical chain. A nil su means the state
+// changes are unavailable.
+func dispatchBlockUpdate(ctx context.Context, block *types.Block, td *big.Int, receipts types.Receipts, su *stateUpdate, removed bool, reorg *updates.Reorg) {
+	loadHooks()
+	if su == nil {
+		su = &stateUpdate{}
+	}
+	if !removed {
+		for _, fn := range legacyHooks {
+			fn(block, td, receipts, su.Destructs, su.Accounts, su.Storage, su.Code)
+		}
+	}
+	if len(v2Hooks) == 0 { return }
+	update := &updates.BlockUpdate{
+		Version: updates.Version,
+		Block: block,
+		TD: td,
+		Receipts: receipts,
+		Destructs: su.Destructs,
+		Accounts: su.Accounts,
+		Storage: su.Storage,
+		Code: su.Code,
+		Removed: removed,
+		Reorg: reorg,
+	}
+	for _, fn := range v2Hooks {
+		fn(ctx, update)
+	}
+}
+
+// dispatchRemovedBlock invokes the BlockUpdatesV2 hooks for a block removed by
+// a reorg, using the inverse state updates from its removed message.
+func dispatchRemovedBlock(ctx context.Context, msg map[string]interface{}, reorg *updates.Reorg) {
+	loadHooks()
+	if len(v2Hooks) == 0 { return }
+	hash, _ := msg["hash"].(core.Hash)
+	blockRLP, err := backend.BlockByHash(ctx, hash)
+	if err != nil {
+		log.Error("Could not get removed block", "hash", hash, "err", err)
+		return
+	}
+	var block types.Block
+	if err := rlp.DecodeBytes(blockRLP, &block); err != nil {
+		log.Error("Could not decode removed block", "hash", hash, "err", err)
+		return
+	}
+	var receipts types.Receipts
+	if receiptBytes, err := backend.GetReceipts(ctx, hash); err == nil {
+		json.Unmarshal(receiptBytes, &receipts)
+	}
+	su, _ := msg["stateUpdates"].(*stateUpdate)
+	dispatchBlockUpdate(ctx, &block, backend.GetTd(ctx, hash), receipts, su, true, reorg)
+}
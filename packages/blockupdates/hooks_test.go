@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-plugins/packages/blockupdates/updates"
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+// testLoader is a core.PluginLoader offering a fixed set of hooks, counting
+// how often each is looked up.
+type testLoader struct {
+	hooks map[string][]interface{}
+	lookups map[string]int
+}
+
+func (l *testLoader) Lookup(name string, validate func(interface{}) bool) []interface{} {
+	l.lookups[name]++
+	var result []interface{}
+	for _, item := range l.hooks[name] {
+		if validate(item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func (l *testLoader) GetFeed() core.Feed { return nil }
+
+func TestDispatchBlockUpdate(t *testing.T) {
+	_, genesis := newTestBackend(t)
+	var legacyCalls []*types.Block
+	var v2Calls []*updates.BlockUpdate
+	legacy := func(block *types.Block, td *big.Int, receipts types.Receipts, destructs map[core.Hash]struct{}, accounts map[core.Hash][]byte, storage map[core.Hash]map[core.Hash][]byte, code map[core.Hash][]byte) {
+		if td.Int64() != 7 || len(accounts) != 1 {
+			t.Errorf("Unexpected legacy hook arguments %v %v", td, accounts)
+		}
+		legacyCalls = append(legacyCalls, block)
+	}
+	v2 := func(ctx context.Context, update *updates.BlockUpdate) {
+		v2Calls = append(v2Calls, update)
+	}
+	loader := &testLoader{
+		hooks: map[string][]interface{}{
+			"BlockUpdates": {legacy, "not a hook"},
+			"BlockUpdatesV2": {v2, legacy},
+		},
+		lookups: make(map[string]int),
+	}
+	oldPl, oldLegacy, oldV2 := pl, legacyHooks, v2Hooks
+	pl, legacyHooks, v2Hooks, hooksOnce = loader, nil, nil, sync.Once{}
+	defer func() {
+		pl, legacyHooks, v2Hooks, hooksOnce = oldPl, oldLegacy, oldV2, sync.Once{}
+	}()
+
+	account := core.HexToHash("0x01")
+	su := &stateUpdate{Accounts: map[core.Hash][]byte{account: {0x01}}}
+	reorg := &updates.Reorg{Common: genesis.Hash()}
+	dispatchBlockUpdate(context.Background(), genesis, big.NewInt(7), nil, su, false, nil)
+	// Removed blocks only go to BlockUpdatesV2 hooks
+	dispatchBlockUpdate(context.Background(), genesis, big.NewInt(7), nil, su, true, reorg)
+
+	if len(legacyCalls) != 1 || legacyCalls[0] != genesis {
+		t.Errorf("Expected one legacy hook call, got %v", len(legacyCalls))
+	}
+	if len(v2Calls) != 2 {
+		t.Fatalf("Expected two BlockUpdatesV2 hook calls, got %v", len(v2Calls))
+	}
+	for i, update := range v2Calls {
+		if update.Version != updates.Version || update.Block != genesis || update.TD.Int64() != 7 || len(update.Accounts[account]) != 1 {
+			t.Errorf("Unexpected update %v: %+v", i, update)
+		}
+		if removed := i == 1; update.Removed != removed || (update.Reorg == reorg) != removed {
+			t.Errorf("Unexpected removal fields for update %v: %v %v", i, update.Removed, update.Reorg)
+		}
+	}
+	if loader.lookups["BlockUpdates"] != 1 || loader.lookups["BlockUpdatesV2"] != 1 {
+		t.Errorf("Expected hooks to be looked up once, got %v", loader.lookups)
+	}
+}
@@ -2,19 +2,24 @@ package main
 
 import (
 	"strings"
-	"bytes"
 	"fmt"
 	"context"
 	"time"
 	"encoding/json"
 	"math/big"
+	"bytes"
+	"sort"
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/openrelayxyz/plugeth-plugins/packages/blockupdates/updates"
 	"github.com/openrelayxyz/plugeth-utils/core"
 	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
 	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
 	"github.com/openrelayxyz/plugeth-utils/restricted/types"
 	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
 	"io"
+	"os"
+	"path/filepath"
 )
 
 
@@ -23,11 +28,16 @@ var (
 	backend restricted.Backend
 	lastBlock core.Hash
 	cache *lru.Cache
+	pending *lru.Cache
 	recentEmits *lru.Cache
 	snapshotFlagName = "snapshot"
 	log core.Logger
 	blockEvents core.Feed
-	suCh chan *stateUpdateWithRoot
+	suCh chan *stateUpdateWithBlock
+	ancientCh chan *ancientBlock
+	ancientReady chan struct{}
+	suFreezer *freezer
+	spillDir string
 )
 
 
@@ -39,9 +49,16 @@ type stateUpdate struct {
 	Code map[core.Hash][]byte
 }
 
-type stateUpdateWithRoot struct {
+type stateUpdateWithBlock struct {
 	su *stateUpdate
-	root core.Hash
+	number uint64
+	hash core.Hash
+}
+
+
+type ancientBlock struct {
+	number uint64
+	hash core.Hash
 }
 
 
@@ -66,14 +83,29 @@ type storedStateUpdate struct {
 }
 
 
-// MarshalJSON represents the stateUpdate as JSON for RPC calls
-func (su *stateUpdate) MarshalJSON() ([]byte, error) {
-	result := make(map[string]interface{})
+func sortHashes(hashes []core.Hash) {
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+}
+
+func sortKVPairs(pairs []kvpair) {
+	sort.Slice(pairs, func(i, j int) bool { return bytes.Compare(pairs[i].Key[:], pairs[j].Key[:]) < 0 })
+}
+
+func (su *stateUpdate) sortedDestructs() []core.Hash {
 	destructs := make([]core.Hash, 0, len(su.Destructs))
 	for k := range su.Destructs {
 		destructs = append(destructs, k)
 	}
-	result["destructs"] = destructs
+	sortHashes(destructs)
+	return destructs
+}
+
+// MarshalJSON represents the stateUpdate as JSON for RPC calls. Map keys are
+// sorted by encoding/json, and destructs are sorted here, so equal state
+// updates always produce the same JSON.
+func (su *stateUpdate) MarshalJSON() ([]byte, error) {
+	result := make(map[string]interface{})
+	result["destructs"] = su.sortedDestructs()
 	accounts := make(map[string]hexutil.Bytes)
 	for k, v := range su.Accounts {
 		accounts[k.String()] = hexutil.Bytes(v)
@@ -95,35 +127,105 @@ func (su *stateUpdate) MarshalJSON() ([]byte, error) {
 	return json.Marshal(result)
 }
 
-// EncodeRLP converts the stateUpdate to a storedStateUpdate, and RLP encodes the result for storage
-func (su *stateUpdate) EncodeRLP(w io.Writer) error {
-	destructs := make([]core.Hash, 0, len(su.Destructs))
-	for k := range su.Destructs {
-		destructs = append(destructs, k)
+// UnmarshalJSON parses the representation produced by MarshalJSON
+func (su *stateUpdate) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Destructs []core.Hash `json:"destructs"`
+		Accounts map[string]hexutil.Bytes `json:"accounts"`
+		Storage map[string]map[string]hexutil.Bytes `json:"storage"`
+		Code map[string]hexutil.Bytes `json:"code"`
 	}
+	if err := json.Unmarshal(data, &raw); err != nil { return err }
+	su.Destructs = make(map[core.Hash]struct{})
+	for _, k := range raw.Destructs {
+		su.Destructs[k] = struct{}{}
+	}
+	su.Accounts = make(map[core.Hash][]byte)
+	for k, v := range raw.Accounts {
+		su.Accounts[core.HexToHash(k)] = v
+	}
+	su.Storage = make(map[core.Hash]map[core.Hash][]byte)
+	for m, s := range raw.Storage {
+		account := core.HexToHash(m)
+		su.Storage[account] = make(map[core.Hash][]byte)
+		for k, v := range s {
+			su.Storage[account][core.HexToHash(k)] = v
+		}
+	}
+	su.Code = make(map[core.Hash][]byte)
+	for k, v := range raw.Code {
+		su.Code[core.HexToHash(k)] = v
+	}
+	return nil
+}
+
+// stored converts the stateUpdate to a storedStateUpdate. Every list is
+// sorted by key, so equal state updates always convert to the same lists.
+func (su *stateUpdate) stored() storedStateUpdate {
 	accounts := make([]kvpair, 0, len(su.Accounts))
 	for k, v := range su.Accounts {
 		accounts = append(accounts, kvpair{k, v})
 	}
+	sortKVPairs(accounts)
 	s := make([]storage, 0, len(su.Storage))
 	for a, m := range su.Storage {
 		accountStorage := storage{a, make([]kvpair, 0, len(m))}
 		for k, v := range m {
 			accountStorage.Data = append(accountStorage.Data, kvpair{k, v})
 		}
+		sortKVPairs(accountStorage.Data)
 		s = append(s, accountStorage)
 	}
+	sort.Slice(s, func(i, j int) bool { return bytes.Compare(s[i].Account[:], s[j].Account[:]) < 0 })
 	code := make([]kvpair, 0, len(su.Code))
 	for k, v := range su.Code {
 		code = append(code, kvpair{k, v})
 	}
-	return rlp.Encode(w, storedStateUpdate{destructs, accounts, s, code})
+	sortKVPairs(code)
+	return storedStateUpdate{su.sortedDestructs(), accounts, s, code}
+}
+
+// EncodeRLP RLP encodes the stateUpdate in its canonical, uncompressed form,
+// which is what Hash commits to. Records in the database use the compressed
+// format written by encodeStoredStateUpdate instead.
+func (su *stateUpdate) EncodeRLP(w io.Writer) error {
+	return rlp.Encode(w, su.stored())
+}
+
+// Hash commits to the contents of the stateUpdate. It is the keccak256 hash of
+// the canonical RLP encoding, so two nodes that produced the same state
+// changes for a block will report the same hash.
+func (su *stateUpdate) Hash() (core.Hash, error) {
+	data, err := rlp.EncodeToBytes(su)
+	if err != nil { return core.Hash{}, err }
+	return crypto.Keccak256Hash(data), nil
 }
 
-// DecodeRLP takes a byte stream, decodes it to a storedStateUpdate, the n converts that into a stateUpdate object
+// setStateUpdates adds a state update and its hash to a block updates message.
+func setStateUpdates(msg map[string]interface{}, su *stateUpdate) error {
+	hash, err := su.Hash()
+	if err != nil { return err }
+	msg["stateUpdates"] = su
+	msg["stateUpdatesHash"] = hash
+	return nil
+}
+
+// DecodeRLP takes a byte stream and decodes it to a stateUpdate. Both the
+// canonical encoding and versioned records from the database are accepted.
 func (su *stateUpdate) DecodeRLP(s *rlp.Stream) error {
+	raw, err := s.Raw()
+	if err != nil { return err }
+	if isVersionedRecord(raw) {
+		return su.decodeVersioned(raw)
+	}
 	ssu := storedStateUpdate{}
-	if err := s.Decode(&ssu); err != nil { return err }
+	if err := rlp.DecodeBytes(raw, &ssu); err != nil { return err }
+	su.fromStored(ssu)
+	return nil
+}
+
+// fromStored fills in the stateUpdate from a storedStateUpdate.
+func (su *stateUpdate) fromStored(ssu storedStateUpdate) {
 	su.Destructs = make(map[core.Hash]struct{})
 	for _, s := range ssu.Destructs {
 		su.Destructs[s] = struct{}{}
@@ -143,7 +245,6 @@ func (su *stateUpdate) DecodeRLP(s *rlp.Stream) error {
 	for _, kv := range ssu.Code {
 		su.Code[kv.Key] = kv.Value
 	}
-	return nil
 }
 
 var (
@@ -157,8 +258,12 @@ func Initialize(ctx core.Context, loader core.PluginLoader, logger core.Logger)
 	pl = loader
 	blockEvents = pl.GetFeed()
 	cache, _ = lru.New(128)
+	pending, _ = lru.New(128)
 	recentEmits, _ = lru.New(128)
-	suCh = make(chan *stateUpdateWithRoot, 128)
+	suCh = make(chan *stateUpdateWithBlock, 128)
+	indexCh = make(chan *stateUpdateWithBlock, 1024)
+	ancientCh = make(chan *ancientBlock, 1024)
+	ancientReady = make(chan struct{})
 	if !ctx.Bool(snapshotFlagName) {
 		log.Warn("Snapshots are required for StateUpdate plugins, but are currently disabled. State Updates will be unavailable")
 	}
@@ -175,18 +280,54 @@ func Initialize(ctx core.Context, loader core.PluginLoader, logger core.Logger)
 		ctx.Set(wsApiFlagName, v+",plugeth")
 	}
 	log.Info("Loaded block updater plugin")
-	go func () {
-		for su := range suCh {
-			data, err := rlp.EncodeToBytes(su.su)
-			if err != nil {
-				log.Error("Failed to encode state update", "root", su.root, "err", err)
+	go writeStateUpdates()
+	go indexStateUpdates()
+	go freezeAncients()
+	go func() {
+		// Wait for the backend before migrating anything, but don't block the
+		// creation of the backend.
+		for backend == nil {
+			time.Sleep(250 * time.Millisecond)
+		}
+		if err := migrateStateUpdates(); err != nil {
+			log.Error("Failed to migrate stored state updates", "err", err)
+		}
+		close(ancientReady)
+		loadAttribution()
+		loadLastEmitted()
+		go loadIndexedRange()
+		go runCollector()
+		go checkStateUpdates()
+		go backfillHistory()
+		startSinks()
+	}()
+}
+
+// freezeAncients freezes the blocks AppendAncient reports. Until the stored
+// state updates have been migrated to their current keys the blocks are only
+// queued, so that geth's freezer never waits on our startup.
+func freezeAncients() {
+	var queued []*ancientBlock
+	ch := ancientCh
+	for {
+		select {
+		case a, ok := <-ch:
+			if ok {
+				queued = append(queued, a)
+			} else {
+				// Nothing more will arrive, just wait for the migration
+				ch = nil
+			}
+		case <-ancientReady:
+			for _, a := range queued {
+				freezeStateUpdate(a)
 			}
-			if err := backend.ChainDb().Put(append([]byte("su"), su.root.Bytes()...), data); err != nil {
-				log.Error("Failed to store state update", "root", su.root, "err", err)
+			for a := range ancientCh {
+				freezeStateUpdate(a)
 			}
-			log.Debug("Stored state update", "root", su.root)
+			return
 		}
-	}()
+	}
 }
 
 
@@ -194,13 +335,24 @@ func Initialize(ctx core.Context, loader core.PluginLoader, logger core.Logger)
 // ready. We will track the backend to provide access to blocks and other
 // useful information.
 func InitializeNode(stack core.Node, b restricted.Backend) {
+	dataDir := stack.ResolvePath("blockupdates")
+	spillDir = filepath.Join(dataDir, "spill")
+	os.RemoveAll(spillDir)
+	var err error
+	suFreezer, err = openFreezer(dataDir, "stateupdates")
+	if err != nil {
+		log.Error("Failed to open state update freezer, ancient state updates will be discarded", "err", err)
+		suFreezer = nil
+	}
 	backend = b
 	log.Info("Initialized node block updater plugin")
 }
 
 
 // StateUpdate gives us updates about state changes made in each block. We
-// cache them for short term use, and write them to disk for the longer term.
+// hold them until NewHead or NewSideBlock tells us which block they belong to,
+// at which point they are cached for short term use and written to disk for
+// the longer term.
 func StateUpdate(blockRoot core.Hash, parentRoot core.Hash, destructs map[core.Hash]struct{}, accounts map[core.Hash][]byte, storage map[core.Hash]map[core.Hash][]byte, codeUpdates map[core.Hash][]byte) {
 	if backend == nil {
 		log.Warn("State update called before InitializeNode", "root", blockRoot)
@@ -212,36 +364,69 @@ func StateUpdate(blockRoot core.Hash, parentRoot core.Hash, destructs map[core.H
 		Storage: storage,
 		Code: codeUpdates,
 	}
-	cache.Add(blockRoot, su)
-	suCh <- &stateUpdateWithRoot{su: su, root: blockRoot}
+	pending.Add(rootPair{blockRoot, parentRoot}, su)
 }
 
-// AppendAncient removes our state update records from leveldb as the
-// corresponding blocks are moved from leveldb to the ancients database. At
-// some point in the future, we may want to look at a way to move the state
-// updates to an ancients table of their own for longer term retention.
+// AppendAncient moves our state update records from leveldb to the state
+// update freezer as the corresponding blocks are moved from leveldb to the
+// ancients database.
 func AppendAncient(number uint64, hash, headerBytes, body, receipts, td []byte) {
-	header := new(types.Header)
-	if err := rlp.Decode(bytes.NewReader(headerBytes), header); err != nil {
-		log.Warn("Could not decode ancient header", "block", number)
+	ancientCh <- &ancientBlock{number: number, hash: core.BytesToHash(hash)}
+}
+
+// freezeStateUpdate appends the state update for a block to the freezer and
+// removes it from leveldb. Freezer items are the block hash followed by the
+// RLP encoded state update, with an empty item marking a block for which no
+// state update was available.
+func freezeStateUpdate(a *ancientBlock) {
+	key := suKey(a.number, a.hash)
+	if suFreezer == nil {
+		backend.ChainDb().Delete(key)
 		return
 	}
-	go func() {
-		// Background this so we can clean up once the backend is set, but we don't
-		// block the creation of the backend.
-		for backend == nil {
-			time.Sleep(250 * time.Millisecond)
+	if a.number < suFreezer.Head() {
+		// The ancients are being rewritten, discard what we had from here on.
+		if err := suFreezer.TruncateHead(a.number); err != nil {
+			log.Error("Failed to truncate state update freezer", "block", a.number, "err", err)
+			return
 		}
-		backend.ChainDb().Delete(append([]byte("su"), header.Root.Bytes()...))
-	}()
+	}
+	if suFreezer.Items() > 0 {
+		for n := suFreezer.Head(); n < a.number; n++ {
+			if err := suFreezer.Append(n, []byte{}); err != nil {
+				log.Error("Failed to fill state update freezer gap", "block", n, "err", err)
+				return
+			}
+		}
+	}
+	item := []byte{}
+	if data, err := backend.ChainDb().Get(key); err == nil {
+		item = append(a.hash.Bytes(), data...)
+	} else {
+		log.Debug("No state update available to freeze", "block", a.number, "hash", a.hash)
+	}
+	if err := suFreezer.Append(a.number, item); err != nil {
+		log.Error("Failed to freeze state update", "block", a.number, "err", err)
+		return
+	}
+	backend.ChainDb().Delete(key)
+}
 
+// frozenStateUpdate retrieves the RLP encoded state update for a block from the
+// freezer, provided the frozen record belongs to the given block hash.
+func frozenStateUpdate(number uint64, hash core.Hash) ([]byte, error) {
+	if suFreezer == nil { return nil, errOutOfBounds }
+	item, err := suFreezer.Retrieve(number)
+	if err != nil { return nil, err }
+	if len(item) < len(hash) || core.BytesToHash(item[:len(hash)]) != hash {
+		return nil, fmt.Errorf("no frozen state update for block %#x", hash)
+	}
+	return item[len(hash):], nil
 }
 
 // NewHead is invoked when a new block becomes the latest recognized block. We
 // use this to notify the blockEvents channel of new blocks, as well as invoke
 // the BlockUpdates hook on downstream plugins.
-// TODO: We're not necessarily handling reorgs properly, which may result in
-// some blocks not being emitted through this hook.
 func NewHead(blockBytes []byte, hash core.Hash, logsBytes [][]byte, td *big.Int) {
 	if pl == nil {
 		log.Warn("Attempting to emit NewHead, but default PluginLoader has not been initialized")
@@ -252,49 +437,60 @@ func NewHead(blockBytes []byte, hash core.Hash, logsBytes [][]byte, td *big.Int)
 		log.Error("Failed to decode block", "hash", hash, "err", err)
 		return
 	}
-	newHead(block, hash, td)
+	newHead(block, hash, td, nil)
+}
+
+// NewSideBlock is invoked when a block is written to the database without
+// becoming the new head. We still need to record its state update, as the
+// block may become canonical in a later reorg.
+func NewSideBlock(blockBytes []byte, hash core.Hash, logsBytes [][]byte) {
+	if backend == nil { return }
+	var block types.Block
+	if err := rlp.DecodeBytes(blockBytes, &block); err != nil {
+		log.Error("Failed to decode side block", "hash", hash, "err", err)
+		return
+	}
+	resolveStateUpdate(&block)
 }
-func newHead(block types.Block, hash core.Hash, td *big.Int) {
+
+// newHead emits a block, first emitting any of its ancestors that were
+// missed, such as blocks imported while the node was down or blocks that
+// could not be serialized when they arrived.
+func newHead(block types.Block, hash core.Hash, td *big.Int, reorg *updates.Reorg) {
 	if recentEmits.Contains(hash) {
 		log.Debug("Skipping recently emitted block")
 		return
 	}
-	result, err := blockUpdates(context.Background(), &block)
+	missing, gap := missingAncestors(context.Background(), &block)
+	if gap != nil {
+		log.Warn("Emitting missed blocks", "from", uint64(gap.From), "to", uint64(gap.To), "repairing", len(missing), "missed", uint64(gap.Missed), "err", gap.Error)
+		recordGap(gap)
+	}
+	for _, ancestor := range missing {
+		emitBlock(ancestor, ancestor.Hash(), backend.GetTd(context.Background(), ancestor.Hash()), reorg)
+	}
+	emitBlock(&block, hash, td, reorg)
+}
+
+func emitBlock(block *types.Block, hash core.Hash, td *big.Int, reorg *updates.Reorg) {
+	resolveStateUpdate(block)
+	result, err := blockUpdates(context.Background(), block)
 	if err != nil {
-		log.Error("Could not serialize block", "err", err, "hash", block.Hash())
+		log.Error("Could not serialize block", "err", err, "hash", hash)
 		return
 	}
-	if recentEmits.Len() > 10 && !recentEmits.Contains(block.ParentHash()) {
-		blockRLP, err := backend.BlockByHash(context.Background(), block.ParentHash())
-		if err != nil {
-			log.Error("Could not get block for reorg", "hash", block.ParentHash(), "err", err)
-			return
-		}
-		var parentBlock types.Block
-		if err := rlp.DecodeBytes(blockRLP, &parentBlock); err != nil {
-			log.Error("Could not decode block during reorg", "hash", block.ParentHash(), "err", err)
-			return
-		}
-		td := backend.GetTd(context.Background(), parentBlock.Hash())
-		newHead(parentBlock, block.Hash(), td)
-	}
 	blockEvents.Send(result)
 
 	receipts := result["receipts"].(types.Receipts)
 	su := result["stateUpdates"].(*stateUpdate)
-	fnList := pl.Lookup("BlockUpdates", func(item interface{}) bool {
-		_, ok := item.(func(*types.Block, *big.Int, types.Receipts, map[core.Hash]struct{}, map[core.Hash][]byte, map[core.Hash]map[core.Hash][]byte, map[core.Hash][]byte))
-		log.Info("Found BlockUpdates hook", "matches", ok)
-		return ok
-	})
-	for _, fni := range fnList {
-		if fn, ok := fni.(func(*types.Block, *big.Int, types.Receipts, map[core.Hash]struct{}, map[core.Hash][]byte, map[core.Hash]map[core.Hash][]byte, map[core.Hash][]byte)); ok {
-			fn(&block, td, receipts, su.Destructs, su.Accounts, su.Storage, su.Code)
-		}
-	}
+	dispatchBlockUpdate(context.Background(), block, td, receipts, su, false, reorg)
 	recentEmits.Add(hash, struct{}{})
+	setLastEmitted(block.NumberU64(), hash)
 }
 
+// Reorg is invoked when blocks are removed from the canonical chain. Before
+// emitting the blocks of the new chain, we notify subscribers of each removed
+// block, starting from the old head, so they can roll back its changes.
 func Reorg(common core.Hash, oldChain []core.Hash, newChain []core.Hash) {
 	fnList := pl.Lookup("BUPreReorg", func(item interface{}) bool {
 		_, ok := item.(func(core.Hash, []core.Hash, []core.Hash))
@@ -305,6 +501,23 @@ func Reorg(common core.Hash, oldChain []core.Hash, newChain []core.Hash) {
 			fn(common, oldChain, newChain)
 		}
 	}
+	reorg := &updates.Reorg{Common: common, OldChain: oldChain, NewChain: newChain}
+	for _, blockHash := range oldChain {
+		result, err := removedBlockUpdates(context.Background(), blockHash)
+		if err != nil {
+			log.Error("Could not serialize removed block", "hash", blockHash, "err", err)
+			continue
+		}
+		blockEvents.Send(result)
+		dispatchRemovedBlock(context.Background(), result, reorg)
+		// If the block comes back in a later reorg it must be emitted again
+		recentEmits.Remove(blockHash)
+		if parent, ok := result["parentHash"].(core.Hash); ok {
+			if number, ok := messageNumber(result); ok && number > 0 {
+				setLastEmitted(number - 1, parent)
+			}
+		}
+	}
 	for i := len(newChain) - 1; i >= 0; i-- {
 		blockHash := newChain[i]
 		blockRLP, err := backend.BlockByHash(context.Background(), blockHash)
@@ -318,7 +531,7 @@ func Reorg(common core.Hash, oldChain []core.Hash, newChain []core.Hash) {
 			return
 		}
 		td := backend.GetTd(context.Background(), blockHash)
-		newHead(block, blockHash, td)
+		newHead(block, blockHash, td, reorg)
 	}
 	fnList = pl.Lookup("BUPostReorg", func(item interface{}) bool {
 		_, ok := item.(func(core.Hash, []core.Hash, []core.Hash))
@@ -332,6 +545,50 @@ func Reorg(common core.Hash, oldChain []core.Hash, newChain []core.Hash) {
 }
 
 
+// removedBlockUpdates builds the message sent to subscribers when a block is
+// dropped from the canonical chain. Its stateUpdates are the inverse of the
+// block's own state updates, restoring the values from its parent's state,
+// taken from the stored reverse diff when there is one. If the inverse cannot
+// be computed, the message is sent without them so subscribers still learn
+// which block was removed.
+func removedBlockUpdates(ctx context.Context, hash core.Hash) (map[string]interface{}, error) {
+	blockRLP, err := backend.BlockByHash(ctx, hash)
+	if err != nil { return nil, err }
+	var block types.Block
+	if err := rlp.DecodeBytes(blockRLP, &block); err != nil { return nil, err }
+	result := map[string]interface{}{
+		"removed": true,
+		"hash": block.Hash(),
+		"number": (*hexutil.Big)(block.Number()),
+		"parentHash": block.ParentHash(),
+	}
+	if reverse, err := loadReverseDiff(block.NumberU64(), hash); err == nil {
+		if err := setStateUpdates(result, reverse); err != nil {
+			log.Warn("Could not hash inverse state updates for removed block", "hash", hash, "err", err)
+		}
+		return result, nil
+	}
+	su, err := loadStateUpdate(&block)
+	if err != nil {
+		log.Warn("Removed block has no state updates to revert", "hash", hash, "err", err)
+		return result, nil
+	}
+	parentBytes, err := backend.HeaderByHash(ctx, block.ParentHash())
+	if err != nil { return nil, err }
+	parent, err := decodeHeader(parentBytes)
+	if err != nil { return nil, err }
+	inverse, err := invertStateUpdate(su, parent.Root)
+	if err != nil {
+		log.Warn("Could not invert state updates for removed block", "hash", hash, "err", err)
+		return result, nil
+	}
+	if err := setStateUpdates(result, inverse); err != nil {
+		log.Warn("Could not hash inverse state updates for removed block", "hash", hash, "err", err)
+	}
+	return result, nil
+}
+
+
 // BlockUpdates is a service that lets clients query for block updates for a
 // given block by hash or number, or subscribe to new block upates.
 type BlockUpdates struct{
@@ -352,15 +609,8 @@ func BlockUpdatesByNumber(number int64) (*types.Block, *big.Int, types.Receipts,
 	if err := json.Unmarshal(receiptBytes, &receipts); err != nil {
 		return nil, nil, nil, nil, nil, nil, nil, err
 	}
-	var su *stateUpdate
-	if v, ok := cache.Get(block.Root()); ok {
-		su = v.(*stateUpdate)
-	} else {
-		su = new(stateUpdate)
-		data, err := backend.ChainDb().Get(append([]byte("su"), block.Root().Bytes()...))
-		if err != nil { return &block, td, receipts, nil, nil, nil, nil, fmt.Errorf("State Updates unavailable for block %v", block.Hash())}
-		if err := rlp.DecodeBytes(data, su); err != nil { return &block, td, receipts, nil, nil, nil, nil, fmt.Errorf("State updates unavailable for block %#x", block.Hash()) }
-	}
+	su, err := loadStateUpdate(&block)
+	if err != nil { return &block, td, receipts, nil, nil, nil, nil, err }
 	return &block, td, receipts, su.Destructs, su.Accounts, su.Storage, su.Code, nil
 }
 
@@ -373,62 +623,74 @@ func blockUpdates(ctx context.Context, block *types.Block) (map[string]interface
 	var receipts types.Receipts
 	if err := json.Unmarshal(receiptBytes, &receipts); err != nil { return nil, err }
 	result["receipts"] = receipts
-	if v, ok := cache.Get(block.Root()); ok {
-		result["stateUpdates"] = v
-		return result, nil
+	su, err := loadStateUpdate(block)
+	if err != nil { return nil, err }
+	if err := setStateUpdates(result, su); err != nil { return nil, err }
+	return result, nil
+}
+
+// loadStateUpdate retrieves the state update for a block from the cache,
+// leveldb, or the state update freezer, in that order. It never writes:
+// state updates are resolved as blocks arrive, and missing ones are only
+// regenerated by checkStateUpdates or BlockUpdatesAdmin.RegenerateStateUpdates,
+// as regenerating is far too expensive to do on every miss.
+func loadStateUpdate(block *types.Block) (*stateUpdate, error) {
+	if v, ok := cache.Get(block.Hash()); ok {
+		return v.(*stateUpdate), nil
+	}
+	su, err := readStateUpdate(block.NumberU64(), block.Hash())
+	if err == errStateUpdateMissing { return nil, fmt.Errorf("State Updates unavailable for block %v", block.Hash()) }
+	if err != nil { return nil, fmt.Errorf("State updates unavailable for block %#x", block.Hash()) }
+	cache.Add(block.Hash(), su)
+	return su, nil
+}
+
+// readStateUpdate reads the stored state update for a block from leveldb or
+// the state update freezer, bypassing the cache.
+func readStateUpdate(number uint64, hash core.Hash) (*stateUpdate, error) {
+	data, err := backend.ChainDb().Get(suKey(number, hash))
+	if err != nil {
+		data, err = frozenStateUpdate(number, hash)
 	}
-	data, err := backend.ChainDb().Get(append([]byte("su"), block.Root().Bytes()...))
-	if err != nil { return nil, fmt.Errorf("State Updates unavailable for block %v", block.Hash())}
+	if err != nil { return nil, errStateUpdateMissing }
 	su := &stateUpdate{}
-	if err := rlp.DecodeBytes(data, su); err != nil { return nil, fmt.Errorf("State updates unavailable for block %#x", block.Hash()) }
-	result["stateUpdates"] = su
-	cache.Add(block.Root(), su)
-	return result, nil
+	if err := rlp.DecodeBytes(data, su); err != nil { return nil, err }
+	return su, nil
 }
 
 // BlockUpdatesByNumber retrieves a block by number, gets receipts and state
-// updates, and serializes the response.
-func (b *BlockUpdates) BlockUpdatesByNumber(ctx context.Context, number restricted.BlockNumber) (map[string]interface{}, error) {
+// updates, and serializes the response, trimmed by the optional filter and
+// decoded if requested.
+func (b *BlockUpdates) BlockUpdatesByNumber(ctx context.Context, number restricted.BlockNumber, filter *blockUpdatesFilter, view *viewOptions) (map[string]interface{}, error) {
 	blockBytes, err := b.backend.BlockByNumber(ctx, int64(number))
 	if err != nil { return nil, err }
 	var block types.Block
 	if err := rlp.DecodeBytes(blockBytes, &block); err != nil { return nil, err }
-	return blockUpdates(ctx, &block)
+	return filteredBlockUpdates(ctx, &block, filter, view)
 }
 
 // BlockUpdatesByHash retrieves a block by hash, gets receipts and state
-// updates, and serializes the response.
-func (b *BlockUpdates) BlockUpdatesByHash(ctx context.Context, hash core.Hash) (map[string]interface{}, error) {
+// updates, and serializes the response, trimmed by the optional filter and
+// decoded if requested.
+func (b *BlockUpdates) BlockUpdatesByHash(ctx context.Context, hash core.Hash, filter *blockUpdatesFilter, view *viewOptions) (map[string]interface{}, error) {
 	blockBytes, err := b.backend.BlockByHash(ctx, hash)
 	if err != nil { return nil, err }
 	var block types.Block
 	if err := rlp.DecodeBytes(blockBytes, &block); err != nil { return nil, err }
-	return blockUpdates(ctx, &block)
+	return filteredBlockUpdates(ctx, &block, filter, view)
 }
 
-
-// BlockUpdates allows clients to subscribe to notifications of new blocks
-// along with receipts and state updates.
-func (b *BlockUpdates) BlockUpdates(ctx context.Context) (<-chan map[string]interface{}, error) {
-	blockDataChan := make(chan map[string]interface{}, 1000)
-	ch := make(chan map[string]interface{}, 1000)
-	sub := blockEvents.Subscribe(blockDataChan)
-	go func() {
-		log.Info("BlockUpdates subscription setup")
-		defer log.Info("BlockUpdates subscription closed")
-		for {
-			select {
-			case <-ctx.Done():
-				sub.Unsubscribe()
-				close(ch)
-				close(blockDataChan)
-				return
-			case b := <-blockDataChan:
-				ch <- b
-			}
-		}
-	}()
-	return ch, nil
+func filteredBlockUpdates(ctx context.Context, block *types.Block, filter *blockUpdatesFilter, view *viewOptions) (map[string]interface{}, error) {
+	if view != nil {
+		if err := validateFormat(view.Format); err != nil { return nil, err }
+	}
+	result, err := blockUpdates(ctx, block)
+	if err != nil { return nil, err }
+	if filter != nil {
+		filter.compile()
+		result = filter.apply(result)
+	}
+	return view.present(result, filter)
 }
 
 
@@ -441,5 +703,10 @@ func GetAPIs(stack core.Node, backend restricted.Backend) []core.API {
 		 Service:	 &BlockUpdates{backend},
 		 Public:		true,
 	 },
+	 {
+		 Namespace: "admin",
+		 Version:	 "1.0",
+		 Service:	 &BlockUpdatesAdmin{backend: backend},
+	 },
  }
 }
@@ -3,7 +3,9 @@ package main
 import (
 	"math/big"
 	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
 	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
 	"github.com/openrelayxyz/plugeth-utils/restricted/types"
 )
 
@@ -32,6 +34,18 @@ func RPCMarshalHeader(head *types.Header) map[string]interface{} {
 	if head.BaseFee != nil {
 		result["baseFeePerGas"] = (*hexutil.Big)(head.BaseFee)
 	}
+	if head.WithdrawalsHash != nil {
+		result["withdrawalsRoot"] = head.WithdrawalsHash
+	}
+	if head.BlobGasUsed != nil {
+		result["blobGasUsed"] = hexutil.Uint64(*head.BlobGasUsed)
+	}
+	if head.ExcessBlobGas != nil {
+		result["excessBlobGas"] = hexutil.Uint64(*head.ExcessBlobGas)
+	}
+	if head.ParentBeaconRoot != nil {
+		result["parentBeaconBlockRoot"] = head.ParentBeaconRoot
+	}
 
 	return result
 }
@@ -68,10 +82,25 @@ func RPCMarshalBlock(block *types.Block, inclTx bool, fullTx bool) (map[string]i
 		uncleHashes[i] = uncle.Hash()
 	}
 	fields["uncles"] = uncleHashes
+	if block.Header().WithdrawalsHash != nil {
+		withdrawals := make([]*RPCWithdrawal, len(block.Withdrawals()))
+		for i, w := range block.Withdrawals() {
+			withdrawals[i] = &RPCWithdrawal{hexutil.Uint64(w.Index), hexutil.Uint64(w.Validator), w.Address, hexutil.Uint64(w.Amount)}
+		}
+		fields["withdrawals"] = withdrawals
+	}
 
 	return fields, nil
 }
 
+// RPCWithdrawal represents a withdrawal that will serialize to the RPC representation of a withdrawal
+type RPCWithdrawal struct {
+	Index     hexutil.Uint64 `json:"index"`
+	Validator hexutil.Uint64 `json:"validatorIndex"`
+	Address   core.Address   `json:"address"`
+	Amount    hexutil.Uint64 `json:"amount"`
+}
+
 // newRPCTransactionFromBlockHash returns a transaction that will serialize to the RPC representation.
 func newRPCTransactionFromBlockHash(b *types.Block, hash core.Hash) *RPCTransaction {
 	for idx, tx := range b.Transactions() {
@@ -100,6 +129,7 @@ type RPCTransaction struct {
 	GasPrice         *hexutil.Big      `json:"gasPrice"`
 	GasFeeCap        *hexutil.Big      `json:"maxFeePerGas,omitempty"`
 	GasTipCap        *hexutil.Big      `json:"maxPriorityFeePerGas,omitempty"`
+	MaxFeePerBlobGas *hexutil.Big      `json:"maxFeePerBlobGas,omitempty"`
 	Hash             core.Hash       `json:"hash"`
 	Input            hexutil.Bytes     `json:"input"`
 	Nonce            hexutil.Uint64    `json:"nonce"`
@@ -109,9 +139,11 @@ type RPCTransaction struct {
 	Type             hexutil.Uint64    `json:"type"`
 	Accesses         *types.AccessList `json:"accessList,omitempty"`
 	ChainID          *hexutil.Big      `json:"chainId,omitempty"`
+	BlobVersionedHashes []core.Hash    `json:"blobVersionedHashes,omitempty"`
 	V                *hexutil.Big      `json:"v"`
 	R                *hexutil.Big      `json:"r"`
 	S                *hexutil.Big      `json:"s"`
+	YParity          *hexutil.Uint64   `json:"yParity,omitempty"`
 }
 
 func bigMin(a, b *big.Int) *big.Int {
@@ -119,6 +151,37 @@ func bigMin(a, b *big.Int) *big.Int {
 	return a
 }
 
+// blobTxSender recovers the sender of a blob transaction, which the signers
+// in plugeth-utils don't support yet.
+func blobTxSender(tx *types.Transaction) (core.Address, error) {
+	v, r, s := tx.RawSignatureValues()
+	if v.BitLen() > 8 || !crypto.ValidateSignatureValues(byte(v.Uint64()), r, s, true) {
+		return core.Address{}, types.ErrInvalidSig
+	}
+	data, err := rlp.EncodeToBytes([]interface{}{
+		tx.ChainId(),
+		tx.Nonce(),
+		tx.GasTipCap(),
+		tx.GasFeeCap(),
+		tx.Gas(),
+		tx.To(),
+		tx.Value(),
+		tx.Data(),
+		tx.AccessList(),
+		tx.BlobGasFeeCap(),
+		tx.BlobHashes(),
+	})
+	if err != nil { return core.Address{}, err }
+	sighash := crypto.Keccak256([]byte{types.BlobTxType}, data)
+	sig := make([]byte, 65)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:64])
+	sig[64] = byte(v.Uint64())
+	pub, err := crypto.Ecrecover(sighash, sig)
+	if err != nil { return core.Address{}, err }
+	return core.BytesToAddress(crypto.Keccak256(pub[1:])[12:]), nil
+}
+
 // newRPCTransaction returns a transaction that will serialize to the RPC
 // representation, with the given location metadata set (if available).
 func newRPCTransaction(tx *types.Transaction, blockHash core.Hash, blockNumber uint64, index uint64, baseFee *big.Int) *RPCTransaction {
@@ -126,13 +189,18 @@ func newRPCTransaction(tx *types.Transaction, blockHash core.Hash, blockNumber u
 	// signer, because we assume that signers are backwards-compatible with old
 	// transactions. For non-protected transactions, the homestead signer signer is used
 	// because the return value of ChainId is zero for those transactions.
-	var signer types.Signer
-	if tx.Protected() {
-		signer = types.LatestSignerForChainID(tx.ChainId())
+	var from core.Address
+	if tx.Type() == types.BlobTxType {
+		from, _ = blobTxSender(tx)
 	} else {
-		signer = types.HomesteadSigner{}
+		var signer types.Signer
+		if tx.Protected() {
+			signer = types.LatestSignerForChainID(tx.ChainId())
+		} else {
+			signer = types.HomesteadSigner{}
+		}
+		from, _ = types.Sender(signer, tx)
 	}
-	from, _ := types.Sender(signer, tx)
 	v, r, s := tx.RawSignatureValues()
 	result := &RPCTransaction{
 		Type:     hexutil.Uint64(tx.Type()),
@@ -153,15 +221,23 @@ func newRPCTransaction(tx *types.Transaction, blockHash core.Hash, blockNumber u
 		result.BlockNumber = (*hexutil.Big)(new(big.Int).SetUint64(blockNumber))
 		result.TransactionIndex = (*hexutil.Uint64)(&index)
 	}
+	if tx.Type() != types.LegacyTxType {
+		yparity := hexutil.Uint64(v.Sign())
+		result.YParity = &yparity
+	}
 	switch tx.Type() {
 	case types.AccessListTxType:
 		al := tx.AccessList()
 		result.Accesses = &al
 		result.ChainID = (*hexutil.Big)(tx.ChainId())
-	case types.DynamicFeeTxType:
+	case types.DynamicFeeTxType, types.BlobTxType:
 		al := tx.AccessList()
 		result.Accesses = &al
 		result.ChainID = (*hexutil.Big)(tx.ChainId())
+		if tx.Type() == types.BlobTxType {
+			result.MaxFeePerBlobGas = (*hexutil.Big)(tx.BlobGasFeeCap())
+			result.BlobVersionedHashes = tx.BlobHashes()
+		}
 		result.GasFeeCap = (*hexutil.Big)(tx.GasFeeCap())
 		result.GasTipCap = (*hexutil.Big)(tx.GasTipCap())
 		// if the transaction has been mined, compute the effective gas price
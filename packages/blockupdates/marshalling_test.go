@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hasher"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// checkGolden compares the JSON encoding of v with testdata/name.json.
+func checkGolden(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	actual, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatalf("Error marshalling %v: %v", name, err.Error())
+	}
+	actual = append(actual, '\n')
+	path := filepath.Join("testdata", name + ".json")
+	if *updateGolden {
+		if err := os.WriteFile(path, actual, 0644); err != nil {
+			t.Fatalf("Error writing %v: %v", path, err.Error())
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading %v: %v", path, err.Error())
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("%v does not match golden file:\n%s", name, actual)
+	}
+}
+
+func signBlobTx(t *testing.T, inner *types.BlobTx, signer func([]byte) []byte) *types.Transaction {
+	tx := types.NewTx(inner)
+	data, _ := rlp.EncodeToBytes([]interface{}{tx.ChainId(), tx.Nonce(), tx.GasTipCap(), tx.GasFeeCap(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), tx.AccessList(), tx.BlobGasFeeCap(), tx.BlobHashes()})
+	sig := signer(crypto.Keccak256([]byte{types.BlobTxType}, data))
+	inner.R = new(uint256.Int).SetBytes(sig[:32])
+	inner.S = new(uint256.Int).SetBytes(sig[32:64])
+	inner.V = uint256.NewInt(uint64(sig[64]))
+	return types.NewTx(inner)
+}
+
+func TestMarshalling(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	chainID := big.NewInt(1)
+	to := core.HexToAddress("0x000000000000000000000000000000000000beef")
+	accessList := types.AccessList{{Address: to, StorageKeys: []core.Hash{core.HexToHash("0x01")}}}
+	sign := func(tx *types.Transaction, signer types.Signer) *types.Transaction {
+		signed, err := types.SignTx(tx, signer, key)
+		if err != nil {
+			t.Fatalf("Error signing transaction: %v", err.Error())
+		}
+		return signed
+	}
+	txs := map[string]*types.Transaction{
+		"tx_legacy": sign(types.NewTx(&types.LegacyTx{Nonce: 0, GasPrice: big.NewInt(30e9), Gas: 21000, To: &to, Value: big.NewInt(1)}), types.NewEIP155Signer(chainID)),
+		"tx_accesslist": sign(types.NewTx(&types.AccessListTx{ChainID: chainID, Nonce: 1, GasPrice: big.NewInt(30e9), Gas: 30000, To: &to, AccessList: accessList}), types.NewEIP2930Signer(chainID)),
+		"tx_dynamicfee": sign(types.NewTx(&types.DynamicFeeTx{ChainID: chainID, Nonce: 2, GasTipCap: big.NewInt(1e9), GasFeeCap: big.NewInt(40e9), Gas: 30000, To: &to, Data: []byte{1, 2, 3}, AccessList: accessList}), types.NewLondonSigner(chainID)),
+		"tx_blob": signBlobTx(t, &types.BlobTx{
+			ChainID: uint256.NewInt(1),
+			Nonce: 3,
+			GasTipCap: uint256.NewInt(1e9),
+			GasFeeCap: uint256.NewInt(40e9),
+			Gas: 21000,
+			To: to,
+			Value: uint256.NewInt(0),
+			BlobFeeCap: uint256.NewInt(5e9),
+			BlobHashes: []core.Hash{core.HexToHash("0x0100000000000000000000000000000000000000000000000000000000000001")},
+		}, func(hash []byte) []byte {
+			sig, _ := crypto.Sign(hash, key)
+			return sig
+		}),
+	}
+	order := []string{"tx_legacy", "tx_accesslist", "tx_dynamicfee", "tx_blob"}
+	blockTxs := make([]*types.Transaction, len(order))
+	for i, name := range order {
+		blockTxs[i] = txs[name]
+	}
+	blobGasUsed, excessBlobGas := uint64(131072), uint64(0)
+	beaconRoot := core.HexToHash("0xbeac")
+	header := &types.Header{
+		ParentHash: core.HexToHash("0x01"),
+		Coinbase: core.HexToAddress("0xc0ffee"),
+		Root: core.HexToHash("0x02"),
+		Difficulty: big.NewInt(0),
+		Number: big.NewInt(19426587),
+		GasLimit: 30000000,
+		GasUsed: 102000,
+		Time: 1710338135,
+		BaseFee: big.NewInt(20e9),
+		BlobGasUsed: &blobGasUsed,
+		ExcessBlobGas: &excessBlobGas,
+		ParentBeaconRoot: &beaconRoot,
+	}
+	withdrawals := []*types.Withdrawal{{Index: 40000000, Validator: 1000, Address: to, Amount: 17000000}}
+	block := types.NewBlockWithWithdrawals(header, blockTxs, nil, nil, withdrawals, hasher.NewStackTrie(nil))
+
+	fields, err := RPCMarshalBlock(block, true, false)
+	if err != nil {
+		t.Fatalf("Error marshalling block: %v", err.Error())
+	}
+	checkGolden(t, "block", fields)
+	for i, name := range order {
+		tx := newRPCTransactionFromBlockIndex(block, uint64(i))
+		if tx.From != sender {
+			t.Errorf("%v: unexpected sender %v", name, tx.From)
+		}
+		checkGolden(t, name, tx)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+const (
+	// maxWriteBatch bounds how many queued state updates are written per pass.
+	maxWriteBatch = 64
+	shutdownTimeout = 30 * time.Second
+)
+
+var (
+	flushCh = make(chan chan struct{})
+	indexFlushCh = make(chan chan struct{})
+	// indexCh queues stored state updates for indexStateUpdates.
+	indexCh chan *stateUpdateWithBlock
+)
+
+// writeStateUpdates stores the state updates queued on suCh, along with the
+// last emitted block. Whatever is queued is written together in block order.
+// The plugin database has no batch API, so writes are not atomic per block:
+// the state update record is written first and on its own, and the block's
+// reverse diff and history entries are left to indexStateUpdates. Those are
+// best effort; if they fail, or a crash comes between the writes, the state
+// update is still stored and the block is left out of the indexed history
+// range.
+func writeStateUpdates() {
+	for {
+		var batch []*stateUpdateWithBlock
+		var flushed chan struct{}
+		select {
+		case su := <-suCh:
+			batch = append(batch, su)
+		case flushed = <-flushCh:
+		}
+	drain:
+		for len(batch) < maxWriteBatch || flushed != nil {
+			select {
+			case su := <-suCh:
+				batch = append(batch, su)
+			default:
+				break drain
+			}
+		}
+		queueIndexing(writeBatch(batch))
+		storeLastEmitted()
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// writeBatch stores the state update records of a batch, returning the ones
+// that were stored.
+func writeBatch(batch []*stateUpdateWithBlock) []*stateUpdateWithBlock {
+	if len(batch) == 0 { return nil }
+	sort.SliceStable(batch, func(i, j int) bool { return batch[i].number < batch[j].number })
+	db := backend.ChainDb()
+	var stored []*stateUpdateWithBlock
+	for _, su := range batch {
+		data, err := encodeStoredStateUpdate(su.su)
+		if err != nil {
+			log.Error("Failed to encode state update, it will not be stored", "number", su.number, "hash", su.hash, "err", err)
+			continue
+		}
+		if err := db.Put(suKey(su.number, su.hash), data); err != nil {
+			log.Error("Failed to store state update", "number", su.number, "hash", su.hash, "err", err)
+			continue
+		}
+		stored = append(stored, su)
+	}
+	log.Debug("Stored state updates", "count", len(stored))
+	return stored
+}
+
+// queueIndexing hands stored state updates to indexStateUpdates without
+// blocking the writer. If indexing has fallen too far behind, blocks are
+// skipped.
+func queueIndexing(batch []*stateUpdateWithBlock) {
+	for _, su := range batch {
+		select {
+		case indexCh <- su:
+		default:
+			log.Warn("State history indexing is behind, skipping block", "number", su.number, "hash", su.hash)
+			rewindHistoryBackfill(su.number)
+		}
+	}
+}
+
+// indexStateUpdates stores the reverse diffs and history entries of the state
+// updates queued on indexCh. Computing a reverse diff means reading the parent
+// state for every change, which is too slow to do while block import waits on
+// the writer, so it happens here, behind it.
+func indexStateUpdates() {
+	for {
+		var batch []*stateUpdateWithBlock
+		var flushed chan struct{}
+		select {
+		case su := <-indexCh:
+			batch = append(batch, su)
+		case flushed = <-indexFlushCh:
+		}
+	drain:
+		for len(batch) < maxWriteBatch || flushed != nil {
+			select {
+			case su := <-indexCh:
+				batch = append(batch, su)
+			default:
+				break drain
+			}
+		}
+		indexBatch(batch)
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+func indexBatch(batch []*stateUpdateWithBlock) {
+	if len(batch) == 0 { return }
+	var highest uint64
+	for _, su := range batch {
+		if su.number > highest {
+			highest = su.number
+		}
+		// Without a reverse diff the history is still indexed, with unknown
+		// prior values
+		reverse, err := storeReverseDiff(su.su, su.number, su.hash)
+		if err != nil {
+			log.Warn("Failed to store reverse diff", "number", su.number, "hash", su.hash, "err", err)
+		}
+		if err := indexStateUpdate(su.su, reverse, nil, su.number, su.hash, false); err != nil {
+			log.Warn("Failed to index state update history", "number", su.number, "hash", su.hash, "err", err)
+		}
+	}
+	advanceIndexedRange(highest)
+}
+
+// flushStateUpdates waits until everything queued on suCh has been written.
+func flushStateUpdates(timeout time.Duration) bool {
+	return flushQueue(flushCh, timeout)
+}
+
+// flushIndexing waits until everything queued on indexCh has been indexed.
+func flushIndexing(timeout time.Duration) bool {
+	return flushQueue(indexFlushCh, timeout)
+}
+
+func flushQueue(ch chan chan struct{}, timeout time.Duration) bool {
+	done := make(chan struct{})
+	select {
+	case ch <- done:
+	case <-time.After(timeout):
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// OnShutdown is invoked by the plugin loader as the node stops. We flush the
+// state updates still waiting to be written, and then their history, so the
+// last blocks before a clean shutdown are not lost, and make sure the freezer
+// is on disk.
+func OnShutdown() {
+	if backend == nil { return }
+	if !flushStateUpdates(shutdownTimeout) {
+		log.Warn("Timed out writing queued state updates on shutdown", "queued", len(suCh))
+	}
+	if !flushIndexing(shutdownTimeout) {
+		log.Warn("Timed out indexing state history on shutdown", "queued", len(indexCh))
+	}
+	if suFreezer != nil {
+		if err := suFreezer.Sync(); err != nil {
+			log.Warn("Failed to sync state update freezer", "err", err)
+		}
+	}
+	log.Info("Flushed state updates on shutdown")
+}
+
+// checkStateUpdates looks for canonical blocks near the head that have no
+// stored state update, for instance because the node crashed before they were
+// written, and regenerates them where the state is still available.
+func checkStateUpdates() {
+	head, err := decodeHeader(backend.CurrentHeader())
+	if err != nil {
+		log.Warn("Could not check stored state updates", "err", err)
+		return
+	}
+	var missing []*types.Block
+	for n := head.Number.Uint64(); n > 0 && n + canonicalDepth > head.Number.Uint64(); n-- {
+		blockBytes, err := backend.BlockByNumber(context.Background(), int64(n))
+		if err != nil { break }
+		var block types.Block
+		if err := rlp.DecodeBytes(blockBytes, &block); err != nil { break }
+		if !hasStoredStateUpdate(n, block.Hash()) {
+			missing = append(missing, &block)
+		}
+	}
+	if len(missing) == 0 { return }
+	log.Warn("Found canonical blocks without stored state updates, regenerating", "count", len(missing))
+	regenerated := 0
+	for i := len(missing) - 1; i >= 0; i-- {
+		if _, err := regenerateAndStore(missing[i]); err != nil {
+			log.Debug("Could not regenerate state update", "number", missing[i].NumberU64(), "err", err)
+			continue
+		}
+		regenerated++
+	}
+	log.Info("Regenerated missing state updates", "regenerated", regenerated, "unavailable", len(missing) - regenerated)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+)
+
+func TestWriteBatch(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	account := core.HexToHash("0x01")
+	one := b.addBlock(genesis, b.setState(map[core.Hash]*fullAccount{account: {Nonce: 1, Balance: big.NewInt(1)}}, nil))
+	su, err := regenerateStateUpdate(one)
+	if err != nil {
+		t.Fatalf("Error regenerating state update: %v", err.Error())
+	}
+	// Without the parent state there is no reverse diff, but the state
+	// update is still stored
+	orphan := b.addBlock(one, b.setState(map[core.Hash]*fullAccount{account: {Nonce: 2, Balance: big.NewInt(2)}}, nil))
+	delete(b.tries, one.Root())
+	indexBatch(writeBatch([]*stateUpdateWithBlock{{su: su, number: orphan.NumberU64(), hash: orphan.Hash()}}))
+	if ok, _ := b.db.Has(suKey(orphan.NumberU64(), orphan.Hash())); !ok {
+		t.Errorf("State update dropped without its reverse diff")
+	}
+	if ok, _ := b.db.Has(reverseDiffKey(orphan.NumberU64(), orphan.Hash())); ok {
+		t.Errorf("Unexpected reverse diff without the parent state")
+	}
+	if data, err := b.db.Get(accountHistoryKey(account, orphan.NumberU64(), orphan.Hash())); err != nil {
+		t.Errorf("History not indexed without a reverse diff")
+	} else {
+		var entry historyEntry
+		if err := rlp.DecodeBytes(data, &entry); err != nil || entry.BeforeKnown {
+			t.Errorf("Expected an unknown prior value: %v", err)
+		}
+	}
+
+	// The writer only stores the state update and queues the block for
+	// indexing, skipping it if the queue is full and leaving it to the next
+	// history backfill
+	b.db.Put(historyBackfillKey, binary.BigEndian.AppendUint64(nil, 10))
+	oldIndexCh := indexCh
+	indexCh = make(chan *stateUpdateWithBlock, 1)
+	defer func() { indexCh = oldIndexCh }()
+	queueIndexing(writeBatch([]*stateUpdateWithBlock{{su: su, number: one.NumberU64(), hash: one.Hash()}}))
+	queueIndexing([]*stateUpdateWithBlock{{su: su, number: orphan.NumberU64(), hash: orphan.Hash()}})
+	if ok, _ := b.db.Has(reverseDiffKey(one.NumberU64(), one.Hash())); ok || len(indexCh) != 1 {
+		t.Fatalf("Expected the block to be queued for indexing")
+	}
+	if data, _ := b.db.Get(historyBackfillKey); binary.BigEndian.Uint64(data) != orphan.NumberU64() {
+		t.Errorf("Expected the history backfill to be rewound to the skipped block, got %x", data)
+	}
+	indexBatch([]*stateUpdateWithBlock{<-indexCh})
+	for _, key := range [][]byte{suKey(one.NumberU64(), one.Hash()), reverseDiffKey(one.NumberU64(), one.Hash()), accountHistoryKey(account, one.NumberU64(), one.Hash())} {
+		if ok, _ := b.db.Has(key); !ok {
+			t.Errorf("Missing record %x", key)
+		}
+	}
+}
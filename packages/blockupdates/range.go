@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+)
+
+const (
+	defaultRangeLimit = 100
+	maxRangeLimit = 1000
+	defaultRangeBytes = 8 * 1024 * 1024
+	maxRangeBytes = 64 * 1024 * 1024
+)
+
+// rangeOptions bounds the size of a page returned by BlockUpdatesRange.
+type rangeOptions struct {
+	Limit int `json:"limit"`
+	MaxBytes int `json:"maxBytes"`
+	Filter *blockUpdatesFilter `json:"filter"`
+	Decoded bool `json:"decoded"`
+	Attribution bool `json:"attribution"`
+	Format string `json:"format"`
+}
+
+// rangeResult is a page of block updates. Next is the block number to pass as
+// `from` to retrieve the following page, and is omitted once the requested
+// range has been exhausted.
+type rangeResult struct {
+	Blocks []json.RawMessage `json:"blocks"`
+	Next *hexutil.Uint64 `json:"next,omitempty"`
+}
+
+func (opts *rangeOptions) normalize() {
+	if opts.Limit <= 0 {
+		opts.Limit = defaultRangeLimit
+	}
+	if opts.Limit > maxRangeLimit {
+		opts.Limit = maxRangeLimit
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaultRangeBytes
+	}
+	if opts.MaxBytes > maxRangeBytes {
+		opts.MaxBytes = maxRangeBytes
+	}
+}
+
+// BlockUpdatesRange returns the block updates for consecutive blocks from
+// `from` to `to` inclusive, stopping early once the page reaches the limit on
+// blocks or serialized bytes. At least one block is always returned, so a
+// single oversized block cannot stall a client.
+func (b *BlockUpdates) BlockUpdatesRange(ctx context.Context, from, to restricted.BlockNumber, opts *rangeOptions) (*rangeResult, error) {
+	if opts == nil {
+		opts = &rangeOptions{}
+	}
+	opts.normalize()
+	if err := validateFormat(opts.Format); err != nil { return nil, err }
+	head, err := decodeHeader(b.backend.CurrentHeader())
+	if err != nil { return nil, err }
+	if to < 0 || uint64(to) > head.Number.Uint64() {
+		to = restricted.BlockNumber(head.Number.Uint64())
+	}
+	if from < 0 || from > to {
+		return nil, fmt.Errorf("invalid range %v - %v", from.Int64(), to.Int64())
+	}
+	result := &rangeResult{Blocks: []json.RawMessage{}}
+	size := 0
+	n := from
+	for ; n <= to && len(result.Blocks) < opts.Limit; n++ {
+		if err := ctx.Err(); err != nil { return nil, err }
+		update, err := b.BlockUpdatesByNumber(ctx, n, opts.Filter, &viewOptions{Decoded: opts.Decoded, Attribution: opts.Attribution, Format: opts.Format})
+		if err != nil {
+			if len(result.Blocks) == 0 { return nil, err }
+			break
+		}
+		data, err := json.Marshal(update)
+		if err != nil { return nil, err }
+		if len(result.Blocks) > 0 && size + len(data) > opts.MaxBytes { break }
+		result.Blocks = append(result.Blocks, data)
+		size += len(data)
+	}
+	if n <= to {
+		next := hexutil.Uint64(n)
+		result.Next = &next
+	}
+	return result, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+func TestBlockUpdatesRange(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	account := core.HexToHash("0x01")
+	chain := []*types.Block{genesis}
+	for i := int64(1); i <= 6; i++ {
+		block := b.addBlock(chain[i-1], b.setState(map[core.Hash]*fullAccount{account: {Nonce: uint64(i), Balance: big.NewInt(i)}}, nil))
+		su, err := regenerateStateUpdate(block)
+		if err != nil {
+			t.Fatalf("Error regenerating state update: %v", err.Error())
+		}
+		data, err := encodeStoredStateUpdate(su)
+		if err != nil {
+			t.Fatalf("Error encoding state update: %v", err.Error())
+		}
+		b.db.Put(suKey(block.NumberU64(), block.Hash()), data)
+		chain = append(chain, block)
+	}
+	// Blocks up to 3 are in the freezer
+	oldFreezer := suFreezer
+	f, err := openFreezer(t.TempDir(), "stateupdates")
+	if err != nil {
+		t.Fatalf("Error opening freezer: %v", err.Error())
+	}
+	suFreezer = f
+	t.Cleanup(func() {
+		f.Close()
+		suFreezer = oldFreezer
+	})
+	for _, block := range chain[:4] {
+		freezeStateUpdate(&ancientBlock{block.NumberU64(), block.Hash()})
+	}
+	if ok, _ := b.db.Has(suKey(3, chain[3].Hash())); ok || f.Head() != 4 {
+		t.Fatalf("Expected blocks to be frozen")
+	}
+	cache.Purge()
+
+	api := &BlockUpdates{b}
+	numbers := func(result *rangeResult) []uint64 {
+		var ns []uint64
+		for _, data := range result.Blocks {
+			var msg struct {
+				Number hexutil.Uint64 `json:"number"`
+			}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatalf("Error decoding block: %v", err.Error())
+			}
+			ns = append(ns, uint64(msg.Number))
+		}
+		return ns
+	}
+	var pages [][]uint64
+	from := restricted.BlockNumber(1)
+	for {
+		result, err := api.BlockUpdatesRange(context.Background(), from, 100, &rangeOptions{Limit: 2})
+		if err != nil {
+			t.Fatalf("Error getting range from %v: %v", from, err.Error())
+		}
+		pages = append(pages, numbers(result))
+		if result.Next == nil { break }
+		from = restricted.BlockNumber(*result.Next)
+	}
+	if len(pages) != 3 || pages[0][0] != 1 || pages[1][0] != 3 || pages[1][1] != 4 || pages[2][1] != 6 {
+		t.Errorf("Unexpected pages %v", pages)
+	}
+
+	full, err := api.BlockUpdatesRange(context.Background(), 2, 3, nil)
+	if err != nil {
+		t.Fatalf("Error getting range: %v", err.Error())
+	}
+	if len(full.Blocks) != 2 || full.Next != nil {
+		t.Fatalf("Unexpected range %v", numbers(full))
+	}
+	limited, err := api.BlockUpdatesRange(context.Background(), 2, 3, &rangeOptions{MaxBytes: len(full.Blocks[0]) + 1})
+	if err != nil {
+		t.Fatalf("Error getting range: %v", err.Error())
+	}
+	if len(limited.Blocks) != 1 || limited.Next == nil || *limited.Next != 3 {
+		t.Errorf("Unexpected size limited range %v", numbers(limited))
+	}
+	// A single block larger than the limit is still returned
+	limited, err = api.BlockUpdatesRange(context.Background(), 2, 3, &rangeOptions{MaxBytes: 1})
+	if err != nil || len(limited.Blocks) != 1 {
+		t.Errorf("Expected one oversized block: %v", err)
+	}
+
+	if _, err := api.BlockUpdatesRange(context.Background(), 5, 4, nil); err == nil {
+		t.Errorf("Expected an error for from > to")
+	}
+}
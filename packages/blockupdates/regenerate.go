@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/trie"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+var errRegenerationRunning = errors.New("state update regeneration already running")
+
+// trieDiff returns the leaves of the child trie that are new or changed
+// relative to the parent trie, and the keys of parent leaves that no longer
+// exist in the child.
+func trieDiff(parent, child core.Trie) (map[core.Hash][]byte, []core.Hash, error) {
+	changed := make(map[core.Hash][]byte)
+	diff, _ := trie.NewDifferenceIterator(parent.NodeIterator(nil), child.NodeIterator(nil))
+	it := trie.NewIterator(diff)
+	for it.Next() {
+		changed[core.BytesToHash(it.Key)] = core.CopyBytes(it.Value)
+	}
+	if it.Err != nil { return nil, nil, it.Err }
+	var removed []core.Hash
+	diff, _ = trie.NewDifferenceIterator(child.NodeIterator(nil), parent.NodeIterator(nil))
+	it = trie.NewIterator(diff)
+	for it.Next() {
+		key := core.BytesToHash(it.Key)
+		if _, ok := changed[key]; ok { continue }
+		value, err := trieGet(child, key)
+		if err != nil { return nil, nil, err }
+		if value == nil {
+			removed = append(removed, key)
+		}
+	}
+	if it.Err != nil { return nil, nil, it.Err }
+	return changed, removed, nil
+}
+
+// storageTrieOrEmpty opens the storage trie for a storage root, returning nil
+// for the empty root.
+func storageTrieOrEmpty(root core.Hash) (core.Trie, error) {
+	if root == types.EmptyRootHash { return nil, nil }
+	return backend.GetTrie(root)
+}
+
+// regenerateStateUpdate rebuilds the state update for a block by diffing its
+// state trie against its parent's. Both states must still be available to
+// the node. Accounts that were destructed and recreated within the block
+// cannot be told apart from accounts that were simply modified, so they are
+// reported as modified; accounts removed from the trie are reported as
+// destructs.
+func regenerateStateUpdate(block *types.Block) (*stateUpdate, error) {
+	if block.NumberU64() == 0 { return nil, fmt.Errorf("cannot regenerate state updates for genesis") }
+	parentBytes, err := backend.HeaderByHash(context.Background(), block.ParentHash())
+	if err != nil { return nil, err }
+	parentHeader, err := decodeHeader(parentBytes)
+	if err != nil { return nil, err }
+	parent, err := openState(parentHeader.Root)
+	if err != nil { return nil, err }
+	child, err := openState(block.Root())
+	if err != nil { return nil, err }
+	su := &stateUpdate{
+		Destructs: make(map[core.Hash]struct{}),
+		Accounts: make(map[core.Hash][]byte),
+		Storage: make(map[core.Hash]map[core.Hash][]byte),
+		Code: make(map[core.Hash][]byte),
+	}
+	changed, removed, err := trieDiff(parent.accounts, child.accounts)
+	if err != nil { return nil, err }
+	for _, account := range removed {
+		su.Destructs[account] = struct{}{}
+	}
+	for account, data := range changed {
+		slim, err := slimAccountRLP(data)
+		if err != nil { return nil, err }
+		su.Accounts[account] = slim
+		acct := &fullAccount{}
+		if err := rlp.DecodeBytes(data, acct); err != nil { return nil, err }
+		prior, err := parent.Account(account)
+		if err != nil { return nil, err }
+		priorRoot := types.EmptyRootHash
+		if prior != nil {
+			priorRoot = prior.Root
+		}
+		if prior == nil || core.BytesToHash(prior.CodeHash) != core.BytesToHash(acct.CodeHash) {
+			if codeHash := core.BytesToHash(acct.CodeHash); codeHash != core.BytesToHash(emptyCodeHash) {
+				code, err := backend.GetContractCode(codeHash)
+				if err != nil { return nil, err }
+				su.Code[codeHash] = code
+			}
+		}
+		if priorRoot == acct.Root { continue }
+		storage := make(map[core.Hash][]byte)
+		childStorage, err := storageTrieOrEmpty(acct.Root)
+		if err != nil { return nil, err }
+		priorStorage, err := storageTrieOrEmpty(priorRoot)
+		if err != nil { return nil, err }
+		switch {
+		case childStorage == nil:
+			slots, err := parent.AllStorage(account)
+			if err != nil { return nil, err }
+			for slot := range slots {
+				storage[slot] = []byte{}
+			}
+		case priorStorage == nil:
+			slots, err := child.AllStorage(account)
+			if err != nil { return nil, err }
+			storage = slots
+		default:
+			changedSlots, removedSlots, err := trieDiff(priorStorage, childStorage)
+			if err != nil { return nil, err }
+			storage = changedSlots
+			for _, slot := range removedSlots {
+				storage[slot] = []byte{}
+			}
+		}
+		if len(storage) > 0 {
+			su.Storage[account] = storage
+		}
+	}
+	return su, nil
+}
+
+// regenerateAndStore regenerates the state update for a block and queues it
+// to be stored in the normal format.
+func regenerateAndStore(block *types.Block) (*stateUpdate, error) {
+	su, err := regenerateStateUpdate(block)
+	if err != nil { return nil, err }
+	cache.Add(block.Hash(), su)
+	suCh <- &stateUpdateWithBlock{su: su, number: block.NumberU64(), hash: block.Hash()}
+	return su, nil
+}
+
+// hasStoredStateUpdate indicates whether a state update for the block is
+// already stored in leveldb or the freezer.
+func hasStoredStateUpdate(number uint64, hash core.Hash) bool {
+	if ok, err := backend.ChainDb().Has(suKey(number, hash)); err == nil && ok { return true }
+	_, err := frozenStateUpdate(number, hash)
+	return err == nil
+}
+
+// regenerationStatus reports the progress of a background regeneration.
+type regenerationStatus struct {
+	Running bool `json:"running"`
+	From hexutil.Uint64 `json:"from"`
+	To hexutil.Uint64 `json:"to"`
+	Current hexutil.Uint64 `json:"current"`
+	Regenerated hexutil.Uint64 `json:"regenerated"`
+	Skipped hexutil.Uint64 `json:"skipped"`
+	Failed hexutil.Uint64 `json:"failed"`
+	LastError string `json:"lastError,omitempty"`
+	Started time.Time `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// BlockUpdatesAdmin provides administrative methods for the block updates
+// plugin.
+type BlockUpdatesAdmin struct {
+	backend restricted.Backend
+	lock sync.Mutex
+	regeneration *regenerationStatus
+	cancel context.CancelFunc
+}
+
+// RegenerateStateUpdates starts regenerating missing state updates for the
+// given range of blocks in the background. Blocks that already have state
+// updates stored are skipped. Progress is available from
+// StateUpdateRegenerationStatus.
+func (a *BlockUpdatesAdmin) RegenerateStateUpdates(from, to restricted.BlockNumber) (*regenerationStatus, error) {
+	if from < 0 || to < from {
+		return nil, fmt.Errorf("invalid range %v - %v", from.Int64(), to.Int64())
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.regeneration != nil && a.regeneration.Running { return nil, errRegenerationRunning }
+	status := &regenerationStatus{
+		Running: true,
+		From: hexutil.Uint64(from),
+		To: hexutil.Uint64(to),
+		Current: hexutil.Uint64(from),
+		Started: time.Now(),
+	}
+	a.regeneration = status
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	go a.regenerate(ctx, status)
+	result := *status
+	return &result, nil
+}
+
+func (a *BlockUpdatesAdmin) regenerate(ctx context.Context, status *regenerationStatus) {
+	log.Info("Regenerating state updates", "from", uint64(status.From), "to", uint64(status.To))
+	defer func() {
+		a.lock.Lock()
+		now := time.Now()
+		status.Running = false
+		status.Finished = &now
+		log.Info("Finished regenerating state updates", "regenerated", uint64(status.Regenerated), "skipped", uint64(status.Skipped), "failed", uint64(status.Failed))
+		a.lock.Unlock()
+	}()
+	for n := uint64(status.From); n <= uint64(status.To); n++ {
+		if ctx.Err() != nil {
+			a.lock.Lock()
+			status.LastError = ctx.Err().Error()
+			a.lock.Unlock()
+			return
+		}
+		var err error
+		regenerated := false
+		blockBytes, err := a.backend.BlockByNumber(ctx, int64(n))
+		if err == nil {
+			var block types.Block
+			if err = rlp.DecodeBytes(blockBytes, &block); err == nil && !hasStoredStateUpdate(n, block.Hash()) {
+				_, err = regenerateAndStore(&block)
+				regenerated = err == nil
+			}
+		}
+		a.lock.Lock()
+		status.Current = hexutil.Uint64(n)
+		switch {
+		case err != nil:
+			status.Failed++
+			status.LastError = fmt.Sprintf("block %v: %v", n, err)
+		case regenerated:
+			status.Regenerated++
+		default:
+			status.Skipped++
+		}
+		a.lock.Unlock()
+	}
+}
+
+// StateUpdateRegenerationStatus reports the progress of the most recent
+// regeneration.
+func (a *BlockUpdatesAdmin) StateUpdateRegenerationStatus() (*regenerationStatus, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.regeneration == nil { return nil, fmt.Errorf("no regeneration has been started") }
+	result := *a.regeneration
+	return &result, nil
+}
+
+// StopStateUpdateRegeneration cancels a running regeneration.
+func (a *BlockUpdatesAdmin) StopStateUpdateRegeneration() (bool, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.regeneration == nil || !a.regeneration.Running { return false, nil }
+	a.cancel()
+	return true, nil
+}
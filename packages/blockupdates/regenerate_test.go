@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+)
+
+func TestTrieDiff(t *testing.T) {
+	a, b, c, d := core.HexToHash("0x0a"), core.HexToHash("0x0b"), core.HexToHash("0x0c"), core.HexToHash("0x0d")
+	parent := newMemTrie(map[core.Hash][]byte{a: {1}, b: {2}, c: {3}})
+	child := newMemTrie(map[core.Hash][]byte{a: {1}, b: {5}, d: {4}})
+	changed, removed, err := trieDiff(parent, child)
+	if err != nil {
+		t.Fatalf("Error diffing tries: %v", err.Error())
+	}
+	if len(changed) != 2 || !bytes.Equal(changed[b], []byte{5}) || !bytes.Equal(changed[d], []byte{4}) {
+		t.Errorf("Unexpected changes: %v", changed)
+	}
+	if len(removed) != 1 || removed[0] != c {
+		t.Errorf("Unexpected removals: %v", removed)
+	}
+	changed, removed, err = trieDiff(newMemTrie(nil), parent)
+	if err != nil {
+		t.Fatalf("Error diffing tries: %v", err.Error())
+	}
+	if len(changed) != 3 || len(removed) != 0 {
+		t.Errorf("Unexpected diff from empty trie: %v %v", changed, removed)
+	}
+}
+
+func TestRegenerateStateUpdate(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	modified, destructed, created := core.HexToHash("0x01"), core.HexToHash("0x02"), core.HexToHash("0x03")
+	slot, cleared := core.HexToHash("0x10"), core.HexToHash("0x11")
+	code := []byte{0x60, 0x00}
+	codeHash := crypto.Keccak256Hash(code)
+	b.code[codeHash] = code
+	one := b.addBlock(genesis, b.setState(map[core.Hash]*fullAccount{
+		modified: {Nonce: 1, Balance: big.NewInt(100)},
+		destructed: {Balance: big.NewInt(5)},
+	}, map[core.Hash]map[core.Hash][]byte{
+		modified: {slot: {0x01}, cleared: {0x02}},
+	}))
+	two := b.addBlock(one, b.setState(map[core.Hash]*fullAccount{
+		modified: {Nonce: 2, Balance: big.NewInt(90)},
+		created: {Balance: big.NewInt(10), CodeHash: codeHash.Bytes()},
+	}, map[core.Hash]map[core.Hash][]byte{
+		modified: {slot: {0x03}},
+	}))
+	su, err := regenerateStateUpdate(two)
+	if err != nil {
+		t.Fatalf("Error regenerating state update: %v", err.Error())
+	}
+	if _, ok := su.Destructs[destructed]; !ok || len(su.Destructs) != 1 {
+		t.Errorf("Unexpected destructs: %v", su.Destructs)
+	}
+	if len(su.Accounts) != 2 {
+		t.Errorf("Unexpected accounts: %v", su.Accounts)
+	}
+	if acct, err := fullAccountFromSlim(su.Accounts[modified]); err != nil || acct.Nonce != 2 || acct.Balance.Int64() != 90 {
+		t.Errorf("Unexpected modified account: %v %v", acct, err)
+	}
+	if !bytes.Equal(su.Code[codeHash], code) || len(su.Code) != 1 {
+		t.Errorf("Unexpected code: %v", su.Code)
+	}
+	storage := su.Storage[modified]
+	if len(storage) != 2 || !bytes.Equal(storage[slot], []byte{0x03}) || storage[cleared] == nil || len(storage[cleared]) != 0 {
+		t.Errorf("Unexpected storage: %v", storage)
+	}
+	if len(su.Storage) != 1 {
+		t.Errorf("Unexpected storage accounts: %v", su.Storage)
+	}
+}
+
+func TestLoadStateUpdateDoesNotRegenerate(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	block := b.addBlock(genesis, b.setState(map[core.Hash]*fullAccount{core.HexToHash("0x01"): {Balance: big.NewInt(1)}}, nil))
+	if _, err := loadStateUpdate(block); err == nil {
+		t.Fatalf("Expected missing state update to be unavailable")
+	}
+	if len(suCh) != 0 || cache.Contains(block.Hash()) {
+		t.Errorf("Loading a missing state update should not regenerate it")
+	}
+	if _, err := regenerateAndStore(block); err != nil {
+		t.Fatalf("Error regenerating state update: %v", err.Error())
+	}
+	if len(suCh) != 1 {
+		t.Errorf("Expected regenerated state update to be queued for storage")
+	}
+	if su, err := loadStateUpdate(block); err != nil || len(su.Accounts) != 1 {
+		t.Errorf("Unexpected state update after regeneration: %v %v", su, err)
+	}
+}
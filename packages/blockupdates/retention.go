@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+)
+
+const (
+	// retentionForever keeps every canonical state update.
+	retentionForever = "forever"
+	// retentionBlocks keeps state updates for the most recent blocks.
+	retentionBlocks = "blocks"
+	// retentionBytes keeps as many recent state updates as fit in a budget.
+	retentionBytes = "bytes"
+
+	// canonicalDepth is how far below the head a record must be before we
+	// consider it safe to delete as non-canonical.
+	canonicalDepth = 128
+
+	collectionInterval = 10 * time.Minute
+)
+
+var (
+	retentionKey = []byte("blockupdates-retention")
+
+	retentionLock sync.Mutex
+	retention = retentionPolicy{Mode: retentionForever}
+	collectorStats gcStats
+	collectCh = make(chan struct{}, 1)
+)
+
+// retentionPolicy determines which stored state updates the collector keeps.
+type retentionPolicy struct {
+	Mode string `json:"mode"`
+	Blocks hexutil.Uint64 `json:"blocks,omitempty"`
+	Bytes hexutil.Uint64 `json:"bytes,omitempty"`
+}
+
+func (p *retentionPolicy) validate() error {
+	switch p.Mode {
+	case retentionForever:
+	case retentionBlocks:
+		if p.Blocks == 0 { return fmt.Errorf("blocks retention requires a number of blocks") }
+	case retentionBytes:
+		if p.Bytes == 0 { return fmt.Errorf("bytes retention requires a number of bytes") }
+	default:
+		return fmt.Errorf("unknown retention mode %q", p.Mode)
+	}
+	return nil
+}
+
+// gcStats reports what the collector found and removed on its last run.
+type gcStats struct {
+	Policy retentionPolicy `json:"policy"`
+	LastRun *time.Time `json:"lastRun,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Records hexutil.Uint64 `json:"records"`
+	Bytes hexutil.Uint64 `json:"bytes"`
+	FreezerTail hexutil.Uint64 `json:"freezerTail"`
+	FreezerHead hexutil.Uint64 `json:"freezerHead"`
+	FreezerBytes hexutil.Uint64 `json:"freezerBytes"`
+	DeletedExpired hexutil.Uint64 `json:"deletedExpired"`
+	DeletedNonCanonical hexutil.Uint64 `json:"deletedNonCanonical"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// loadRetentionPolicy restores the retention policy persisted in the database.
+func loadRetentionPolicy() {
+	data, err := backend.ChainDb().Get(retentionKey)
+	if err != nil || len(data) == 0 { return }
+	var p retentionPolicy
+	if err := json.Unmarshal(data, &p); err != nil || p.validate() != nil {
+		log.Warn("Ignoring invalid stored retention policy", "policy", string(data))
+		return
+	}
+	retentionLock.Lock()
+	retention = p
+	retentionLock.Unlock()
+}
+
+// runCollector enforces the retention policy periodically, or sooner if
+// requested through collectCh.
+func runCollector() {
+	loadRetentionPolicy()
+	ticker := time.NewTicker(collectionInterval)
+	defer ticker.Stop()
+	for {
+		collectStateUpdates()
+		select {
+		case <-ticker.C:
+		case <-collectCh:
+		}
+	}
+}
+
+// deleteBlockRecords deletes the records kept alongside a block's encoded
+// state update: its transaction state changes, reverse diff and history
+// entries. History entries are keyed by account, so they are found through
+// the state update rather than by scanning the index.
+func deleteBlockRecords(data []byte, number uint64, hash core.Hash) {
+	db := backend.ChainDb()
+	db.Delete(txChangesKey(number, hash))
+	db.Delete(reverseDiffKey(number, hash))
+	su := new(stateUpdate)
+	if err := rlp.DecodeBytes(data, su); err != nil {
+		log.Warn("Could not decode deleted state update, its history is kept", "number", number, "hash", hash, "err", err)
+		return
+	}
+	deleteHistory(db, su, number, hash)
+}
+
+// deleteFrozenRecords deletes the records kept alongside the frozen state
+// updates below the given number.
+func deleteFrozenRecords(to uint64) {
+	for n := suFreezer.Tail(); n < to && n < suFreezer.Head(); n++ {
+		item, err := suFreezer.Retrieve(n)
+		if err != nil || len(item) < 32 { continue }
+		deleteBlockRecords(item[32:], n, core.BytesToHash(item[:32]))
+	}
+}
+
+// truncateFreezerTail drops frozen state updates below tail, along with the
+// records kept alongside them.
+func truncateFreezerTail(tail uint64) error {
+	deleteFrozenRecords(tail)
+	return suFreezer.TruncateTail(tail)
+}
+
+// emptyFreezer drops every frozen state update, along with the records kept
+// alongside them.
+func emptyFreezer() error {
+	deleteFrozenRecords(suFreezer.Head())
+	return suFreezer.TruncateHead(suFreezer.Tail())
+}
+
+type storedRecord struct {
+	key []byte
+	size int
+}
+
+// collectStateUpdates deletes stored state updates that fall outside the
+// retention policy, along with records for blocks that are not canonical.
+func collectStateUpdates() {
+	start := time.Now()
+	retentionLock.Lock()
+	policy := retention
+	retentionLock.Unlock()
+	stats := gcStats{Policy: policy, LastRun: &start}
+	defer func() {
+		stats.Duration = time.Since(start).String()
+		retentionLock.Lock()
+		collectorStats = stats
+		retentionLock.Unlock()
+	}()
+	head, err := decodeHeader(backend.CurrentHeader())
+	if err != nil {
+		stats.LastError = err.Error()
+		return
+	}
+	headNumber := head.Number.Uint64()
+	var cutoff uint64
+	if policy.Mode == retentionBlocks && headNumber > uint64(policy.Blocks) {
+		cutoff = headNumber - uint64(policy.Blocks)
+	}
+	db := backend.ChainDb()
+	canonical := make(map[uint64]core.Hash)
+	var kept []storedRecord
+	var total uint64
+	it := db.NewIterator(suPrefix, nil)
+	for it.Next() {
+		number, hash, ok := parseSuKey(it.Key())
+		if !ok { continue }
+		key := append([]byte{}, it.Key()...)
+		if number < cutoff {
+			deleteBlockRecords(it.Value(), number, hash)
+			if err := db.Delete(key); err == nil { stats.DeletedExpired++ }
+			continue
+		}
+		if number + canonicalDepth <= headNumber {
+			canonicalHash, ok := canonical[number]
+			if !ok {
+				headerBytes, err := backend.HeaderByNumber(context.Background(), int64(number))
+				if err == nil {
+					if header, err := decodeHeader(headerBytes); err == nil {
+						canonicalHash = header.Hash()
+						canonical[number] = canonicalHash
+					}
+				}
+			}
+			if canonicalHash != (core.Hash{}) && canonicalHash != hash {
+				deleteBlockRecords(it.Value(), number, hash)
+				if err := db.Delete(key); err == nil { stats.DeletedNonCanonical++ }
+				continue
+			}
+		}
+		kept = append(kept, storedRecord{key, len(it.Value())})
+		total += uint64(len(it.Value()))
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		stats.LastError = err.Error()
+	}
+	// Transaction state changes and reverse diffs outlive their "su" records
+	// once those are frozen, so expire them separately. History entries of
+	// frozen records are removed as the freezer is truncated.
+	if cutoff > 0 {
+		expire := func(prefix []byte, parse func([]byte) (uint64, core.Hash, bool)) {
+			it := db.NewIterator(prefix, nil)
+			defer it.Release()
+			for it.Next() {
+				number, _, ok := parse(it.Key())
+				if !ok { continue }
+				if number >= cutoff { break }
+				db.Delete(append([]byte{}, it.Key()...))
+			}
+		}
+		expire(txChangesPrefix, parseTxChangesKey)
+		expire(reverseDiffPrefix, parseReverseDiffKey)
+	}
+	if suFreezer != nil {
+		switch policy.Mode {
+		case retentionBlocks:
+			if err := truncateFreezerTail(cutoff); err != nil { stats.LastError = err.Error() }
+		case retentionBytes:
+			// Frozen records are older than any in leveldb, so they go first,
+			// a data file at a time. If the newest data file is still too
+			// much, it goes too.
+			for suFreezer.Items() > 0 {
+				size, err := suFreezer.Size()
+				if err != nil || total + size <= uint64(policy.Bytes) { break }
+				next, ok := suFreezer.SecondFileTail()
+				if !ok {
+					err = emptyFreezer()
+				} else {
+					err = truncateFreezerTail(next)
+				}
+				if err != nil {
+					stats.LastError = err.Error()
+					break
+				}
+			}
+		}
+	}
+	var frozen uint64
+	if suFreezer != nil {
+		frozen, _ = suFreezer.Size()
+		stats.FreezerTail = hexutil.Uint64(suFreezer.Tail())
+		stats.FreezerHead = hexutil.Uint64(suFreezer.Head())
+		stats.FreezerBytes = hexutil.Uint64(frozen)
+	}
+	if policy.Mode == retentionBytes && (suFreezer == nil || suFreezer.Items() == 0) {
+		for len(kept) > 0 && total + frozen > uint64(policy.Bytes) {
+			if data, err := db.Get(kept[0].key); err == nil {
+				number, hash, _ := parseSuKey(kept[0].key)
+				deleteBlockRecords(data, number, hash)
+			}
+			if err := db.Delete(kept[0].key); err != nil { break }
+			total -= uint64(kept[0].size)
+			kept = kept[1:]
+			stats.DeletedExpired++
+		}
+	}
+	stats.Records = hexutil.Uint64(len(kept))
+	stats.Bytes = hexutil.Uint64(total)
+	log.Debug("Collected stored state updates", "expired", uint64(stats.DeletedExpired), "noncanonical", uint64(stats.DeletedNonCanonical), "records", len(kept))
+}
+
+// SetStateUpdateRetention sets and persists the retention policy for stored
+// state updates, and triggers a collection run to apply it.
+func (a *BlockUpdatesAdmin) SetStateUpdateRetention(policy retentionPolicy) (bool, error) {
+	if err := policy.validate(); err != nil { return false, err }
+	data, err := json.Marshal(policy)
+	if err != nil { return false, err }
+	if err := a.backend.ChainDb().Put(retentionKey, data); err != nil { return false, err }
+	retentionLock.Lock()
+	retention = policy
+	retentionLock.Unlock()
+	select {
+	case collectCh <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// StateUpdateRetentionStats reports the retention policy and the results of
+// the last collection run.
+func (a *BlockUpdatesAdmin) StateUpdateRetentionStats() gcStats {
+	retentionLock.Lock()
+	defer retentionLock.Unlock()
+	stats := collectorStats
+	stats.Policy = retention
+	return stats
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+func TestCollectHistory(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	oldRetention := retention
+	retention = retentionPolicy{Mode: retentionBlocks, Blocks: 10}
+	defer func() { retention = oldRetention }()
+	account := core.HexToHash("0x01")
+	write := func(block *types.Block) {
+		su, err := regenerateStateUpdate(block)
+		if err != nil {
+			t.Fatalf("Error regenerating state update: %v", err.Error())
+		}
+		indexBatch(writeBatch([]*stateUpdateWithBlock{{su: su, number: block.NumberU64(), hash: block.Hash()}}))
+	}
+	chain := []*types.Block{genesis}
+	for i := int64(1); i <= 140; i++ {
+		block := b.addBlock(chain[len(chain)-1], b.setState(map[core.Hash]*fullAccount{account: {Nonce: uint64(i), Balance: big.NewInt(i)}}, nil))
+		write(block)
+		chain = append(chain, block)
+	}
+	fork := b.addBlock(chain[134], b.setState(map[core.Hash]*fullAccount{account: {Nonce: 1000, Balance: big.NewInt(1000)}}, nil))
+	write(fork)
+	side := b.addBlock(chain[1], b.setState(map[core.Hash]*fullAccount{account: {Nonce: 2000, Balance: big.NewInt(2000)}}, nil))
+	write(side)
+	b.setCanonical(chain...)
+
+	collectStateUpdates()
+	var numbers []uint64
+	it := b.db.NewIterator(accountHistoryPrefix, account[:])
+	for it.Next() {
+		key := it.Key()[len(accountHistoryPrefix) + 32:]
+		number, hash := binary.BigEndian.Uint64(key[:8]), core.BytesToHash(key[8:])
+		if hash == side.Hash() {
+			t.Errorf("History of non-canonical block %v was kept", number)
+		}
+		numbers = append(numbers, number)
+	}
+	it.Release()
+	// Block 135 of the fork is too recent to be collected
+	if len(numbers) != 12 || numbers[0] != 130 || numbers[len(numbers)-1] != 140 {
+		t.Errorf("Unexpected history kept: %v", numbers)
+	}
+	if ok, _ := b.db.Has(accountHistoryKey(account, fork.NumberU64(), fork.Hash())); !ok {
+		t.Errorf("Recent fork history should be kept")
+	}
+}
+
+func TestCollectBytes(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	oldRetention, oldFreezer := retention, suFreezer
+	f, err := openFreezer(t.TempDir(), "stateupdates")
+	if err != nil {
+		t.Fatalf("Error opening freezer: %v", err.Error())
+	}
+	f.maxFileSize = 1
+	suFreezer = f
+	defer func() {
+		f.Close()
+		retention, suFreezer = oldRetention, oldFreezer
+	}()
+	account := core.HexToHash("0x01")
+	chain := []*types.Block{genesis}
+	for i := int64(1); i <= 10; i++ {
+		block := b.addBlock(chain[len(chain)-1], b.setState(map[core.Hash]*fullAccount{account: {Nonce: uint64(i), Balance: big.NewInt(i)}}, nil))
+		su, err := regenerateStateUpdate(block)
+		if err != nil {
+			t.Fatalf("Error regenerating state update: %v", err.Error())
+		}
+		indexBatch(writeBatch([]*stateUpdateWithBlock{{su: su, number: block.NumberU64(), hash: block.Hash()}}))
+		chain = append(chain, block)
+	}
+	for _, block := range chain[:6] {
+		freezeStateUpdate(&ancientBlock{block.NumberU64(), block.Hash()})
+	}
+	if ok, _ := b.db.Has(reverseDiffKey(3, chain[3].Hash())); !ok {
+		t.Fatalf("Expected a reverse diff for block 3")
+	}
+	var recent uint64
+	for _, block := range chain[6:] {
+		data, err := b.db.Get(suKey(block.NumberU64(), block.Hash()))
+		if err != nil {
+			t.Fatalf("Missing state update %v", block.NumberU64())
+		}
+		recent += uint64(len(data))
+	}
+	stored := func() []uint64 {
+		var numbers []uint64
+		for _, block := range chain[1:] {
+			if ok, _ := b.db.Has(suKey(block.NumberU64(), block.Hash())); ok {
+				numbers = append(numbers, block.NumberU64())
+			}
+		}
+		return numbers
+	}
+
+	// The frozen records are the oldest, so they all go before any recent
+	// record, even though the newest frozen file can only go with the rest.
+	// The budget leaves room for an empty freezer, but not for a record.
+	retention = retentionPolicy{Mode: retentionBytes, Bytes: hexutil.Uint64(recent + 64)}
+	collectStateUpdates()
+	if f.Items() != 0 {
+		t.Errorf("Expected frozen state updates to be dropped, %v left", f.Items())
+	}
+	if numbers := stored(); len(numbers) != 5 || numbers[0] != 6 {
+		t.Errorf("Unexpected recent state updates kept: %v", numbers)
+	}
+	if ok, _ := b.db.Has(reverseDiffKey(3, chain[3].Hash())); ok {
+		t.Errorf("Reverse diff of a dropped frozen block was kept")
+	}
+
+	empty, _ := f.Size()
+	retention = retentionPolicy{Mode: retentionBytes, Bytes: hexutil.Uint64(recent + empty - 1)}
+	collectStateUpdates()
+	if numbers := stored(); len(numbers) != 4 || numbers[0] != 7 {
+		t.Errorf("Expected the oldest recent state update to go: %v", numbers)
+	}
+
+	// Freezing continues after the freezer has been emptied
+	freezeStateUpdate(&ancientBlock{7, chain[7].Hash()})
+	if f.Tail() != 7 || f.Head() != 8 {
+		t.Errorf("Unexpected freezer bounds %v - %v", f.Tail(), f.Head())
+	}
+}
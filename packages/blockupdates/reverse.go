@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+)
+
+var (
+	// reverseDiffPrefix holds the reverse diff of each block: the inverse of
+	// its state update, with the values its changes replaced. Keyed by number
+	// and hash like the "su" records.
+	reverseDiffPrefix = []byte("sr")
+	indexedRangeKey = []byte("blockupdates-indexed")
+
+	indexedLock sync.Mutex
+	indexed *indexedRange
+)
+
+// indexedRange is the stretch of the canonical chain, from Low through High,
+// whose reverse diffs and history entries are all stored. Historical state
+// queries are anchored at High, whose hash is Hash, and can reach back to the
+// state at block Low - 1. The range is empty when Low is High + 1.
+type indexedRange struct {
+	Low uint64
+	High uint64
+	Hash core.Hash
+}
+
+func storeIndexedRange(r *indexedRange) {
+	data, err := rlp.EncodeToBytes(r)
+	if err == nil {
+		err = backend.ChainDb().Put(indexedRangeKey, data)
+	}
+	if err != nil {
+		log.Warn("Failed to store indexed state history range", "err", err)
+	}
+}
+
+// loadIndexedRange restores the indexed range. The first time, it is found
+// by walking back from the most recent stored state update for as long as
+// blocks have both a state update and a reverse diff.
+func loadIndexedRange() {
+	db := backend.ChainDb()
+	if data, err := db.Get(indexedRangeKey); err == nil {
+		r := new(indexedRange)
+		if err := rlp.DecodeBytes(data, r); err == nil {
+			indexedLock.Lock()
+			indexed = r
+			indexedLock.Unlock()
+			return
+		}
+	}
+	head, err := decodeHeader(backend.CurrentHeader())
+	if err != nil {
+		log.Error("Could not find indexed state history range", "err", err)
+		return
+	}
+	r := &indexedRange{Low: head.Number.Uint64() + 1, High: head.Number.Uint64(), Hash: head.Hash()}
+	indexedBlock := func(n uint64) (core.Hash, bool) {
+		hash, err := canonicalHash(n)
+		if err != nil || !hasStoredStateUpdate(n, hash) { return hash, false }
+		ok, err := db.Has(reverseDiffKey(n, hash))
+		return hash, err == nil && ok
+	}
+	for n := r.High; n > 0 && n + canonicalDepth > r.High; n-- {
+		if hash, ok := indexedBlock(n); ok {
+			r.Low, r.High, r.Hash = n, n, hash
+			break
+		}
+	}
+	for r.Low > 1 {
+		if _, ok := indexedBlock(r.Low - 1); !ok { break }
+		r.Low--
+	}
+	log.Info("Indexed state history range", "from", r.Low, "to", r.High)
+	indexedLock.Lock()
+	defer indexedLock.Unlock()
+	if indexed == nil {
+		indexed = r
+		storeIndexedRange(r)
+	}
+}
+
+// advanceIndexedRange extends the indexed range along the canonical chain, up
+// to block limit, as blocks are indexed, first stepping back off any blocks a
+// reorg removed. A block that is still missing its reverse diff once it is
+// canonicalDepth blocks below limit will not be indexed by the normal flow, so
+// the range restarts after it.
+func advanceIndexedRange(limit uint64) {
+	indexedLock.Lock()
+	defer indexedLock.Unlock()
+	if indexed == nil { return }
+	head, err := decodeHeader(backend.CurrentHeader())
+	if err != nil { return }
+	if head.Number.Uint64() < limit {
+		limit = head.Number.Uint64()
+	}
+	r := *indexed
+	for r.High > 0 {
+		if hash, err := canonicalHash(r.High); err != nil || hash == r.Hash { break }
+		headerBytes, err := backend.HeaderByHash(context.Background(), r.Hash)
+		if err != nil { return }
+		header, err := decodeHeader(headerBytes)
+		if err != nil { return }
+		r.High, r.Hash = r.High - 1, header.ParentHash
+		if r.Low > r.High + 1 {
+			r.Low = r.High + 1
+		}
+	}
+	for r.High < limit {
+		n := r.High + 1
+		headerBytes, err := backend.HeaderByNumber(context.Background(), int64(n))
+		if err != nil { break }
+		header, err := decodeHeader(headerBytes)
+		if err != nil || header.ParentHash != r.Hash { break }
+		if ok, err := backend.ChainDb().Has(reverseDiffKey(n, header.Hash())); err != nil || !ok {
+			if n + canonicalDepth > limit { break }
+			log.Warn("State history is missing a block, older state can no longer be queried", "number", n)
+			r.Low = n + 1
+		}
+		r.High, r.Hash = n, header.Hash()
+	}
+	if r != *indexed {
+		indexed = &r
+		storeIndexedRange(&r)
+	}
+}
+
+func reverseDiffKey(number uint64, hash core.Hash) []byte {
+	key := make([]byte, suKeyLength)
+	copy(key, reverseDiffPrefix)
+	binary.BigEndian.PutUint64(key[2:10], number)
+	copy(key[10:], hash.Bytes())
+	return key
+}
+
+func parseReverseDiffKey(key []byte) (uint64, core.Hash, bool) {
+	if len(key) != suKeyLength || !bytes.HasPrefix(key, reverseDiffPrefix) {
+		return 0, core.Hash{}, false
+	}
+	return binary.BigEndian.Uint64(key[2:10]), core.BytesToHash(key[10:]), true
+}
+
+// storeReverseDiff computes and stores the reverse diff of a block from its
+// parent's state. This happens as state updates are written, shortly after
+// StateUpdate fires, while the parent state is still available.
+func storeReverseDiff(su *stateUpdate, number uint64, hash core.Hash) (*stateUpdate, error) {
+	headerBytes, err := backend.HeaderByHash(context.Background(), hash)
+	if err != nil { return nil, err }
+	header, err := decodeHeader(headerBytes)
+	if err != nil { return nil, err }
+	parentBytes, err := backend.HeaderByHash(context.Background(), header.ParentHash)
+	if err != nil { return nil, err }
+	parent, err := decodeHeader(parentBytes)
+	if err != nil { return nil, err }
+	reverse, err := invertStateUpdate(su, parent.Root)
+	if err != nil { return nil, err }
+	data, err := encodeStoredStateUpdate(reverse)
+	if err != nil { return nil, err }
+	if err := backend.ChainDb().Put(reverseDiffKey(number, hash), data); err != nil { return nil, err }
+	return reverse, nil
+}
+
+func loadReverseDiff(number uint64, hash core.Hash) (*stateUpdate, error) {
+	data, err := backend.ChainDb().Get(reverseDiffKey(number, hash))
+	if err != nil { return nil, err }
+	reverse := new(stateUpdate)
+	if err := rlp.DecodeBytes(data, reverse); err != nil { return nil, err }
+	return reverse, nil
+}
+
+// firstChange finds the first canonical block from `from` to `to` with a
+// history entry under prefix accepted by match.
+func firstChange(ctx context.Context, prefix []byte, from, to uint64, match func(*historyEntry) bool) (uint64, core.Hash, bool, error) {
+	it := backend.ChainDb().NewIterator(prefix, binary.BigEndian.AppendUint64(nil, from))
+	defer it.Release()
+	for it.Next() {
+		if err := ctx.Err(); err != nil { return 0, core.Hash{}, false, err }
+		key := it.Key()
+		if len(key) != len(prefix) + 40 { continue }
+		number := binary.BigEndian.Uint64(key[len(prefix):])
+		hash := core.BytesToHash(key[len(prefix) + 8:])
+		if number > to { break }
+		if canonical, err := canonicalHash(number); err != nil || canonical != hash { continue }
+		var entry historyEntry
+		if err := rlp.DecodeBytes(it.Value(), &entry); err != nil { return 0, core.Hash{}, false, err }
+		if match(&entry) { return number, hash, true, nil }
+	}
+	return 0, core.Hash{}, false, nil
+}
+
+// historicalState answers a query about the state at a past block by walking
+// back from the top of the indexed range: the value at the block is the value
+// there, unless a later block changed it, in which case it is the value the
+// first such change replaced, as recorded in that block's reverse diff.
+// Blocks at or above the top of the indexed range are read from their own
+// state, which the node still has.
+type historicalState struct {
+	head *stateReader
+	headNumber uint64
+	number uint64
+}
+
+func openHistoricalState(b restricted.Backend, number restricted.BlockNumber) (*historicalState, error) {
+	head, err := decodeHeader(b.CurrentHeader())
+	if err != nil { return nil, err }
+	hs := &historicalState{headNumber: head.Number.Uint64(), number: uint64(number)}
+	if number < 0 || hs.number > hs.headNumber {
+		hs.number = hs.headNumber
+	}
+	indexedLock.Lock()
+	var r indexedRange
+	ready := indexed != nil
+	if ready {
+		r = *indexed
+	}
+	indexedLock.Unlock()
+	if !ready || hs.number >= r.High {
+		headerBytes, err := b.HeaderByNumber(context.Background(), int64(hs.number))
+		if err != nil { return nil, err }
+		header, err := decodeHeader(headerBytes)
+		if err != nil { return nil, err }
+		if hs.head, err = openState(header.Root); err != nil {
+			return nil, fmt.Errorf("state at block %v is unavailable: %v", hs.number, err)
+		}
+		hs.headNumber = hs.number
+		return hs, nil
+	}
+	if hs.number + 1 < r.Low {
+		return nil, fmt.Errorf("state at block %v is older than the indexed state history, which starts at block %v", hs.number, r.Low - 1)
+	}
+	if hash, err := canonicalHash(r.High); err != nil || hash != r.Hash {
+		return nil, fmt.Errorf("state history is catching up with a reorg")
+	}
+	// The indexed range is contiguous, so if the oldest reverse diff we need
+	// has not been expired, neither have the rest.
+	hash, err := canonicalHash(hs.number + 1)
+	if err != nil { return nil, err }
+	if ok, err := b.ChainDb().Has(reverseDiffKey(hs.number + 1, hash)); err != nil || !ok {
+		return nil, fmt.Errorf("state at block %v is older than the retained reverse diffs", hs.number)
+	}
+	headerBytes, err := b.HeaderByHash(context.Background(), r.Hash)
+	if err != nil { return nil, err }
+	header, err := decodeHeader(headerBytes)
+	if err != nil { return nil, err }
+	if hs.head, err = openState(header.Root); err != nil {
+		return nil, fmt.Errorf("state at indexed block %v is unavailable: %v", r.High, err)
+	}
+	hs.headNumber = r.High
+	return hs, nil
+}
+
+// account returns the slim encoded account, or nil if it did not exist.
+func (hs *historicalState) account(ctx context.Context, account core.Hash) ([]byte, error) {
+	if hs.number == hs.headNumber { return hs.head.SlimAccount(account) }
+	prefix := append(append([]byte{}, accountHistoryPrefix...), account[:]...)
+	number, hash, ok, err := firstChange(ctx, prefix, hs.number + 1, hs.headNumber, func(*historyEntry) bool { return true })
+	if err != nil { return nil, err }
+	if !ok { return hs.head.SlimAccount(account) }
+	reverse, err := loadReverseDiff(number, hash)
+	if err != nil { return nil, err }
+	return reverse.Accounts[account], nil
+}
+
+// storage returns the RLP encoded value of a slot, or nil if it was empty.
+// Besides writes to the slot, destroying the account changes it, so the
+// first of either is used.
+func (hs *historicalState) storage(ctx context.Context, account, slot core.Hash) ([]byte, error) {
+	if hs.number == hs.headNumber { return hs.head.Storage(account, slot) }
+	slotPrefix := append(append(append([]byte{}, storageHistoryPrefix...), account[:]...), slot[:]...)
+	number, hash, ok, err := firstChange(ctx, slotPrefix, hs.number + 1, hs.headNumber, func(*historyEntry) bool { return true })
+	if err != nil { return nil, err }
+	to := hs.headNumber
+	if ok {
+		to = number - 1
+	}
+	accountPrefix := append(append([]byte{}, accountHistoryPrefix...), account[:]...)
+	if destructNumber, destructHash, destructed, err := firstChange(ctx, accountPrefix, hs.number + 1, to, func(e *historyEntry) bool { return e.Destructed }); err != nil {
+		return nil, err
+	} else if destructed {
+		number, hash, ok = destructNumber, destructHash, true
+	}
+	if !ok { return hs.head.Storage(account, slot) }
+	reverse, err := loadReverseDiff(number, hash)
+	if err != nil { return nil, err }
+	return reverse.Storage[account][slot], nil
+}
+
+// GetBalanceAt returns the balance of an account at a past block, using a
+// recent state and retained reverse diffs rather than historical tries, so it
+// works on nodes that have pruned old state.
+func (b *BlockUpdates) GetBalanceAt(ctx context.Context, address core.Address, number restricted.BlockNumber) (*hexutil.Big, error) {
+	hs, err := openHistoricalState(b.backend, number)
+	if err != nil { return nil, err }
+	data, err := hs.account(ctx, crypto.Keccak256Hash(address[:]))
+	if err != nil || len(data) == 0 { return (*hexutil.Big)(new(big.Int)), err }
+	acct, err := fullAccountFromSlim(data)
+	if err != nil { return nil, err }
+	return (*hexutil.Big)(acct.Balance), nil
+}
+
+// GetNonceAt returns the nonce of an account at a past block. See GetBalanceAt.
+func (b *BlockUpdates) GetNonceAt(ctx context.Context, address core.Address, number restricted.BlockNumber) (hexutil.Uint64, error) {
+	hs, err := openHistoricalState(b.backend, number)
+	if err != nil { return 0, err }
+	data, err := hs.account(ctx, crypto.Keccak256Hash(address[:]))
+	if err != nil || len(data) == 0 { return 0, err }
+	acct, err := fullAccountFromSlim(data)
+	if err != nil { return 0, err }
+	return hexutil.Uint64(acct.Nonce), nil
+}
+
+// GetStorageAt returns the value of a storage slot at a past block. See
+// GetBalanceAt.
+func (b *BlockUpdates) GetStorageAt(ctx context.Context, address core.Address, slot core.Hash, number restricted.BlockNumber) (core.Hash, error) {
+	hs, err := openHistoricalState(b.backend, number)
+	if err != nil { return core.Hash{}, err }
+	data, err := hs.storage(ctx, crypto.Keccak256Hash(address[:]), crypto.Keccak256Hash(slot[:]))
+	if err != nil || len(data) == 0 { return core.Hash{}, err }
+	_, content, _, err := rlp.Split(data)
+	if err != nil { return core.Hash{}, err }
+	return core.BytesToHash(content), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+func TestHistoricalState(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	account, other, slot := core.HexToHash("0x01"), core.HexToHash("0x02"), core.HexToHash("0x10")
+	states := []struct{
+		accounts map[core.Hash]*fullAccount
+		storage map[core.Hash]map[core.Hash][]byte
+	}{
+		{map[core.Hash]*fullAccount{account: {Nonce: 1, Balance: big.NewInt(100)}}, map[core.Hash]map[core.Hash][]byte{account: {slot: {0x01}}}},
+		// A write
+		{map[core.Hash]*fullAccount{account: {Nonce: 2, Balance: big.NewInt(90)}}, map[core.Hash]map[core.Hash][]byte{account: {slot: {0x02}}}},
+		// A destruct
+		{map[core.Hash]*fullAccount{other: {Balance: big.NewInt(1)}}, nil},
+		// Recreated without storage
+		{map[core.Hash]*fullAccount{account: {Balance: big.NewInt(5)}, other: {Balance: big.NewInt(1)}}, nil},
+		{map[core.Hash]*fullAccount{account: {Balance: big.NewInt(5)}, other: {Balance: big.NewInt(2)}}, nil},
+	}
+	chain := []*types.Block{genesis}
+	write := func(block *types.Block) {
+		su, err := regenerateStateUpdate(block)
+		if err != nil {
+			t.Fatalf("Error regenerating state update: %v", err.Error())
+		}
+		indexBatch(writeBatch([]*stateUpdateWithBlock{{su: su, number: block.NumberU64(), hash: block.Hash()}}))
+	}
+	for i, state := range states {
+		block := b.addBlock(chain[len(chain)-1], b.setState(state.accounts, state.storage))
+		write(block)
+		chain = append(chain, block)
+		if i == 1 {
+			loadIndexedRange()
+			if indexed == nil || indexed.Low != 1 || indexed.High != 2 {
+				t.Fatalf("Unexpected indexed range %v", indexed)
+			}
+		}
+	}
+	advanceIndexedRange(chain[5].NumberU64())
+	if indexed.Low != 1 || indexed.High != 5 || indexed.Hash != chain[5].Hash() {
+		t.Fatalf("Unexpected indexed range %v", indexed)
+	}
+	// Older states are pruned, so queries have to use the reverse diffs
+	for _, block := range chain[:5] {
+		delete(b.tries, block.Root())
+	}
+
+	accounts := []*fullAccount{nil, {Nonce: 1, Balance: big.NewInt(100)}, {Nonce: 2, Balance: big.NewInt(90)}, nil, {Balance: big.NewInt(5)}, {Balance: big.NewInt(5)}}
+	slots := [][]byte{nil, {0x01}, {0x02}, nil, nil, nil}
+	for n := range accounts {
+		hs, err := openHistoricalState(b, restricted.BlockNumber(n))
+		if err != nil {
+			t.Fatalf("Error opening state at block %v: %v", n, err.Error())
+		}
+		acct, err := hs.account(context.Background(), account)
+		if err != nil {
+			t.Fatalf("Error getting account at block %v: %v", n, err.Error())
+		}
+		if expected := accounts[n]; expected == nil {
+			if acct != nil {
+				t.Errorf("Expected no account at block %v, got %x", n, acct)
+			}
+		} else if full, err := fullAccountFromSlim(acct); err != nil || full.Nonce != expected.Nonce || full.Balance.Cmp(expected.Balance) != 0 {
+			t.Errorf("Unexpected account at block %v: %x", n, acct)
+		}
+		value, err := hs.storage(context.Background(), account, slot)
+		if err != nil {
+			t.Fatalf("Error getting storage at block %v: %v", n, err.Error())
+		}
+		if !bytes.Equal(value, slots[n]) {
+			t.Errorf("Unexpected storage at block %v: %x", n, value)
+		}
+	}
+
+	// Blocks before a gap in the index can't be answered
+	indexed.Low = 3
+	if _, err := openHistoricalState(b, 1); err == nil {
+		t.Errorf("Expected an error for state before the indexed range")
+	}
+}
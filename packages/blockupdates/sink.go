@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+const (
+	sinkFile = "file"
+	sinkUnix = "unix"
+	sinkWebhook = "webhook"
+
+	sinkTimeout = 30 * time.Second
+	sinkMaxBackoff = time.Minute
+	sinkPollInterval = time.Minute
+)
+
+var (
+	sinkConfigKey = []byte("blockupdates-sinks")
+	sinkOffsetPrefix = []byte("blockupdates-sink-")
+
+	sinksLock sync.Mutex
+	sinks = make(map[string]*sinkRunner)
+)
+
+// sink delivers serialized block updates messages to a downstream system. A
+// nil error from Send means the message has been durably accepted.
+type sink interface {
+	Send(ctx context.Context, data []byte) error
+	Close() error
+}
+
+// sinkConfig describes an outbound sink. Target is a file path for file
+// sinks, a socket path for unix sinks and a URL for webhook sinks. From is
+// the first block to deliver when the sink is created; by default delivery
+// starts after the current head. Genesis has no state update, so a From of 0
+// starts delivery at block 1.
+type sinkConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Target string `json:"target"`
+	From *hexutil.Uint64 `json:"from,omitempty"`
+	Filter *blockUpdatesFilter `json:"filter,omitempty"`
+	Decoded bool `json:"decoded,omitempty"`
+	Attribution bool `json:"attribution,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+func (c *sinkConfig) open() (sink, error) {
+	if c.Name == "" { return nil, fmt.Errorf("sink name required") }
+	if c.Target == "" { return nil, fmt.Errorf("sink target required") }
+	if err := validateFormat(c.Format); err != nil { return nil, err }
+	switch c.Type {
+	case sinkFile:
+		return &fileSink{path: c.Target}, nil
+	case sinkUnix:
+		return &unixSink{path: c.Target}, nil
+	case sinkWebhook:
+		return &webhookSink{url: c.Target, client: &http.Client{Timeout: sinkTimeout}}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", c.Type)
+}
+
+// fileSink appends each message as a line to a file, syncing after every
+// write.
+type fileSink struct {
+	path string
+	file *os.File
+}
+
+func (s *fileSink) Send(ctx context.Context, data []byte) error {
+	if s.file == nil {
+		file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil { return err }
+		s.file = file
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		s.Close()
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *fileSink) Close() error {
+	if s.file == nil { return nil }
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// unixSink writes each message as a line to a unix socket, reconnecting
+// whenever a write fails.
+type unixSink struct {
+	path string
+	conn net.Conn
+}
+
+func (s *unixSink) Send(ctx context.Context, data []byte) error {
+	if s.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "unix", s.path)
+		if err != nil { return err }
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+	if _, err := s.conn.Write(append(data, '\n')); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *unixSink) Close() error {
+	if s.conn == nil { return nil }
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// webhookSink POSTs each message to a URL. Any 2xx response counts as
+// delivered.
+type webhookSink struct {
+	url string
+	client *http.Client
+}
+
+func (s *webhookSink) Send(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil { return err }
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// sinkOffset is the last block delivered to a sink.
+type sinkOffset struct {
+	Number uint64
+	Hash core.Hash
+}
+
+func sinkOffsetKey(name string) []byte {
+	return append(append([]byte{}, sinkOffsetPrefix...), []byte(name)...)
+}
+
+func loadSinkOffset(name string) (*sinkOffset, error) {
+	data, err := backend.ChainDb().Get(sinkOffsetKey(name))
+	if err != nil { return nil, err }
+	offset := &sinkOffset{}
+	if err := rlp.DecodeBytes(data, offset); err != nil { return nil, err }
+	return offset, nil
+}
+
+func storeSinkOffset(name string, offset *sinkOffset) error {
+	data, err := rlp.EncodeToBytes(offset)
+	if err != nil { return err }
+	return backend.ChainDb().Put(sinkOffsetKey(name), data)
+}
+
+func loadSinkConfigs() ([]*sinkConfig, error) {
+	data, err := backend.ChainDb().Get(sinkConfigKey)
+	if err != nil || len(data) == 0 { return nil, nil }
+	var configs []*sinkConfig
+	if err := json.Unmarshal(data, &configs); err != nil { return nil, err }
+	return configs, nil
+}
+
+// storeSinkConfigs persists the configuration of the running sinks. The
+// caller must hold sinksLock.
+func storeSinkConfigs() error {
+	configs := make([]*sinkConfig, 0, len(sinks))
+	for _, r := range sinks {
+		configs = append(configs, r.config)
+	}
+	data, err := json.Marshal(configs)
+	if err != nil { return err }
+	return backend.ChainDb().Put(sinkConfigKey, data)
+}
+
+// canonicalHash returns the hash of the canonical block at a height.
+func canonicalHash(number uint64) (core.Hash, error) {
+	headerBytes, err := backend.HeaderByNumber(context.Background(), int64(number))
+	if err != nil { return core.Hash{}, err }
+	header, err := decodeHeader(headerBytes)
+	if err != nil { return core.Hash{}, err }
+	return header.Hash(), nil
+}
+
+// sinkStatus reports the delivery progress of a sink.
+type sinkStatus struct {
+	Config *sinkConfig `json:"config"`
+	Number hexutil.Uint64 `json:"number"`
+	Hash core.Hash `json:"hash"`
+	Delivered hexutil.Uint64 `json:"delivered"`
+	Skipped hexutil.Uint64 `json:"skipped"`
+	LastSkipped *hexutil.Uint64 `json:"lastSkipped,omitempty"`
+	LastDelivery *time.Time `json:"lastDelivery,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// sinkRunner delivers block updates to a sink in block order. It works from
+// the persisted offset rather than the contents of the feed, so whether it
+// is catching up after a restart, recovering from a failed delivery or
+// following the head, it does the same thing: revert any delivered blocks
+// that are no longer canonical, then deliver canonical blocks up to the head.
+// The offset is only advanced after the sink accepts a message, so messages
+// may be delivered more than once but never skipped, other than for blocks
+// whose state update is unavailable, which are counted in the status.
+type sinkRunner struct {
+	config *sinkConfig
+	sink sink
+	stop chan struct{}
+	done chan struct{}
+
+	lock sync.Mutex
+	status sinkStatus
+}
+
+func newSinkRunner(config *sinkConfig) (*sinkRunner, error) {
+	s, err := config.open()
+	if err != nil { return nil, err }
+	if config.Filter != nil {
+		config.Filter.compile()
+	}
+	return &sinkRunner{
+		config: config,
+		sink: s,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		status: sinkStatus{Config: config},
+	}, nil
+}
+
+func (r *sinkRunner) run() {
+	defer close(r.done)
+	defer r.sink.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	// The feed only wakes us up, so it must never block on a slow sink
+	wake := make(chan struct{}, 1)
+	events := make(chan map[string]interface{}, 16)
+	sub := blockEvents.Subscribe(events)
+	defer sub.Unsubscribe()
+	go func() {
+		for {
+			select {
+			case <-events:
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	backoff := time.Second
+	for {
+		wait := sinkPollInterval
+		if err := r.sync(ctx); err != nil {
+			if ctx.Err() != nil { return }
+			r.lock.Lock()
+			r.status.LastError = err.Error()
+			r.lock.Unlock()
+			log.Warn("Block updates sink delivery failed", "sink", r.config.Name, "err", err, "retry", backoff)
+			wait = backoff
+			if backoff *= 2; backoff > sinkMaxBackoff {
+				backoff = sinkMaxBackoff
+			}
+		} else {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (r *sinkRunner) deliver(ctx context.Context, msg map[string]interface{}, offset *sinkOffset) error {
+	if skipped(msg) {
+		if err := storeSinkOffset(r.config.Name, offset); err != nil { return err }
+		number := hexutil.Uint64(offset.Number)
+		r.lock.Lock()
+		r.status.Number = number
+		r.status.Hash = offset.Hash
+		r.status.Skipped++
+		r.status.LastSkipped = &number
+		r.lock.Unlock()
+		return nil
+	}
+	msg, err := (&viewOptions{Decoded: r.config.Decoded, Attribution: r.config.Attribution, Format: r.config.Format}).present(r.config.Filter.apply(msg), r.config.Filter)
+	if err != nil { return err }
+	if msg != nil {
+		data, err := json.Marshal(msg)
+		if err != nil { return err }
+		if err := r.sink.Send(ctx, data); err != nil { return err }
+	}
+	if err := storeSinkOffset(r.config.Name, offset); err != nil { return err }
+	now := time.Now()
+	r.lock.Lock()
+	r.status.Number = hexutil.Uint64(offset.Number)
+	r.status.Hash = offset.Hash
+	r.status.Delivered++
+	r.status.LastDelivery = &now
+	r.status.LastError = ""
+	r.lock.Unlock()
+	return nil
+}
+
+// sync brings the sink up to date with the canonical chain.
+func (r *sinkRunner) sync(ctx context.Context) error {
+	offset, err := loadSinkOffset(r.config.Name)
+	if err != nil { return fmt.Errorf("could not load offset: %v", err) }
+	r.lock.Lock()
+	r.status.Number = hexutil.Uint64(offset.Number)
+	r.status.Hash = offset.Hash
+	r.lock.Unlock()
+	head, err := decodeHeader(backend.CurrentHeader())
+	if err != nil { return err }
+	_, err = followCanonical(ctx, offset, head.Number.Uint64(), r.deliver)
+	return err
+}
+
+// skippedBlockUpdates builds the message passed to deliver in place of the
+// block updates for a canonical block whose state update is unavailable and
+// cannot be regenerated.
+func skippedBlockUpdates(block *types.Block, err error) map[string]interface{} {
+	return map[string]interface{}{
+		"hash": block.Hash(),
+		"number": (*hexutil.Big)(block.Number()),
+		"parentHash": block.ParentHash(),
+		"skipped": true,
+		"error": err.Error(),
+	}
+}
+
+func skipped(msg map[string]interface{}) bool {
+	s, _ := msg["skipped"].(bool)
+	return s
+}
+
+// followCanonical delivers the messages that take a consumer from offset to
+// the canonical block at target: a removed message for each delivered block
+// that is no longer canonical, then the canonical blocks up to target. The
+// offset after each message is passed to deliver, and the final offset is
+// returned. An offset at block 0 without a hash, as stored by earlier
+// versions for sinks starting at genesis, is taken to be the genesis block.
+//
+// A block without a stored state update is regenerated if the node still has
+// its state. Otherwise it is logged and passed to deliver as a skipped block
+// message, so that one missing record cannot hold the consumer up forever.
+func followCanonical(ctx context.Context, offset *sinkOffset, target uint64, deliver func(context.Context, map[string]interface{}, *sinkOffset) error) (*sinkOffset, error) {
+	for {
+		for {
+			if err := ctx.Err(); err != nil { return offset, err }
+			hash, err := canonicalHash(offset.Number)
+			if err == nil && hash == offset.Hash { break }
+			if offset.Number == 0 {
+				if err != nil { return offset, err }
+				if offset.Hash != (core.Hash{}) { return offset, fmt.Errorf("offset %#x is not the genesis block", offset.Hash) }
+				offset = &sinkOffset{0, hash}
+				break
+			}
+			msg, err := removedBlockUpdates(ctx, offset.Hash)
+			if err != nil { return offset, err }
+			parent, _ := msg["parentHash"].(core.Hash)
+			next := &sinkOffset{offset.Number - 1, parent}
+			if err := deliver(ctx, msg, next); err != nil { return offset, err }
+			offset = next
+		}
+		reorged := false
+		for n := offset.Number + 1; n <= target && !reorged; n++ {
+			if err := ctx.Err(); err != nil { return offset, err }
+			blockBytes, err := backend.BlockByNumber(ctx, int64(n))
+			if err != nil { return offset, err }
+			var block types.Block
+			if err := rlp.DecodeBytes(blockBytes, &block); err != nil { return offset, err }
+			if block.ParentHash() != offset.Hash {
+				// A reorg happened under us; revert to the new chain and
+				// start over from there
+				reorged = true
+				continue
+			}
+			next := &sinkOffset{n, block.Hash()}
+			if _, err := loadStateUpdate(&block); err != nil {
+				if _, err := regenerateAndStore(&block); err != nil {
+					log.Error("State update unavailable, skipping block", "number", n, "hash", block.Hash(), "err", err)
+					if err := deliver(ctx, skippedBlockUpdates(&block, err), next); err != nil { return offset, err }
+					offset = next
+					continue
+				}
+				log.Info("Regenerated missing state update", "number", n, "hash", block.Hash())
+			}
+			msg, err := blockUpdates(ctx, &block)
+			if err != nil { return offset, fmt.Errorf("block %v: %v", n, err) }
+			if err := deliver(ctx, msg, next); err != nil { return offset, err }
+			offset = next
+		}
+		if !reorged { return offset, nil }
+	}
+}
+
+// initialSinkOffset returns the offset a new sink starts from: the block
+// before from, or the current head if from is not set. Genesis has no state
+// update to deliver, so a sink starting from block 0 starts after genesis.
+func initialSinkOffset(from *hexutil.Uint64) (*sinkOffset, error) {
+	if from == nil {
+		head, err := decodeHeader(backend.CurrentHeader())
+		if err != nil { return nil, err }
+		return &sinkOffset{head.Number.Uint64(), head.Hash()}, nil
+	}
+	offset := &sinkOffset{}
+	if *from > 0 {
+		offset.Number = uint64(*from) - 1
+	}
+	var err error
+	if offset.Hash, err = canonicalHash(offset.Number); err != nil { return nil, err }
+	return offset, nil
+}
+
+func (r *sinkRunner) close() {
+	close(r.stop)
+	<-r.done
+}
+
+// startSinks resumes delivery to the sinks configured before a restart.
+func startSinks() {
+	configs, err := loadSinkConfigs()
+	if err != nil {
+		log.Error("Failed to load block updates sinks", "err", err)
+		return
+	}
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	for _, config := range configs {
+		r, err := newSinkRunner(config)
+		if err != nil {
+			log.Error("Failed to open block updates sink", "sink", config.Name, "err", err)
+			continue
+		}
+		sinks[config.Name] = r
+		go r.run()
+		log.Info("Resumed block updates sink", "sink", config.Name, "type", config.Type)
+	}
+}
+
+// AddBlockUpdatesSink starts delivering block updates to a new sink. The sink
+// is persisted and resumes from where it left off after a restart.
+func (a *BlockUpdatesAdmin) AddBlockUpdatesSink(config sinkConfig) (bool, error) {
+	r, err := newSinkRunner(&config)
+	if err != nil { return false, err }
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	if _, ok := sinks[config.Name]; ok { return false, fmt.Errorf("sink %q already exists", config.Name) }
+	offset, err := initialSinkOffset(config.From)
+	if err != nil { return false, err }
+	if err := storeSinkOffset(config.Name, offset); err != nil { return false, err }
+	sinks[config.Name] = r
+	if err := storeSinkConfigs(); err != nil {
+		delete(sinks, config.Name)
+		return false, err
+	}
+	go r.run()
+	return true, nil
+}
+
+// RemoveBlockUpdatesSink stops delivery to a sink and forgets its offset.
+func (a *BlockUpdatesAdmin) RemoveBlockUpdatesSink(name string) (bool, error) {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	r, ok := sinks[name]
+	if !ok { return false, nil }
+	r.close()
+	delete(sinks, name)
+	if err := storeSinkConfigs(); err != nil { return false, err }
+	return true, a.backend.ChainDb().Delete(sinkOffsetKey(name))
+}
+
+// BlockUpdatesSinks reports the delivery progress of each sink.
+func (a *BlockUpdatesAdmin) BlockUpdatesSinks() []sinkStatus {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	result := make([]sinkStatus, 0, len(sinks))
+	for _, r := range sinks {
+		r.lock.Lock()
+		result = append(result, r.status)
+		r.lock.Unlock()
+	}
+	return result
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "updates.ndjson")
+	s, err := (&sinkConfig{Name: "file", Type: sinkFile, Target: path}).open()
+	if err != nil {
+		t.Fatalf("Error opening sink: %v", err.Error())
+	}
+	s.Send(context.Background(), []byte(`{"a":1}`))
+	s.Close()
+	// Reopening appends rather than truncating
+	s.Send(context.Background(), []byte(`{"a":2}`))
+	s.Close()
+	data, _ := os.ReadFile(path)
+	if string(data) != "{\"a\":1}\n{\"a\":2}\n" {
+		t.Errorf("Unexpected file contents %q", data)
+	}
+}
+
+func TestUnixSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sink.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Error listening: %v", err.Error())
+	}
+	defer l.Close()
+	lines := make(chan string, 2)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil { return }
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	s, _ := (&sinkConfig{Name: "unix", Type: sinkUnix, Target: path}).open()
+	defer s.Close()
+	for _, msg := range []string{`{"a":1}`, `{"a":2}`} {
+		if err := s.Send(context.Background(), []byte(msg)); err != nil {
+			t.Fatalf("Error sending: %v", err.Error())
+		}
+		if line := <-lines; line != msg {
+			t.Errorf("Unexpected line %q", line)
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var received []string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, string(body))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	s, _ := (&sinkConfig{Name: "webhook", Type: sinkWebhook, Target: server.URL}).open()
+	defer s.Close()
+	if err := s.Send(context.Background(), []byte(`{"a":1}`)); err != nil {
+		t.Errorf("Error sending: %v", err.Error())
+	}
+	status = http.StatusServiceUnavailable
+	if err := s.Send(context.Background(), []byte(`{"a":2}`)); err == nil {
+		t.Errorf("Expected an error for a failed delivery")
+	}
+	if len(received) != 2 || received[0] != `{"a":1}` {
+		t.Errorf("Unexpected requests %v", received)
+	}
+}
+
+func TestFollowCanonicalFromGenesis(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	account := core.HexToHash("0x01")
+	chain := []*types.Block{genesis}
+	for i := int64(1); i <= 3; i++ {
+		block := b.addBlock(chain[len(chain)-1], b.setState(map[core.Hash]*fullAccount{account: {Nonce: uint64(i), Balance: big.NewInt(i)}}, nil))
+		if _, err := regenerateAndStore(block); err != nil {
+			t.Fatalf("Error regenerating state update: %v", err.Error())
+		}
+		chain = append(chain, block)
+	}
+	var delivered []string
+	deliver := func(ctx context.Context, msg map[string]interface{}, next *sinkOffset) error {
+		n, _ := messageNumber(msg)
+		if removed, _ := msg["removed"].(bool); removed {
+			delivered = append(delivered, fmt.Sprintf("-%v:%x", n, messageHash(msg).Bytes()[:2]))
+		} else {
+			delivered = append(delivered, fmt.Sprintf("%v:%x", n, messageHash(msg).Bytes()[:2]))
+		}
+		return nil
+	}
+	name := func(block *types.Block) string { return fmt.Sprintf("%v:%x", block.NumberU64(), block.Hash().Bytes()[:2]) }
+	expected := fmt.Sprint([]string{name(chain[1]), name(chain[2]), name(chain[3])})
+
+	from := hexutil.Uint64(0)
+	offset, err := initialSinkOffset(&from)
+	if err != nil {
+		t.Fatalf("Error getting initial offset: %v", err.Error())
+	}
+	if offset.Number != 0 || offset.Hash != genesis.Hash() {
+		t.Fatalf("Unexpected initial offset %v", offset)
+	}
+	offset, err = followCanonical(context.Background(), offset, 3, deliver)
+	if err != nil {
+		t.Fatalf("Error following chain: %v", err.Error())
+	}
+	if fmt.Sprint(delivered) != expected || offset.Hash != chain[3].Hash() {
+		t.Errorf("Unexpected deliveries %v, offset %v", delivered, offset)
+	}
+
+	// Offsets stored without a genesis hash start after genesis too
+	delivered = nil
+	if _, err := followCanonical(context.Background(), &sinkOffset{}, 3, deliver); err != nil {
+		t.Fatalf("Error following chain: %v", err.Error())
+	}
+	if fmt.Sprint(delivered) != expected {
+		t.Errorf("Unexpected deliveries %v", delivered)
+	}
+
+	// A reorg after block 2 is delivered reverts it and continues on the
+	// new chain.
+	fork2 := b.addBlock(chain[1], b.setState(map[core.Hash]*fullAccount{account: {Nonce: 2, Balance: big.NewInt(20)}}, nil))
+	fork3 := b.addBlock(fork2, b.setState(map[core.Hash]*fullAccount{account: {Nonce: 3, Balance: big.NewInt(30)}}, nil))
+	for _, block := range []*types.Block{fork2, fork3} {
+		if _, err := regenerateAndStore(block); err != nil {
+			t.Fatalf("Error regenerating state update: %v", err.Error())
+		}
+	}
+	b.setCanonical(chain...)
+	delivered = nil
+	reorg := func(ctx context.Context, msg map[string]interface{}, next *sinkOffset) error {
+		if next.Hash == chain[2].Hash() {
+			b.setCanonical(fork2, fork3)
+		}
+		return deliver(ctx, msg, next)
+	}
+	offset, err = followCanonical(context.Background(), &sinkOffset{1, chain[1].Hash()}, 3, reorg)
+	if err != nil {
+		t.Fatalf("Error following chain: %v", err.Error())
+	}
+	expected = fmt.Sprint([]string{name(chain[2]), "-" + name(chain[2]), name(fork2), name(fork3)})
+	if fmt.Sprint(delivered) != expected || offset.Hash != fork3.Hash() {
+		t.Errorf("Unexpected deliveries %v, offset %v", delivered, offset)
+	}
+}
+
+func TestFollowCanonicalMissingStateUpdate(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	account := core.HexToHash("0x01")
+	chain := []*types.Block{genesis}
+	for i := int64(1); i <= 4; i++ {
+		chain = append(chain, b.addBlock(chain[i-1], b.setState(map[core.Hash]*fullAccount{account: {Nonce: uint64(i), Balance: big.NewInt(i)}}, nil)))
+	}
+	for _, i := range []int{1, 4} {
+		if _, err := regenerateAndStore(chain[i]); err != nil {
+			t.Fatalf("Error regenerating state update: %v", err.Error())
+		}
+	}
+	queued := len(suCh)
+	// Block 2 has its state and can be regenerated, block 3 cannot
+	delete(b.tries, chain[3].Root())
+	var delivered []string
+	deliver := func(ctx context.Context, msg map[string]interface{}, next *sinkOffset) error {
+		n, _ := messageNumber(msg)
+		if skipped(msg) {
+			delivered = append(delivered, fmt.Sprintf("skipped %v", n))
+		} else {
+			delivered = append(delivered, fmt.Sprint(n))
+		}
+		return nil
+	}
+	offset, err := followCanonical(context.Background(), &sinkOffset{0, genesis.Hash()}, 4, deliver)
+	if err != nil {
+		t.Fatalf("Error following chain: %v", err.Error())
+	}
+	if fmt.Sprint(delivered) != "[1 2 skipped 3 4]" || offset.Hash != chain[4].Hash() {
+		t.Errorf("Unexpected deliveries %v, offset %v", delivered, offset)
+	}
+	if len(suCh) != queued + 1 {
+		t.Errorf("Expected the regenerated state update to be queued for storage")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+var emptyCodeHash = crypto.Keccak256(nil)
+
+// fullAccount is the consensus representation of an account, as stored in the
+// state trie.
+type fullAccount struct {
+	Nonce uint64
+	Balance *big.Int
+	Root core.Hash
+	CodeHash []byte
+}
+
+// slimAccount is the snapshot representation of an account, as provided to the
+// StateUpdate hook. Empty storage roots and code hashes are omitted.
+type slimAccount struct {
+	Nonce uint64
+	Balance *big.Int
+	Root []byte
+	CodeHash []byte
+}
+
+// slimAccountRLP converts an account from its trie encoding to the slim
+// encoding used in state updates.
+func slimAccountRLP(data []byte) ([]byte, error) {
+	var acct fullAccount
+	if err := rlp.DecodeBytes(data, &acct); err != nil { return nil, err }
+	slim := slimAccount{Nonce: acct.Nonce, Balance: acct.Balance}
+	if acct.Root != types.EmptyRootHash {
+		slim.Root = acct.Root.Bytes()
+	}
+	if !bytes.Equal(acct.CodeHash, emptyCodeHash) {
+		slim.CodeHash = acct.CodeHash
+	}
+	return rlp.EncodeToBytes(slim)
+}
+
+// fullAccountFromSlim decodes a slim encoded account, filling in the empty
+// storage root and code hash where they were omitted.
+func fullAccountFromSlim(data []byte) (*fullAccount, error) {
+	var slim slimAccount
+	if err := rlp.DecodeBytes(data, &slim); err != nil { return nil, err }
+	acct := &fullAccount{Nonce: slim.Nonce, Balance: slim.Balance, Root: types.EmptyRootHash, CodeHash: emptyCodeHash}
+	if len(slim.Root) > 0 {
+		acct.Root = core.BytesToHash(slim.Root)
+	}
+	if len(slim.CodeHash) > 0 {
+		acct.CodeHash = slim.CodeHash
+	}
+	return acct, nil
+}
+
+// trieGet returns the value stored under key in the given trie, or nil if the
+// key is not present.
+func trieGet(t core.Trie, key core.Hash) ([]byte, error) {
+	it := t.NodeIterator(key.Bytes())
+	for it.Next(true) {
+		if it.Leaf() {
+			if bytes.Equal(it.LeafKey(), key.Bytes()) {
+				return core.CopyBytes(it.LeafBlob()), nil
+			}
+			return nil, nil
+		}
+	}
+	return nil, it.Error()
+}
+
+// stateReader provides read access to the accounts and storage of a state
+// root, keyed by hashed addresses and slots as in state updates. Storage tries
+// are opened by their root, which requires the node to use the hash based
+// trie scheme.
+type stateReader struct {
+	accounts core.Trie
+	storage map[core.Hash]core.Trie
+}
+
+func openState(root core.Hash) (*stateReader, error) {
+	t, err := backend.GetTrie(root)
+	if err != nil { return nil, err }
+	return &stateReader{accounts: t, storage: make(map[core.Hash]core.Trie)}, nil
+}
+
+// Account returns the trie encoded account for the given account hash, or nil
+// if the account does not exist.
+func (s *stateReader) Account(account core.Hash) (*fullAccount, error) {
+	data, err := trieGet(s.accounts, account)
+	if err != nil || data == nil { return nil, err }
+	acct := &fullAccount{}
+	if err := rlp.DecodeBytes(data, acct); err != nil { return nil, err }
+	return acct, nil
+}
+
+// SlimAccount returns the slim encoded account for the given account hash, or
+// nil if the account does not exist.
+func (s *stateReader) SlimAccount(account core.Hash) ([]byte, error) {
+	data, err := trieGet(s.accounts, account)
+	if err != nil || data == nil { return nil, err }
+	return slimAccountRLP(data)
+}
+
+func (s *stateReader) storageTrie(account core.Hash) (core.Trie, error) {
+	if t, ok := s.storage[account]; ok { return t, nil }
+	acct, err := s.Account(account)
+	if err != nil || acct == nil || acct.Root == types.EmptyRootHash { return nil, err }
+	t, err := backend.GetTrie(acct.Root)
+	if err != nil { return nil, err }
+	s.storage[account] = t
+	return t, nil
+}
+
+// Storage returns the RLP encoded value of a storage slot, or nil if the slot
+// is empty.
+func (s *stateReader) Storage(account, slot core.Hash) ([]byte, error) {
+	t, err := s.storageTrie(account)
+	if err != nil || t == nil { return nil, err }
+	return trieGet(t, slot)
+}
+
+// AllStorage returns every non-empty storage slot of an account.
+func (s *stateReader) AllStorage(account core.Hash) (map[core.Hash][]byte, error) {
+	result := make(map[core.Hash][]byte)
+	t, err := s.storageTrie(account)
+	if err != nil || t == nil { return result, err }
+	it := t.NodeIterator(nil)
+	for it.Next(true) {
+		if it.Leaf() {
+			result[core.BytesToHash(it.LeafKey())] = core.CopyBytes(it.LeafBlob())
+		}
+	}
+	return result, it.Error()
+}
+
+// invertStateUpdate builds the state update that would undo su when applied
+// on top of the state it produced, using the state at parentRoot for the
+// prior values. Accounts that did not exist before are marked as destructed,
+// and destructed accounts have their full prior storage restored.
+func invertStateUpdate(su *stateUpdate, parentRoot core.Hash) (*stateUpdate, error) {
+	parent, err := openState(parentRoot)
+	if err != nil { return nil, err }
+	inverse := &stateUpdate{
+		Destructs: make(map[core.Hash]struct{}),
+		Accounts: make(map[core.Hash][]byte),
+		Storage: make(map[core.Hash]map[core.Hash][]byte),
+		Code: make(map[core.Hash][]byte),
+	}
+	restore := func(account core.Hash) error {
+		if _, ok := inverse.Accounts[account]; ok { return nil }
+		prior, err := parent.SlimAccount(account)
+		if err != nil { return err }
+		if prior == nil {
+			inverse.Destructs[account] = struct{}{}
+			return nil
+		}
+		inverse.Accounts[account] = prior
+		return nil
+	}
+	for account := range su.Destructs {
+		if err := restore(account); err != nil { return nil, err }
+		storage, err := parent.AllStorage(account)
+		if err != nil { return nil, err }
+		if len(storage) > 0 {
+			inverse.Storage[account] = storage
+		}
+	}
+	for account := range su.Accounts {
+		if err := restore(account); err != nil { return nil, err }
+	}
+	for account, slots := range su.Storage {
+		if _, ok := inverse.Storage[account]; !ok {
+			inverse.Storage[account] = make(map[core.Hash][]byte)
+		}
+		for slot := range slots {
+			if _, ok := inverse.Storage[account][slot]; ok { continue }
+			prior, err := parent.Storage(account, slot)
+			if err != nil { return nil, err }
+			if prior == nil {
+				prior = []byte{}
+			}
+			inverse.Storage[account][slot] = prior
+		}
+	}
+	return inverse, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+func TestSlimAccountRLP(t *testing.T) {
+	full, _ := rlp.EncodeToBytes(fullAccount{Nonce: 3, Balance: big.NewInt(100), Root: types.EmptyRootHash, CodeHash: emptyCodeHash})
+	slim, err := slimAccountRLP(full)
+	if err != nil {
+		t.Fatalf("Error converting account: %v", err.Error())
+	}
+	expected, _ := rlp.EncodeToBytes(slimAccount{Nonce: 3, Balance: big.NewInt(100)})
+	if !bytes.Equal(slim, expected) {
+		t.Errorf("Unexpected slim account %x", slim)
+	}
+	acct, err := fullAccountFromSlim(slim)
+	if err != nil {
+		t.Fatalf("Error decoding slim account: %v", err.Error())
+	}
+	if acct.Root != types.EmptyRootHash || !bytes.Equal(acct.CodeHash, emptyCodeHash) || acct.Nonce != 3 {
+		t.Errorf("Unexpected account %v", acct)
+	}
+	root := core.HexToHash("0x1234")
+	full, _ = rlp.EncodeToBytes(fullAccount{Nonce: 1, Balance: big.NewInt(0), Root: root, CodeHash: []byte{1, 2}})
+	slim, _ = slimAccountRLP(full)
+	if acct, _ := fullAccountFromSlim(slim); acct.Root != root || !bytes.Equal(acct.CodeHash, []byte{1, 2}) {
+		t.Errorf("Unexpected account %v", acct)
+	}
+}
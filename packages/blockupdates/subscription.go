@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+// blockNumberOrHash identifies a block either by number or by hash, and can be
+// provided over RPC as either a hex encoded number (or block tag) or a hash.
+type blockNumberOrHash struct {
+	Number *restricted.BlockNumber
+	Hash *core.Hash
+}
+
+func (bnh *blockNumberOrHash) UnmarshalJSON(data []byte) error {
+	var input string
+	if err := json.Unmarshal(data, &input); err == nil && len(input) == 66 {
+		hash := core.HexToHash(input)
+		bnh.Hash = &hash
+		return nil
+	}
+	var number restricted.BlockNumber
+	if err := number.UnmarshalJSON(data); err != nil { return err }
+	bnh.Number = &number
+	return nil
+}
+
+// block retrieves the identified block. Blocks identified by hash must be on
+// the canonical chain.
+func (bnh *blockNumberOrHash) block(ctx context.Context, b restricted.Backend) (*types.Block, error) {
+	var blockBytes []byte
+	var err error
+	if bnh.Hash != nil {
+		blockBytes, err = b.BlockByHash(ctx, *bnh.Hash)
+	} else {
+		blockBytes, err = b.BlockByNumber(ctx, bnh.Number.Int64())
+	}
+	if err != nil { return nil, err }
+	block := new(types.Block)
+	if err := rlp.DecodeBytes(blockBytes, block); err != nil { return nil, err }
+	if bnh.Hash != nil {
+		canonicalBytes, err := b.BlockByNumber(ctx, int64(block.NumberU64()))
+		if err != nil { return nil, err }
+		var canonical types.Block
+		if err := rlp.DecodeBytes(canonicalBytes, &canonical); err != nil { return nil, err }
+		if canonical.Hash() != block.Hash() {
+			return nil, fmt.Errorf("block %#x is not on the canonical chain", block.Hash())
+		}
+	}
+	return block, nil
+}
+
+// messageHash returns the hash of the block a subscription message is about.
+func messageHash(msg map[string]interface{}) core.Hash {
+	hash, _ := msg["hash"].(core.Hash)
+	return hash
+}
+
+// errReplayReorg aborts sending a replayed block when a reorg is seen.
+var errReplayReorg = errors.New("reorg during replay")
+
+// replay sends the stored block updates from the given block number up to
+// the current head, recording the hash of each block sent. The head is
+// re-checked as replay catches up, so blocks that arrive during replay are
+// included. Replay waits for the client to take each message rather than
+// applying the slow consumer policy, so a long replay never leaves gaps.
+//
+// The live feed is drained while replaying so it never backs up. Live blocks
+// are left for replay to send by number. When blocks are removed by a reorg,
+// those the client saw are reported, and replay continues from the first
+// removed block on the new chain.
+func (b *BlockUpdates) replay(ctx context.Context, from uint64, s *subscriber, live <-chan map[string]interface{}, sent *lru.Cache) error {
+	var removals []map[string]interface{}
+	var liveHead uint64
+	rewind := uint64(math.MaxUint64)
+	watch := func(msg map[string]interface{}) {
+		n, _ := messageNumber(msg)
+		if removed, _ := msg["removed"].(bool); !removed {
+			if n > liveHead {
+				liveHead = n
+			}
+			return
+		}
+		if n <= liveHead && n > 0 {
+			liveHead = n - 1
+		}
+		if n < rewind {
+			rewind = n
+		}
+		if sent.Contains(messageHash(msg)) {
+			removals = append(removals, msg)
+		}
+	}
+	send := func(msg map[string]interface{}, abortOnReorg bool) error {
+		out, err := s.present(msg)
+		if err != nil || out == nil { return err }
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg := <-live:
+				watch(msg)
+				if abortOnReorg && rewind != math.MaxUint64 { return errReplayReorg }
+			case s.ch <- out:
+				s.sent(out)
+				return nil
+			}
+		}
+	}
+	head, err := decodeHeader(b.backend.CurrentHeader())
+	if err != nil { return err }
+	for n := from; ; {
+		if len(removals) > 0 {
+			msg := removals[0]
+			removals = removals[1:]
+			if err := send(msg, false); err != nil { return err }
+			sent.Remove(messageHash(msg))
+			continue
+		}
+		if rewind != math.MaxUint64 {
+			if rewind < n {
+				n = rewind
+			}
+			rewind = math.MaxUint64
+			if head, err = decodeHeader(b.backend.CurrentHeader()); err != nil { return err }
+		}
+		if n > head.Number.Uint64() && n > liveHead {
+			if head, err = decodeHeader(b.backend.CurrentHeader()); err != nil { return err }
+			if n > head.Number.Uint64() && n > liveHead { return nil }
+		}
+		if err := ctx.Err(); err != nil { return err }
+		blockBytes, err := b.backend.BlockByNumber(ctx, int64(n))
+		if err != nil { return fmt.Errorf("could not replay block %v: %v", n, err) }
+		var block types.Block
+		if err := rlp.DecodeBytes(blockBytes, &block); err != nil { return fmt.Errorf("could not replay block %v: %v", n, err) }
+		if sent.Contains(block.Hash()) {
+			n++
+			continue
+		}
+		result, err := blockUpdates(ctx, &block)
+		if err != nil { return fmt.Errorf("could not replay block %v: %v", n, err) }
+		if err := send(result, true); err == errReplayReorg {
+			continue
+		} else if err != nil {
+			return err
+		}
+		sent.Add(messageHash(result), struct{}{})
+		n++
+	}
+}
+
+// BlockUpdates allows clients to subscribe to notifications of new blocks
+// along with receipts and state updates. When blocks are removed by a reorg,
+// subscribers receive a message with `"removed": true` for each removed
+// block, carrying the state updates needed to revert it, before the blocks of
+// the new chain.
+//
+// If a starting block number or hash is provided, stored block updates are
+// replayed from that block (inclusive) before switching to live updates,
+// without gaps or duplicates. An error is returned if state updates for the
+// starting block are no longer available. Replay goes at the client's pace;
+// the slow consumer policy applies once it has caught up with live updates.
+//
+// Options control what happens when the client falls behind: "dropOldest"
+// discards the oldest undelivered messages, "disconnect" (the default) sends
+// an error message and closes the subscription, and "spill" buffers messages
+// on disk, up to maxSpillBytes, until the client catches up. An optional
+// filter in the options trims each message server side, as with
+// BlockUpdatesByNumber.
+func (b *BlockUpdates) BlockUpdates(ctx context.Context, start *blockNumberOrHash, opts *subscriptionOptions) (<-chan map[string]interface{}, error) {
+	if opts == nil {
+		opts = &subscriptionOptions{}
+	}
+	if err := opts.validate(); err != nil { return nil, err }
+	var startBlock *types.Block
+	if start != nil && (start.Hash != nil || start.Number.Int64() >= 0) {
+		var err error
+		if startBlock, err = start.block(ctx, b.backend); err != nil { return nil, err }
+		if _, err := loadStateUpdate(startBlock); err != nil {
+			return nil, fmt.Errorf("cannot resume from block %v, state updates have been pruned", startBlock.NumberU64())
+		}
+	}
+	blockDataChan := make(chan map[string]interface{}, 1000)
+	ch := make(chan map[string]interface{}, 1000)
+	s, err := newSubscriber(*opts, ch)
+	if err != nil { return nil, err }
+	sub := blockEvents.Subscribe(blockDataChan)
+	go func() {
+		log.Info("BlockUpdates subscription setup", "id", s.id, "policy", opts.Policy)
+		defer log.Info("BlockUpdates subscription closed", "id", s.id)
+		defer s.close()
+		// Replay drains live updates as it goes. Once it is done, we track
+		// what has been sent so that live blocks are not repeated, and blocks
+		// removed by a reorg are only reported if the subscriber saw them.
+		var sent *lru.Cache
+		if startBlock != nil {
+			sent, _ = lru.New(1024)
+			if err := b.replay(ctx, startBlock.NumberU64(), s, blockDataChan, sent); err != nil {
+				log.Warn("BlockUpdates replay failed", "id", s.id, "err", err)
+				s.fail(err)
+				sub.Unsubscribe()
+				close(ch)
+				return
+			}
+		}
+		for {
+			out, next := s.pending()
+			select {
+			case <-ctx.Done():
+				sub.Unsubscribe()
+				close(ch)
+				close(blockDataChan)
+				return
+			case b := <-blockDataChan:
+				if sent != nil {
+					hash := messageHash(b)
+					if removed, _ := b["removed"].(bool); removed {
+						if !sent.Contains(hash) { continue }
+						sent.Remove(hash)
+					} else {
+						if sent.Contains(hash) { continue }
+						sent.Add(hash, struct{}{})
+					}
+				}
+				if err := s.deliver(b); err != nil {
+					log.Warn("Closing BlockUpdates subscription", "id", s.id, "err", err)
+					s.fail(err)
+					sub.Unsubscribe()
+					close(ch)
+					return
+				}
+			case out <- next:
+				s.pendingSent()
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// BlockUpdatesSubscribers reports delivery statistics for each active
+// BlockUpdates subscription, including how many blocks it lags behind the
+// head of the chain.
+func (b *BlockUpdates) BlockUpdatesSubscribers(ctx context.Context) ([]subscriberStats, error) {
+	head, err := decodeHeader(b.backend.CurrentHeader())
+	if err != nil { return nil, err }
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+	result := make([]subscriberStats, 0, len(subscribers))
+	for _, s := range subscribers {
+		result = append(result, s.stats(head.Number.Uint64()))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+func TestReplay(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	account := core.HexToHash("0x01")
+	addBlock := func(parent *types.Block, balance int64) *types.Block {
+		block := b.addBlock(parent, b.setState(map[core.Hash]*fullAccount{account: {Nonce: uint64(balance), Balance: big.NewInt(balance)}}, nil))
+		if _, err := regenerateAndStore(block); err != nil {
+			t.Fatalf("Error regenerating state update: %v", err.Error())
+		}
+		return block
+	}
+	chain := []*types.Block{genesis}
+	for i := int64(1); i <= 6; i++ {
+		chain = append(chain, addBlock(chain[i-1], i))
+	}
+	name := func(msg map[string]interface{}) string {
+		n, _ := messageNumber(msg)
+		if removed, _ := msg["removed"].(bool); removed {
+			return fmt.Sprintf("-%v:%x", n, messageHash(msg).Bytes()[:2])
+		}
+		return fmt.Sprintf("%v:%x", n, messageHash(msg).Bytes()[:2])
+	}
+	liveMessage := func(block *types.Block, removed bool) map[string]interface{} {
+		return map[string]interface{}{"hash": block.Hash(), "number": (*hexutil.Big)(block.Number()), "removed": removed}
+	}
+
+	// An unbuffered client under the disconnect policy is never too slow for
+	// replay.
+	s, err := newSubscriber(subscriptionOptions{}, make(chan map[string]interface{}))
+	if err != nil {
+		t.Fatalf("Error creating subscriber: %v", err.Error())
+	}
+	defer s.close()
+	live := make(chan map[string]interface{}, 16)
+	sent, _ := lru.New(1024)
+	done := make(chan error, 1)
+	go func() {
+		done <- (&BlockUpdates{b}).replay(context.Background(), 1, s, live, sent)
+	}()
+	var received []string
+	for len(received) < 3 {
+		received = append(received, name(<-s.ch))
+	}
+
+	// Blocks 3 to 6 are replaced by a shorter chain while block 4 is on its
+	// way to the client.
+	fork3 := addBlock(chain[2], 30)
+	fork4 := addBlock(fork3, 40)
+	delete(b.canonical, 5)
+	delete(b.canonical, 6)
+	b.setCanonical(fork3, fork4)
+	for _, msg := range []map[string]interface{}{
+		liveMessage(chain[6], true),
+		liveMessage(chain[5], true),
+		liveMessage(chain[4], true),
+		liveMessage(chain[3], true),
+		liveMessage(fork3, false),
+		liveMessage(fork4, false),
+	} {
+		live <- msg
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(live) > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Replay is not draining the live feed")
+		}
+	}
+	for finished := false; !finished; {
+		select {
+		case msg := <-s.ch:
+			received = append(received, name(msg))
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Error replaying: %v", err.Error())
+			}
+			finished = true
+		}
+	}
+	expected := []string{
+		name(liveMessage(chain[1], false)),
+		name(liveMessage(chain[2], false)),
+		name(liveMessage(chain[3], false)),
+		name(liveMessage(chain[3], true)),
+		name(liveMessage(fork3, false)),
+		name(liveMessage(fork4, false)),
+	}
+	if fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected messages %v, expected %v", received, expected)
+	}
+	if s.stats(4).Dropped != 0 {
+		t.Errorf("Replay should not drop messages")
+	}
+}
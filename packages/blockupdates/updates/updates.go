@@ -0,0 +1,48 @@
+// Package updates defines the types the blockupdates plugin passes to the
+// hooks of downstream plugins. Plugins must import this package, rather than
+// copy its types, for their hooks to be recognized.
+package updates
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+// Version is the version of BlockUpdate passed to BlockUpdatesV2 hooks.
+// Fields may be added in later versions, but existing fields will not change.
+const Version = 2
+
+// BlockUpdate carries a block along with its receipts and state changes.
+// Withdrawals and blob fields are available from Block.
+//
+// When a reorg removes a block, BlockUpdatesV2 hooks receive it with Removed
+// set, and the state changes are the inverse of the block's own, restoring
+// the values from its parent's state. Reorg is set for both the removed
+// blocks and the blocks of the new chain delivered as part of a reorg.
+type BlockUpdate struct {
+	Version int
+	Block *types.Block
+	TD *big.Int
+	Receipts types.Receipts
+	Destructs map[core.Hash]struct{}
+	Accounts map[core.Hash][]byte
+	Storage map[core.Hash]map[core.Hash][]byte
+	Code map[core.Hash][]byte
+	Removed bool
+	Reorg *Reorg
+}
+
+// Reorg describes the reorg a block update was delivered as part of.
+type Reorg struct {
+	Common core.Hash
+	OldChain []core.Hash
+	NewChain []core.Hash
+}
+
+// Hook is the signature of a BlockUpdatesV2 hook. Plugins implement it as
+//
+//	func BlockUpdatesV2(ctx context.Context, update *updates.BlockUpdate)
+type Hook = func(context.Context, *BlockUpdate)
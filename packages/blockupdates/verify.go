@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted"
+	"github.com/openrelayxyz/plugeth-utils/restricted/crypto"
+	"github.com/openrelayxyz/plugeth-utils/restricted/hexutil"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+	"github.com/openrelayxyz/plugeth-utils/restricted/types"
+)
+
+const maxVerifyRange = 128
+
+var errStateUpdateMissing = errors.New("state update missing")
+
+type accountMismatch struct {
+	Account core.Hash `json:"account"`
+	Expected hexutil.Bytes `json:"expected"`
+	Applied hexutil.Bytes `json:"applied"`
+}
+
+type storageMismatch struct {
+	Account core.Hash `json:"account"`
+	Slot core.Hash `json:"slot"`
+	Expected hexutil.Bytes `json:"expected"`
+	Applied hexutil.Bytes `json:"applied"`
+}
+
+// verificationResult reports whether applying a stored state update to the
+// parent state gives the values found in the block's state, and where it does
+// not. No state root is computed.
+type verificationResult struct {
+	Hash core.Hash `json:"hash"`
+	Number hexutil.Uint64 `json:"number"`
+	Consistent bool `json:"consistent"`
+	Missing bool `json:"missing,omitempty"`
+	Accounts []accountMismatch `json:"accounts,omitempty"`
+	Storage []storageMismatch `json:"storage,omitempty"`
+	Code []core.Hash `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// appliedAccount returns the value an account has after applying su to the
+// parent state.
+func appliedAccount(su *stateUpdate, parent *stateReader, account core.Hash) ([]byte, error) {
+	if data, ok := su.Accounts[account]; ok {
+		if len(data) == 0 { return nil, nil }
+		return data, nil
+	}
+	if _, ok := su.Destructs[account]; ok { return nil, nil }
+	return parent.SlimAccount(account)
+}
+
+// appliedStorage returns the value a storage slot has after applying su to
+// the parent state.
+func appliedStorage(su *stateUpdate, parent *stateReader, account, slot core.Hash) ([]byte, error) {
+	if value, ok := su.Storage[account][slot]; ok {
+		if len(value) == 0 { return nil, nil }
+		return value, nil
+	}
+	if _, ok := su.Destructs[account]; ok { return nil, nil }
+	return parent.Storage(account, slot)
+}
+
+// verifyStateUpdate checks a stored state update key by key: for every
+// account and slot the state update touches, or that differs between the
+// parent and block tries, the value the state update gives on top of the
+// parent state must equal the value in the block's state. The plugin can only
+// read tries, so the diff is never applied to a trie and no root is
+// recomputed; this is a consistency check against the block's state, which
+// must still be available along with the parent's. Only the record in leveldb
+// or the freezer is checked, never the cache, and a block without one is
+// reported as missing rather than regenerated.
+func verifyStateUpdate(block *types.Block) *verificationResult {
+	result := &verificationResult{Hash: block.Hash(), Number: hexutil.Uint64(block.NumberU64())}
+	fail := func(err error) *verificationResult {
+		result.Error = err.Error()
+		return result
+	}
+	su, err := readStateUpdate(block.NumberU64(), block.Hash())
+	if err == errStateUpdateMissing { result.Missing = true }
+	if err != nil { return fail(err) }
+	parentBytes, err := backend.HeaderByHash(context.Background(), block.ParentHash())
+	if err != nil { return fail(err) }
+	parentHeader, err := decodeHeader(parentBytes)
+	if err != nil { return fail(err) }
+	parent, err := openState(parentHeader.Root)
+	if err != nil { return fail(fmt.Errorf("parent state unavailable: %v", err)) }
+	child, err := openState(block.Root())
+	if err != nil { return fail(fmt.Errorf("block state unavailable: %v", err)) }
+	actual, err := regenerateStateUpdate(block)
+	if err != nil { return fail(err) }
+
+	accounts := make(map[core.Hash]struct{})
+	for _, set := range []map[core.Hash]struct{}{su.Destructs, actual.Destructs} {
+		for account := range set {
+			accounts[account] = struct{}{}
+		}
+	}
+	for _, set := range []map[core.Hash][]byte{su.Accounts, actual.Accounts} {
+		for account := range set {
+			accounts[account] = struct{}{}
+		}
+	}
+	for _, set := range []map[core.Hash]map[core.Hash][]byte{su.Storage, actual.Storage} {
+		for account := range set {
+			accounts[account] = struct{}{}
+		}
+	}
+	for account := range accounts {
+		expected, err := child.SlimAccount(account)
+		if err != nil { return fail(err) }
+		applied, err := appliedAccount(su, parent, account)
+		if err != nil { return fail(err) }
+		if !bytes.Equal(expected, applied) {
+			result.Accounts = append(result.Accounts, accountMismatch{account, expected, applied})
+		}
+		if expected != nil {
+			acct, err := fullAccountFromSlim(expected)
+			if err != nil { return fail(err) }
+			if codeHash := core.BytesToHash(acct.CodeHash); actual.Code[codeHash] != nil {
+				if code, ok := su.Code[codeHash]; !ok || crypto.Keccak256Hash(code) != codeHash {
+					result.Code = append(result.Code, codeHash)
+				}
+			}
+		}
+		slots := make(map[core.Hash]struct{})
+		for slot := range su.Storage[account] {
+			slots[slot] = struct{}{}
+		}
+		for slot := range actual.Storage[account] {
+			slots[slot] = struct{}{}
+		}
+		if _, ok := su.Destructs[account]; ok {
+			// Everything the account held before must now be cleared or
+			// explicitly rewritten
+			prior, err := parent.AllStorage(account)
+			if err != nil { return fail(err) }
+			for slot := range prior {
+				slots[slot] = struct{}{}
+			}
+		}
+		for slot := range slots {
+			expected, err := child.Storage(account, slot)
+			if err != nil { return fail(err) }
+			applied, err := appliedStorage(su, parent, account, slot)
+			if err != nil { return fail(err) }
+			if !bytes.Equal(expected, applied) {
+				result.Storage = append(result.Storage, storageMismatch{account, slot, expected, applied})
+			}
+		}
+	}
+	sort.Slice(result.Accounts, func(i, j int) bool { return bytes.Compare(result.Accounts[i].Account[:], result.Accounts[j].Account[:]) < 0 })
+	sort.Slice(result.Storage, func(i, j int) bool {
+		if c := bytes.Compare(result.Storage[i].Account[:], result.Storage[j].Account[:]); c != 0 { return c < 0 }
+		return bytes.Compare(result.Storage[i].Slot[:], result.Storage[j].Slot[:]) < 0
+	})
+	result.Consistent = len(result.Accounts) == 0 && len(result.Storage) == 0 && len(result.Code) == 0
+	return result
+}
+
+// VerifyStateUpdate checks the stored state update for a block against the
+// block's state, reporting any accounts, slots or code that disagree. Both
+// the block's state and its parent's must still be available to the node. It
+// compares values rather than recomputing the state root.
+func (b *BlockUpdates) VerifyStateUpdate(ctx context.Context, hash core.Hash) (*verificationResult, error) {
+	blockBytes, err := b.backend.BlockByHash(ctx, hash)
+	if err != nil { return nil, err }
+	var block types.Block
+	if err := rlp.DecodeBytes(blockBytes, &block); err != nil { return nil, err }
+	return verifyStateUpdate(&block), nil
+}
+
+// VerifyStateUpdatesRange verifies the stored state updates for a range of
+// canonical blocks, up to 128 blocks at a time.
+func (b *BlockUpdates) VerifyStateUpdatesRange(ctx context.Context, from, to restricted.BlockNumber) ([]*verificationResult, error) {
+	head, err := decodeHeader(b.backend.CurrentHeader())
+	if err != nil { return nil, err }
+	if to < 0 || uint64(to) > head.Number.Uint64() {
+		to = restricted.BlockNumber(head.Number.Uint64())
+	}
+	if from < 0 || to < from {
+		return nil, fmt.Errorf("invalid range %v - %v", from.Int64(), to.Int64())
+	}
+	if to - from >= maxVerifyRange {
+		return nil, fmt.Errorf("range too large, at most %v blocks may be verified at a time", maxVerifyRange)
+	}
+	results := make([]*verificationResult, 0, to - from + 1)
+	for n := from; n <= to; n++ {
+		if err := ctx.Err(); err != nil { return nil, err }
+		blockBytes, err := b.backend.BlockByNumber(ctx, n.Int64())
+		if err != nil { return nil, err }
+		var block types.Block
+		if err := rlp.DecodeBytes(blockBytes, &block); err != nil { return nil, err }
+		results = append(results, verifyStateUpdate(&block))
+	}
+	return results, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/openrelayxyz/plugeth-utils/core"
+	"github.com/openrelayxyz/plugeth-utils/restricted/rlp"
+)
+
+func TestVerifyStateUpdate(t *testing.T) {
+	b, genesis := newTestBackend(t)
+	account, slot := core.HexToHash("0x01"), core.HexToHash("0x10")
+	one := b.addBlock(genesis, b.setState(map[core.Hash]*fullAccount{account: {Nonce: 1, Balance: big.NewInt(100)}}, nil))
+	two := b.addBlock(one, b.setState(map[core.Hash]*fullAccount{account: {Nonce: 2, Balance: big.NewInt(90)}}, map[core.Hash]map[core.Hash][]byte{account: {slot: {0x01}}}))
+	su, err := regenerateStateUpdate(two)
+	if err != nil {
+		t.Fatalf("Error regenerating state update: %v", err.Error())
+	}
+	store := func(su *stateUpdate) {
+		data, err := encodeStoredStateUpdate(su)
+		if err != nil {
+			t.Fatalf("Error encoding state update: %v", err.Error())
+		}
+		b.db.Put(suKey(two.NumberU64(), two.Hash()), data)
+	}
+	store(su)
+	if result := verifyStateUpdate(two); !result.Consistent || result.Error != "" {
+		t.Fatalf("Expected stored state update to verify: %v", result)
+	}
+
+	// The correct state update stays in the cache, but the stored record is
+	// what gets verified.
+	cache.Add(two.Hash(), su)
+	tampered, _ := rlp.EncodeToBytes(slimAccount{Nonce: 2, Balance: big.NewInt(1000)})
+	store(&stateUpdate{
+		Destructs: map[core.Hash]struct{}{},
+		Accounts: map[core.Hash][]byte{account: tampered},
+		Storage: su.Storage,
+		Code: map[core.Hash][]byte{},
+	})
+	result := verifyStateUpdate(two)
+	if result.Consistent || result.Error != "" {
+		t.Fatalf("Expected tampered state update to fail verification: %v", result)
+	}
+	if len(result.Accounts) != 1 || result.Accounts[0].Account != account || len(result.Storage) != 0 {
+		t.Errorf("Unexpected mismatches: %v %v", result.Accounts, result.Storage)
+	}
+
+	b.db.Delete(suKey(two.NumberU64(), two.Hash()))
+	if result := verifyStateUpdate(two); result.Consistent || !result.Missing {
+		t.Errorf("Expected missing state update to be reported: %v", result)
+	}
+	if len(suCh) != 0 {
+		t.Errorf("Verification should not regenerate state updates")
+	}
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/openrelayxyz/plugeth-utils/core"
 	"github.com/openrelayxyz/plugeth-utils/restricted"
@@ -67,19 +68,12 @@ func Initialize(ctx core.Context, loader core.PluginLoader, logger core.Logger)
 }
 
 func (pt *ParityTrace) blockStringProcessing (ctx context.Context, bkNum string) (string, error) {
-	var err error
-	var currentBlockString string
-	var currentBlockUint64 uint64
 	var result string
-	client, err := pt.stack.Attach()
-	if err != nil {
-		return "", err
-	}
-	client.Call(&currentBlockString, "eth_blockNumber")
-	currentBlockUint64, err = hexutil.DecodeUint64(currentBlockString)
-	if err != nil {
+	header := types.Header{}
+	if err := rlp.DecodeBytes(pt.backend.CurrentHeader(), &header); err != nil {
 		return "", err
 	}
+	currentBlockUint64 := header.Number.Uint64()
 	switch bkNum {
 	case "latest":
 		result = hexutil.EncodeUint64(currentBlockUint64 -1)
@@ -216,9 +210,6 @@ func (pt *ParityTrace) ReplayBlockTransactions(ctx context.Context, bkNum string
 		if typ == "trace" {
 				raw.TraceVar, traceOutputs, err = pt.TraceVariantBlock(ctx, bn)
 					if err != nil {return nil, err}
-				for _, item := range traceOutputs {
-					traceOutputs = append(traceOutputs, item)
-					}
 					outputs = append(outputs, traceOutputs)
 				}
 		if typ == "vmTrace" {
@@ -256,6 +247,14 @@ func (pt *ParityTrace) ReplayBlockTransactions(ctx context.Context, bkNum string
 	}
 
 	transactions := block.Transactions()
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("no known trace type requested")
+	}
+	for _, out := range outputs {
+		if len(out) != len(transactions) {
+			return nil, fmt.Errorf("traced %v of %v transactions in block %v", len(out), len(transactions), blockNM)
+		}
+	}
 	results := make([]FinalResult, len(transactions))
 	for i := range results {
 		if outputs[0][i] == "" {
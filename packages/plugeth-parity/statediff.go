@@ -79,9 +79,11 @@ func (sd *ParityTrace) StateDiffVariantCall(ctx context.Context, txObject map[st
 	}
 	tr := SDTracerService{}
 	err = client.Call(&tr, "debug_traceCall", txObject, bkNum, map[string]string{"tracer": "plugethStateDiffTracer"})
+	if err != nil {
+		return nil, "", err
+	}
 
 	object, output := tr.ReturnObj, hexutil.Encode(tr.Output)
-	log.Warn("inside sd function")
 	return object, output, err
 }
 
@@ -92,6 +94,9 @@ func (sd *ParityTrace) StateDiffVariantTransaction(ctx context.Context, txHash c
 	}
 	tr := SDTracerService{}
 	err = client.Call(&tr, "debug_traceTransaction", txHash, map[string]string{"tracer": "plugethStateDiffTracer"})
+	if err != nil {
+		return nil, "", err
+	}
 
 	result, output := tr.ReturnObj, hexutil.Encode(tr.Output)
 
@@ -177,7 +177,10 @@ func (tr *ParityTrace) TraceVariantCall(ctx context.Context, txObject map[string
 		return nil, "", err
 	}
 	gr := GethResponse{}
-	client.Call(&gr, "debug_traceCall", txObject, bkNum, map[string]string{"tracer": "callTracer"})
+	err = client.Call(&gr, "debug_traceCall", txObject, bkNum, map[string]string{"tracer": "callTracer"})
+	if err != nil {
+		return nil, "", err
+	}
 	tAddress := make([]int, 0)
 	gp := GethParity(gr, tAddress, strings.ToLower(gr.Type))
 	if gr.Output == "" {
@@ -194,7 +197,10 @@ func (tr *ParityTrace) TraceVariantTransaction(ctx context.Context, txHash core.
 		return nil, "", err
 	}
 	gr := GethResponse{}
-	client.Call(&gr, "debug_traceTransaction", txHash, map[string]string{"tracer": "callTracer"})
+	err = client.Call(&gr, "debug_traceTransaction", txHash, map[string]string{"tracer": "callTracer"})
+	if err != nil {
+		return nil, "", err
+	}
 	tAddress := make([]int, 0)
 	gp := GethParity(gr, tAddress, strings.ToLower(gr.Type))
 	if gr.Output == "" {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGethParity(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "callTracer.json"))
+	if err != nil {
+		t.Fatalf("Error reading fixture: %v", err.Error())
+	}
+	gr := GethResponse{}
+	if err := json.Unmarshal(data, &gr); err != nil {
+		t.Fatalf("Error decoding fixture: %v", err.Error())
+	}
+	traces := GethParity(gr, make([]int, 0), strings.ToLower(gr.Type))
+	// The precompile call is filtered out
+	if len(traces) != 4 {
+		t.Fatalf("Expected 4 traces, got %v", len(traces))
+	}
+
+	// The top level call carries callTracer's gas and gasUsed, which include
+	// intrinsic gas, through unchanged.
+	top := traces[0]
+	if top.Type != "call" || top.Action.CallType != "call" || top.SubTraces != 2 || len(top.TracerAddress) != 0 {
+		t.Errorf("Unexpected top level trace %+v", top)
+	}
+	if top.Action.Gas != "0x30d40" || top.Result.GasUsed != "0x1d8a8" || top.Result.Output != gr.Output {
+		t.Errorf("Unexpected top level gas or output %+v %+v", top.Action, top.Result)
+	}
+
+	delegate := traces[1]
+	if delegate.Action.CallType != "delegatecall" || delegate.Action.Value != "0x0" || delegate.SubTraces != 1 || !equalAddress(delegate.TracerAddress, 0) {
+		t.Errorf("Unexpected delegatecall trace %+v %+v", delegate, delegate.Action)
+	}
+
+	create := traces[2]
+	if create.Type != "create" || create.Result.Address != "0x9fe46736679d2d9a65f0992f2272de9f3c7fa6e0" || create.Action.Init == "" || !equalAddress(create.TracerAddress, 0, 0) {
+		t.Errorf("Unexpected create trace %+v %+v", create, create.Result)
+	}
+	if create.Result.Code != "0x6080604052600080fdfea164736f6c6343000813000a" || create.Result.GasUsed != "0xd3e2" {
+		t.Errorf("Unexpected create result %+v", create.Result)
+	}
+
+	reverted := traces[3]
+	if reverted.Error != "Reverted" || reverted.Result != nil || reverted.Type != "call" || !equalAddress(reverted.TracerAddress, 1) {
+		t.Errorf("Unexpected reverted trace %+v", reverted)
+	}
+}
+
+func equalAddress(address []int, expected ...int) bool {
+	if len(address) != len(expected) {
+		return false
+	}
+	for i := range address {
+		if address[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
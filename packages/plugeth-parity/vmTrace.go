@@ -55,6 +55,9 @@ func (vm *ParityTrace) VMTraceVariantCall(ctx context.Context, txObject map[stri
 	}
 	tr := VMTracerService{}
 	err = client.Call(&tr, "debug_traceCall", txObject, bkNum, map[string]string{"tracer": "plugethVMTracer"})
+	if err != nil {
+		return nil, "", err
+	}
 
 	result, output := tr, hexutil.Encode(tr.Output)
 	return result, output, nil
@@ -67,6 +70,9 @@ func (vm *ParityTrace) VMTraceVariantTransaction(ctx context.Context, txHash cor
 	}
 	tr := VMTracerService{}
 	err = client.Call(&tr, "debug_traceTransaction", txHash, map[string]string{"tracer": "plugethVMTracer"})
+	if err != nil {
+		return nil, "", err
+	}
 
 	result, output := tr.CurrentTrace, hexutil.Encode(tr.Output)
 	return result, output, nil
@@ -80,6 +86,7 @@ func (vm *ParityTrace) VMTraceVariantBlock(ctx context.Context, bkNum string) ([
 		Result VMTracerService
 		}{}
 		err = client.Call(&tr, "debug_traceBlockByNumber", bkNum, map[string]string{"tracer": "plugethVMTracer"})
+		if err != nil {return nil, err}
 		r := tr
 		return r, nil
 	}